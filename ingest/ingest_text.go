@@ -3,7 +3,10 @@
 //
 // This version uses text embeddings on the enriched descriptions from
 // describe_gifs.py. Antfly's built-in termite handles embedding automatically
-// via the configured Embedder on the index (no direct termite calls).
+// via the configured Embedder on the index (no direct termite calls), unless
+// -client-embed asks for the vectors to be computed here and stored in
+// _embeddings, so they can be exported or reused without re-embedding
+// (search such tables with search.go -client-embed).
 //
 // Prerequisites:
 // - Antfly running: antfly swarm
@@ -11,41 +14,99 @@
 // - Description file: gif_descriptions.jsonl (from describe_gifs.py)
 //
 // Run: go run ingest_text.go
+//
+// Ingest alongside the describe pipeline, tailing its output (Ctrl-C is
+// safe; the next -watch run resumes from the saved offset):
+//   go run ingest_text.go -skip-create -watch
 
 package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/antflydb/antfly-go/antfly"
 	"github.com/antflydb/antfly-go/antfly/oapi"
+	"github.com/antflydb/antfly-go/antfly/query"
 )
 
 var (
-	antflyURL   = flag.String("url", "http://localhost:8080/api/v1", "Antfly API URL")
-	jsonlPath   = flag.String("jsonl", "../gif_descriptions.jsonl", "Path to descriptions JSONL file")
-	tableName   = flag.String("table", "tgif_gifs_text", "Antfly table name")
-	batchSize   = flag.Int("batch", 50, "Batch size for inserts")
-	limit       = flag.Int("limit", 0, "Limit number of GIFs to import (0 = all)")
-	skipCreate  = flag.Bool("skip-create", false, "Skip table creation")
-	embedModel  = flag.String("embed-model", "BAAI/bge-small-en-v1.5", "Text embedding model")
-	dimension   = flag.Int("dimension", 384, "Embedding dimension (384 for bge-small)")
-	attribution = flag.String("attribution", "", "Default attribution for docs missing one (e.g., 'TGIF dataset')")
+	antflyURL     = flag.String("url", "http://localhost:8080/api/v1", "Antfly API URL")
+	jsonlPath     = flag.String("jsonl", "../gif_descriptions.jsonl", "Path to descriptions JSONL file")
+	tableName     = flag.String("table", "tgif_gifs_text", "Antfly table name")
+	batchSize     = flag.Int("batch", 50, "Batch size for inserts")
+	limit         = flag.Int("limit", 0, "Limit number of GIFs to import (0 = all)")
+	skipCreate    = flag.Bool("skip-create", false, "Skip table creation")
+	lockFile      = flag.String("lock-file", "", "Advisory lock held while creating the table, so concurrent runs can't race on setup (default: <tmp>/gif-picker-<table>.lock)")
+	force         = flag.Bool("force", false, "Take over the -lock-file even if another run seems to hold it (e.g., left behind by a crash)")
+	verifyCreate  = flag.Bool("verify-after-create", false, "After creating the table, insert a probe doc, find it by semantic search and delete it; abort if the table can't serve queries")
+	embedModel    = flag.String("embed-model", "BAAI/bge-small-en-v1.5", "Text embedding model")
+	dimension     = flag.Int("dimension", 384, "Embedding dimension (384 for bge-small)")
+	attribution   = flag.String("attribution", "", "Default attribution for docs missing one (e.g., 'TGIF dataset')")
+	fullTextIndex = flag.Bool("full-text-index", true, "Also create a BM25 full-text index for hybrid search")
+	dataset       = flag.String("dataset", "", "Dataset tag stored as 'dataset' on every doc (e.g., 'tgif')")
+	embedFields   = flag.String("embed-fields", "literal,source,mood,action,context,tags", "Description fields folded into combined_text (the embedded text)")
+	storeFields   = flag.String("store-fields", "literal,source,mood,action,context,tags", "Description fields stored as structured doc fields for filtering")
+
+	progressInterval  = flag.Duration("progress-interval", 2*time.Second, "How often to print progress (0 = after every batch)")
+	caCert            = flag.String("ca-cert", "", "PEM bundle of extra root CAs for TLS to Antfly")
+	idleConnTimeout   = flag.Duration("idle-conn-timeout", 30*time.Second, "Close pooled Antfly connections idle this long, before a proxy drops them while -watch waits for new lines (0 = never)")
+	validate          = flag.Bool("validate", false, "Check the JSONL for schema problems and exit (no Antfly calls)")
+	sanitize          = flag.Bool("sanitize", false, "Clean description fields: unescape HTML entities, strip markup and control characters, collapse whitespace")
+	requireEmbedder   = flag.Bool("require-embedder-match", true, "With -skip-create, fail unless the table's embeddings index uses -embed-model")
+	dedupeByDesc      = flag.Bool("dedupe-by-description", false, "Skip docs whose normalized combined_text was already ingested this run, keeping the first")
+	maxPerSource      = flag.Int("max-per-source", 0, "Cap docs per distinct source (e.g., one TV show) so none dominates (0 = no cap; empty/\"unknown\" are never capped)")
+	blocklistFile     = flag.String("blocklist", "", "Skip docs whose description fields or tags contain any term in this file (one term or phrase per line, # comments; whole words, case-insensitive)")
+	minTags           = flag.Int("min-tags", 0, "Skip docs with fewer than this many distinct tags (case/whitespace-insensitive), a quality gate for thin descriptions")
+	skipExisting      = flag.Bool("skip-existing", false, "Before each insert, look up the batch's docs and drop those already stored with the same text_hash, so re-runs only re-embed changed descriptions")
+	watch             = flag.Bool("watch", false, "Keep tailing -jsonl for appended lines (e.g., while describe_gifs.py runs), resuming from -watch-offset")
+	watchOffset       = flag.String("watch-offset", "", "File persisting the -watch byte offset (default: <jsonl>.offset)")
+	watchInterval     = flag.Duration("watch-interval", 2*time.Second, "How often -watch polls for new lines once caught up")
+	head              = flag.Int("head", 0, "Print the docs built from the first N lines as JSON and exit (no Antfly calls)")
+	strictJSON        = flag.Bool("strict-json", false, "Reject lines with keys GIFDescription doesn't know (catches typos like 'literaI')")
+	descriptionsMode  = flag.String("descriptions-mode", "join", "How to embed a 'descriptions' array: join (append to combined_text) or multi (one vector index per description)")
+	multilingualModel = flag.String("multilingual-model", "", "Embed non-English docs with this model into an 'embeddings_multilingual' index (e.g., 'sentence-transformers/paraphrase-multilingual-MiniLM-L12-v2')")
+	multilingualDim   = flag.Int("multilingual-dimension", 384, "Embedding dimension of -multilingual-model")
+	maxDescriptions   = flag.Int("max-descriptions", 3, "With -descriptions-mode multi, how many description_N fields and indexes to create")
+	clientEmbed       = flag.Bool("client-embed", false, "Embed text via Termite here and store the vectors in _embeddings, creating indexes without a server-side embedder (portable vectors, like main.go)")
+	termiteURL        = flag.String("termite-url", "http://localhost:11433", "Termite API URL for -client-embed")
+	termiteHeaders    = headerFlag("termite-header", "Header sent with every Termite request, as key=value (repeatable; e.g., for an auth gateway)")
+	antflyHeaders     = headerFlag("antfly-header", "Header sent with every Antfly request, as key=value (repeatable)")
+	ci                = flag.Bool("ci", false, "CI-friendly output: one progress line per interval (no \\r), no cosmetic sleeps, periodic heartbeats")
+	heartbeat         = flag.Duration("heartbeat", time.Minute, "With -ci, print a heartbeat after this long without output")
+	ingestTime        = flag.String("ingest-time", "", "RFC3339 timestamp stored as ingested_at on every doc, for reproducible runs (default: when each doc is built)")
 )
 
 // GIFDescription matches the output of describe_gifs.py and describe_sources.py
 type GIFDescription struct {
-	ID                  string          `json:"id"`          // Optional: manifest ID (used as doc ID if present)
+	ID                  string          `json:"id"` // Optional: manifest ID (used as doc ID if present)
 	URL                 string          `json:"url"`
 	Attribution         string          `json:"attribution"` // Optional: source page URL for credit
 	OriginalDescription string          `json:"original_description"`
@@ -55,6 +116,161 @@ type GIFDescription struct {
 	Action              json.RawMessage `json:"action"` // Can be string or []string
 	Context             string          `json:"context"`
 	Tags                []string        `json:"tags"`
+	Descriptions        []string        `json:"descriptions"` // Optional: candidate descriptions from several models
+	Lang                string          `json:"lang"`         // Optional: ISO 639-1 code; detected from the text when empty
+}
+
+// IsEnglish reports whether the doc should go to the English embedder,
+// trusting the lang field and falling back to detection
+func (g *GIFDescription) IsEnglish(text string) bool {
+	if g.Lang != "" {
+		return strings.HasPrefix(strings.ToLower(g.Lang), "en")
+	}
+	return looksEnglish(text)
+}
+
+// englishStopwords are frequent enough that any real English caption has some
+var englishStopwords = map[string]bool{
+	"the": true, "a": true, "an": true, "and": true, "of": true, "to": true,
+	"in": true, "is": true, "on": true, "with": true, "at": true, "his": true,
+	"her": true, "their": true, "it": true, "while": true, "into": true,
+}
+
+// looksEnglish is a cheap language guess: mostly ASCII letters, and for
+// anything longer than a few words, at least one English stopword
+func looksEnglish(text string) bool {
+	letters, ascii := 0, 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if r < unicode.MaxASCII {
+				ascii++
+			}
+		}
+	}
+	if letters == 0 {
+		return true
+	}
+	if float64(ascii) < 0.8*float64(letters) {
+		return false
+	}
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) < 4 {
+		return true
+	}
+	for _, w := range words {
+		if englishStopwords[strings.Trim(w, ".,!?;:")] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDescription decodes one JSONL line. With -strict-json an unknown key
+// is an error naming the key, instead of a silently empty field.
+func parseDescription(line []byte) (GIFDescription, error) {
+	var desc GIFDescription
+	if !*strictJSON {
+		err := json.Unmarshal(line, &desc)
+		return desc, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&desc)
+	return desc, err
+}
+
+// Sanitize cleans every free-text field in place
+func (g *GIFDescription) Sanitize() {
+	g.OriginalDescription = sanitizeText(g.OriginalDescription)
+	g.Literal = sanitizeText(g.Literal)
+	g.Source = sanitizeText(g.Source)
+	g.Mood = sanitizeText(g.Mood)
+	g.Context = sanitizeText(g.Context)
+	for i, tag := range g.Tags {
+		g.Tags[i] = sanitizeText(tag)
+	}
+	for i, d := range g.Descriptions {
+		g.Descriptions[i] = sanitizeText(d)
+	}
+}
+
+// FreeText lists every free-text field, tags included, for -blocklist
+func (g *GIFDescription) FreeText() []string {
+	texts := []string{g.OriginalDescription, g.Literal, g.Source, g.Mood, g.ActionString(), g.Context}
+	texts = append(texts, g.Tags...)
+	return append(texts, g.Descriptions...)
+}
+
+// blocklist is the loaded -blocklist, nil without one
+var blocklist *termBlocklist
+
+// termBlocklist and loadBlocklist are main.go's -blocklist matcher, copied
+// since each program is one file; change them together
+type termBlocklist struct {
+	re *regexp.Regexp
+}
+
+func loadBlocklist(path string) (*termBlocklist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read blocklist: %w", err)
+	}
+	var terms []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words := strings.Fields(line)
+		for i, w := range words {
+			words[i] = regexp.QuoteMeta(w)
+		}
+		terms = append(terms, strings.Join(words, `\s+`))
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("blocklist %s has no terms", path)
+	}
+	re, err := regexp.Compile(`(?i)(?:^|[^\pL\pN_])(?:` + strings.Join(terms, "|") + `)(?:$|[^\pL\pN_])`)
+	if err != nil {
+		return nil, fmt.Errorf("compile blocklist: %w", err)
+	}
+	return &termBlocklist{re: re}, nil
+}
+
+// Match reports whether any of the texts contains a blocked term; a nil
+// blocklist matches nothing
+func (b *termBlocklist) Match(texts ...string) bool {
+	if b == nil {
+		return false
+	}
+	for _, t := range texts {
+		if b.re.MatchString(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// markupRegex and sanitizeText are main.go's -sanitize, copied so both
+// tables clean text identically; change them together
+var markupRegex = regexp.MustCompile(`<[^>]*>`)
+
+func sanitizeText(text string) string {
+	text = html.UnescapeString(text)
+	text = markupRegex.ReplaceAllString(text, " ")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// normalizeText is sanitizeText plus lowercasing, for comparing descriptions
+func normalizeText(text string) string {
+	return strings.ToLower(sanitizeText(text))
 }
 
 // DocID returns the document ID, preferring the manifest ID if present.
@@ -81,34 +297,266 @@ func (g *GIFDescription) ActionString() string {
 	return ""
 }
 
-// CombinedText creates a searchable text blob from all description fields
-func (g *GIFDescription) CombinedText() string {
-	parts := []string{
-		g.Literal,
-		"Source: " + g.Source,
-		"Mood: " + g.Mood,
-		"Actions: " + g.ActionString(),
-		"Use case: " + g.Context,
-		"Tags: " + strings.Join(g.Tags, ", "),
+// Validate returns the schema problems with a parsed description, if any
+func (g *GIFDescription) Validate() []string {
+	var problems []string
+	if strings.TrimSpace(g.URL) == "" {
+		problems = append(problems, "missing url")
+	}
+	if strings.TrimSpace(g.Literal) == "" && len(g.Descriptions) == 0 {
+		problems = append(problems, "empty literal")
+	}
+	if len(g.Action) > 0 && string(g.Action) != "null" {
+		var s string
+		var arr []string
+		if json.Unmarshal(g.Action, &s) != nil && json.Unmarshal(g.Action, &arr) != nil {
+			problems = append(problems, fmt.Sprintf("action must be a string or array of strings, got %s", g.Action))
+		}
+	}
+	return problems
+}
+
+// describedFields are the enriched fields -embed-fields and -store-fields choose from
+var describedFields = []string{"literal", "source", "mood", "action", "context", "tags"}
+
+// parseFieldSet parses a comma-separated subset of describedFields
+func parseFieldSet(name, list string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		known := false
+		for _, d := range describedFields {
+			known = known || d == f
+		}
+		if !known {
+			return nil, fmt.Errorf("-%s: unknown field %q (want any of %s)", name, f, strings.Join(describedFields, ","))
+		}
+		set[f] = true
+	}
+	return set, nil
+}
+
+// CombinedText creates a searchable text blob from the selected description fields
+func (g *GIFDescription) CombinedText(fields map[string]bool) string {
+	var parts []string
+	if fields["literal"] {
+		parts = append(parts, g.Literal)
+	}
+	if fields["source"] {
+		parts = append(parts, "Source: "+g.Source)
+	}
+	if fields["mood"] {
+		parts = append(parts, "Mood: "+g.Mood)
+	}
+	if fields["action"] {
+		parts = append(parts, "Actions: "+g.ActionString())
+	}
+	if fields["context"] {
+		parts = append(parts, "Use case: "+g.Context)
+	}
+	if fields["tags"] {
+		parts = append(parts, "Tags: "+strings.Join(g.Tags, ", "))
+	}
+	if *descriptionsMode == "join" {
+		for _, d := range g.Descriptions {
+			if strings.TrimSpace(d) != "" {
+				parts = append(parts, d)
+			}
+		}
 	}
 	return strings.Join(parts, ". ")
 }
 
+// descriptionField names the doc field (and index) for the i'th description in multi mode
+func descriptionField(i int) string {
+	return fmt.Sprintf("description_%d", i)
+}
+
+// DescriptionFields spreads the descriptions over description_N fields for
+// -descriptions-mode multi, so each gets its own vector in the same doc.
+// It reports how many were dropped past -max-descriptions.
+func (g *GIFDescription) DescriptionFields() (map[string]any, int) {
+	fields := make(map[string]any)
+	n := 0
+	for _, d := range g.Descriptions {
+		if strings.TrimSpace(d) == "" {
+			continue
+		}
+		if n == *maxDescriptions {
+			return fields, len(g.Descriptions) - n
+		}
+		fields[descriptionField(n)] = d
+		n++
+	}
+	return fields, 0
+}
+
+// StoredFields returns the selected description fields as doc fields
+func (g *GIFDescription) StoredFields(fields map[string]bool) map[string]any {
+	all := map[string]any{
+		"literal": g.Literal,
+		"source":  g.Source,
+		"mood":    g.Mood,
+		"action":  g.Action,
+		"context": g.Context,
+		"tags":    g.Tags,
+	}
+	stored := make(map[string]any, len(fields))
+	for f := range fields {
+		stored[f] = all[f]
+	}
+	if len(g.Descriptions) > 0 {
+		stored["descriptions"] = g.Descriptions
+	}
+	return stored
+}
+
+// schemaVersion is stamped on every text doc as schema_version. It's
+// versioned apart from main.go's image docs, whose migrate subcommand
+// doesn't apply here: bump it when text docs gain a field.
+const schemaVersion = 1
+
+// BuildDoc assembles the Antfly document for a description, reporting how
+// many descriptions -max-descriptions dropped
+func (g *GIFDescription) BuildDoc(embedSet, storeSet map[string]bool) (map[string]any, int) {
+	// Create combined text for embedding (Antfly will embed this via the configured Field)
+	text := g.CombinedText(embedSet)
+
+	doc := g.StoredFields(storeSet)
+	doc["gif_url"] = g.URL
+	doc["original_description"] = g.OriginalDescription
+	doc["ingested_at"] = ingestedAt()
+	doc["schema_version"] = schemaVersion
+	// Every doc keeps combined_text, which full-text search matches on
+	doc["combined_text"] = text
+	if *multilingualModel != "" && !g.IsEnglish(text) {
+		doc["combined_text_multilingual"] = text
+	}
+	if g.Lang != "" {
+		doc["lang"] = g.Lang
+	}
+	if g.Attribution != "" {
+		doc["attribution"] = g.Attribution
+	} else if *attribution != "" {
+		doc["attribution"] = *attribution
+	}
+	if *dataset != "" {
+		doc["dataset"] = *dataset
+	}
+	dropped := 0
+	if *descriptionsMode == "multi" {
+		var fields map[string]any
+		fields, dropped = g.DescriptionFields()
+		for f, d := range fields {
+			doc[f] = d
+		}
+	}
+	doc["text_hash"] = textHash(doc)
+	return doc, dropped
+}
+
+// textHash fingerprints every field a doc gets embedded from, so a re-run
+// can tell whether its vectors would change
+func textHash(doc map[string]any) string {
+	h := md5.New()
+	for _, t := range embedTargets() {
+		if text, ok := doc[t.field].(string); ok {
+			fmt.Fprintf(h, "%s\x00%s\x00", t.field, text)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fixedIngestTime is -ingest-time normalized to UTC, set in main
+var fixedIngestTime string
+
+// ingestedAt is the ingested_at value for a doc built now
+func ingestedAt() string {
+	if fixedIngestTime != "" {
+		return fixedIngestTime
+	}
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
 func main() {
 	flag.Parse()
-	ctx := context.Background()
+	// -watch runs until interrupted; Ctrl-C stops it between polls
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *ingestTime != "" {
+		t, err := time.Parse(time.RFC3339, *ingestTime)
+		if err != nil {
+			log.Fatalf("-ingest-time must be RFC3339 (e.g. 2024-01-02T15:04:05Z): %v", err)
+		}
+		fixedIngestTime = t.UTC().Format(time.RFC3339)
+	}
+	if *descriptionsMode != "join" && *descriptionsMode != "multi" {
+		log.Fatalf("-descriptions-mode must be join or multi, got %q", *descriptionsMode)
+	}
+	if *blocklistFile != "" {
+		b, err := loadBlocklist(*blocklistFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		blocklist = b
+	}
+
+	// Preview mode: shows exactly what would be inserted
+	if *head > 0 {
+		if err := printHead(); err != nil {
+			log.Fatalf("Head failed: %v", err)
+		}
+		return
+	}
+
+	// Lint mode: never touches Antfly
+	if *validate {
+		if err := validateJSONL(); err != nil {
+			log.Fatalf("Validation failed: %v", err)
+		}
+		return
+	}
+
+	if *ci && *heartbeat > 0 {
+		go heartbeats(*heartbeat)
+	}
+
+	// Route Antfly traffic through the proxy/CA-aware transport
+	transport, err := newTransport()
+	if err != nil {
+		log.Fatalf("Failed to configure HTTP transport: %v", err)
+	}
 
 	// Create client
-	client, err := antfly.NewAntflyClient(*antflyURL, http.DefaultClient)
+	antflyHTTPClient = &http.Client{Transport: transport}
+	if len(*antflyHeaders) > 0 {
+		antflyHTTPClient.Transport = &headerTransport{base: transport, headers: *antflyHeaders}
+	}
+	client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
 
 	// Create table with text embeddings index
 	if !*skipCreate {
-		if err := createTable(ctx, client); err != nil {
+		lock, err := acquireTableLock()
+		if err != nil {
+			log.Fatalf("Failed to lock table setup: %v", err)
+		}
+		err = createTable(ctx, client)
+		lock.Release()
+		if err != nil {
 			log.Fatalf("Failed to create table: %v", err)
 		}
+	} else if *requireEmbedder && !*clientEmbed {
+		// Antfly embeds server-side, so a reused table must embed with our model
+		if err := checkEmbedder(ctx, client); err != nil {
+			log.Fatalf("Embedder check failed: %v", err)
+		}
 	}
 
 	// Import GIFs
@@ -117,15 +565,70 @@ func main() {
 	}
 }
 
+// newTransport builds the shared HTTP transport. Proxies come from
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY; -ca-cert adds an internal root CA
+// on top of the system pool.
+func newTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.IdleConnTimeout = *idleConnTimeout
+	if *caCert == "" {
+		return transport, nil
+	}
+
+	pem, err := os.ReadFile(*caCert)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", *caCert)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
+
+// knownDimensions are the output sizes of embedders we've used with Antfly.
+// Antfly embeds for us, so there's no probe; other models go unchecked.
+var knownDimensions = map[string]int{
+	"BAAI/bge-small-en-v1.5":                                      384,
+	"BAAI/bge-base-en-v1.5":                                       768,
+	"BAAI/bge-large-en-v1.5":                                      1024,
+	"sentence-transformers/all-MiniLM-L6-v2":                      384,
+	"sentence-transformers/paraphrase-multilingual-MiniLM-L12-v2": 384,
+	"intfloat/multilingual-e5-small":                              384,
+	"intfloat/multilingual-e5-base":                               768,
+}
+
+// checkDimension refuses to create an index whose dimension doesn't match
+// its model; the mismatch would otherwise only surface as failed inserts
+func checkDimension(model string, dim int, flagName string) error {
+	expected, ok := knownDimensions[model]
+	if !ok {
+		fmt.Printf("Note: %s produces vectors of unknown size, trusting %s %d\n", model, flagName, dim)
+		return nil
+	}
+	if dim != expected {
+		return fmt.Errorf("%s is %d but %s produces %d-dim vectors; pass %s %d", flagName, dim, model, expected, flagName, expected)
+	}
+	return nil
+}
+
 func createTable(ctx context.Context, client *antfly.AntflyClient) error {
+	if err := checkDimension(*embedModel, *dimension, "-dimension"); err != nil {
+		return err
+	}
+	if *multilingualModel != "" {
+		if err := checkDimension(*multilingualModel, *multilingualDim, "-multilingual-dimension"); err != nil {
+			return err
+		}
+	}
 	fmt.Printf("Creating table '%s' with text embeddings index (dim=%d)...\n", *tableName, *dimension)
 
-	// Build the embedder config (union type)
-	var embedderConfig oapi.EmbedderConfig
-	embedderConfig.Provider = oapi.EmbedderProviderTermite
-	embedderConfig.FromTermiteEmbedderConfig(oapi.TermiteEmbedderConfig{
-		Model: *embedModel,
-	})
+	embedderConfig := indexEmbedder(*embedModel)
 
 	// Build the index config (union type)
 	var indexConfig oapi.IndexConfig
@@ -137,10 +640,52 @@ func createTable(ctx context.Context, client *antfly.AntflyClient) error {
 		Field:     "combined_text",
 	})
 
+	indexes := map[string]oapi.IndexConfig{
+		"embeddings": indexConfig,
+	}
+
+	// Non-English docs also carry their text in a separate field, embedded
+	// by the multilingual model, where non-English queries look for them
+	if *multilingualModel != "" {
+		mlEmbedder := indexEmbedder(*multilingualModel)
+		var mlConfig oapi.IndexConfig
+		mlConfig.Name = "embeddings_multilingual"
+		mlConfig.Type = oapi.IndexTypeAknnV0
+		mlConfig.FromEmbeddingIndexConfig(oapi.EmbeddingIndexConfig{
+			Dimension: *multilingualDim,
+			Embedder:  mlEmbedder,
+			Field:     "combined_text_multilingual",
+		})
+		indexes["embeddings_multilingual"] = mlConfig
+	}
+
+	// Multi mode: one more vector per candidate description, same embedder
+	if *descriptionsMode == "multi" {
+		for i := range *maxDescriptions {
+			name := descriptionField(i)
+			var descConfig oapi.IndexConfig
+			descConfig.Name = name
+			descConfig.Type = oapi.IndexTypeAknnV0
+			descConfig.FromEmbeddingIndexConfig(oapi.EmbeddingIndexConfig{
+				Dimension: *dimension,
+				Embedder:  embedderConfig,
+				Field:     name,
+			})
+			indexes[name] = descConfig
+		}
+	}
+
+	// Add a BM25 full-text index so search.go can run hybrid queries
+	if *fullTextIndex {
+		var ftConfig oapi.IndexConfig
+		ftConfig.Name = "full_text"
+		ftConfig.Type = oapi.IndexTypeFullTextV0
+		ftConfig.FromBleveIndexV2Config(oapi.BleveIndexV2Config{})
+		indexes["full_text"] = ftConfig
+	}
+
 	err := client.CreateTable(ctx, *tableName, antfly.CreateTableRequest{
-		Indexes: map[string]oapi.IndexConfig{
-			"embeddings": indexConfig,
-		},
+		Indexes: indexes,
 	})
 	if err != nil {
 		if strings.Contains(err.Error(), "already exists") {
@@ -156,11 +701,208 @@ func createTable(ctx context.Context, client *antfly.AntflyClient) error {
 	if err := waitForShards(ctx, client, 30*time.Second); err != nil {
 		return err
 	}
-	fmt.Println("Waiting 30s for shard stability...")
-	time.Sleep(30 * time.Second)
+	// CI can't afford a blind sleep; wait until the table actually answers
+	if *ci {
+		if err := waitForQueryable(ctx, client, 2*time.Minute); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("Waiting 30s for shard stability...")
+		time.Sleep(30 * time.Second)
+	}
+	if *verifyCreate {
+		return verifyQueryable(ctx, client)
+	}
 	return nil
 }
 
+// indexEmbedder is the server-side embedder config for an index embedding
+// with model. With -client-embed it's empty: docs bring their own vectors.
+func indexEmbedder(model string) oapi.EmbedderConfig {
+	var config oapi.EmbedderConfig
+	if *clientEmbed {
+		return config
+	}
+	config.Provider = oapi.EmbedderProviderTermite
+	config.FromTermiteEmbedderConfig(oapi.TermiteEmbedderConfig{
+		Model: model,
+	})
+	return config
+}
+
+const verifyTimeout = 2 * time.Minute
+
+// verifyQueryable is main.go's -verify-after-create probe, found here by
+// semantic search on its own text
+func verifyQueryable(ctx context.Context, client *antfly.AntflyClient) error {
+	fmt.Println("Verifying the table serves semantic queries...")
+	id := fmt.Sprintf("_verify_%d", time.Now().UnixNano())
+	text := "table readiness probe " + id
+	doc := map[string]any{"combined_text": text}
+	// Without a server embedder, both the probe and the query need our vector
+	var embeddings map[string][]float32
+	if *clientEmbed {
+		vecs, err := embedTexts(ctx, *embedModel, []string{text})
+		if err != nil {
+			return fmt.Errorf("table not ready for queries: embed probe doc: %w", err)
+		}
+		doc["_embeddings"] = map[string]any{"embeddings": vecs[0]}
+		embeddings = map[string][]float32{"embeddings": vecs[0]}
+	}
+	_, err := client.Batch(ctx, *tableName, antfly.BatchRequest{
+		Inserts:   map[string]any{id: doc},
+		SyncLevel: antfly.SyncLevelAknn,
+	})
+	if err != nil {
+		return fmt.Errorf("table not ready for queries: insert probe doc: %w", err)
+	}
+	defer func() {
+		if _, err := client.Batch(ctx, *tableName, antfly.BatchRequest{Deletes: []string{id}}); err != nil {
+			log.Printf("Warning: failed to delete probe doc %s: %v", id, err)
+		}
+	}()
+
+	deadline := time.Now().Add(verifyTimeout)
+	for {
+		resp, err := client.Query(ctx, antfly.QueryRequest{
+			Table:          *tableName,
+			Indexes:        []string{"embeddings"},
+			SemanticSearch: text,
+			Embeddings:     embeddings,
+			Limit:          1,
+		})
+		if err == nil && len(resp.Responses) > 0 {
+			if r := resp.Responses[0]; r.Error != "" {
+				err = fmt.Errorf("%s", r.Error)
+			} else if len(r.Hits.Hits) > 0 && r.Hits.Hits[0].ID == id {
+				fmt.Println("Table serves semantic queries")
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("probe doc %s not returned", id)
+			}
+			return fmt.Errorf("table not ready for queries after %s: %w", verifyTimeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// checkEmbedder verifies the existing table's embeddings index is configured
+// with -embed-model. Inserting under a different model would leave the
+// corpus embedded half one way, half another.
+func checkEmbedder(ctx context.Context, client *antfly.AntflyClient) error {
+	status, err := client.GetTable(ctx, *tableName)
+	if err != nil {
+		return fmt.Errorf("get table: %w", err)
+	}
+	index, ok := status.Indexes["embeddings"]
+	if !ok {
+		return fmt.Errorf("table '%s' has no 'embeddings' index", *tableName)
+	}
+	config, err := index.AsEmbeddingIndexConfig()
+	if err != nil {
+		return fmt.Errorf("read embeddings index config: %w", err)
+	}
+	if config.Embedder.Provider != oapi.EmbedderProviderTermite {
+		return fmt.Errorf("'embeddings' index uses the %q embedder provider, not termite", config.Embedder.Provider)
+	}
+	termite, err := config.Embedder.AsTermiteEmbedderConfig()
+	if err != nil {
+		return fmt.Errorf("read embedder config: %w", err)
+	}
+	if termite.Model != *embedModel {
+		return fmt.Errorf("'embeddings' index embeds with %s but -embed-model is %s (pass -require-embedder-match=false to override)", termite.Model, *embedModel)
+	}
+	fmt.Printf("Table '%s' embeds with %s\n", *tableName, termite.Model)
+	return nil
+}
+
+// lockInfo, tableLock and acquireTableLock are main.go's table-setup lock,
+// copied since each program is one file. The default path is shared, so
+// image and text runs on one table name exclude each other too.
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+type tableLock struct {
+	path string
+}
+
+func lockFilePath() string {
+	if *lockFile != "" {
+		return *lockFile
+	}
+	return filepath.Join(os.TempDir(), "gif-picker-"+*tableName+".lock")
+}
+
+func acquireTableLock() (*tableLock, error) {
+	path := lockFilePath()
+	host, _ := os.Hostname()
+	info, err := json.Marshal(lockInfo{PID: os.Getpid(), Host: host, Started: time.Now().UTC()})
+	if err != nil {
+		return nil, fmt.Errorf("encode lock: %w", err)
+	}
+	for range 2 {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, err = f.Write(info)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("write lock %s: %w", path, err)
+			}
+			return &tableLock{path: path}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("create lock %s: %w", path, err)
+		}
+
+		holder, stale := readLock(path, host)
+		if !stale && !*force {
+			return nil, fmt.Errorf("another run is setting up '%s' (%s holds %s); wait for it, or pass -force if that run is gone", *tableName, holder, path)
+		}
+		log.Printf("Warning: taking over lock %s from %s", path, holder)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("remove stale lock: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("lock %s was recreated by another run", path)
+}
+
+func readLock(path, host string) (string, bool) {
+	data, err := os.ReadFile(path)
+	var info lockInfo
+	if err != nil || json.Unmarshal(data, &info) != nil {
+		return "an unknown run", false
+	}
+	holder := fmt.Sprintf("pid %d on %s since %s", info.PID, info.Host, info.Started.Format(time.RFC3339))
+	if info.Host != host {
+		return holder, false
+	}
+	p, err := os.FindProcess(info.PID)
+	if err != nil {
+		return holder, true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return holder, err != nil && !errors.Is(err, syscall.EPERM)
+}
+
+func (l *tableLock) Release() {
+	if err := os.Remove(l.path); err != nil {
+		log.Printf("Warning: release lock %s: %v", l.path, err)
+	}
+}
+
 func waitForShards(ctx context.Context, client *antfly.AntflyClient, timeout time.Duration) error {
 	fmt.Println("Waiting for shards to be ready...")
 	deadline := time.Now().Add(timeout)
@@ -191,67 +933,234 @@ func waitForShards(ctx context.Context, client *antfly.AntflyClient, timeout tim
 	}
 }
 
+// waitForQueryable, progressf and heartbeats are main.go's -ci helpers
+func waitForQueryable(ctx context.Context, client *antfly.AntflyClient, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := client.Query(ctx, antfly.QueryRequest{Table: *tableName, Limit: 1})
+		if err == nil {
+			fmt.Println("Table is serving queries")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("table not queryable after %s: %w", timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// lastOutput is when progressf last wrote, in unix nanoseconds
+var lastOutput atomic.Int64
+
+func progressf(format string, args ...any) {
+	lastOutput.Store(time.Now().UnixNano())
+	if *ci {
+		fmt.Printf(format+"\n", args...)
+		return
+	}
+	fmt.Printf("\r"+format, args...)
+}
+
+func heartbeats(every time.Duration) {
+	start := time.Now()
+	lastOutput.Store(start.UnixNano())
+	for range time.Tick(every / 2) {
+		if time.Since(time.Unix(0, lastOutput.Load())) >= every {
+			progressf("Heartbeat: still running after %s", time.Since(start).Round(time.Second))
+		}
+	}
+}
+
 func importGIFs(ctx context.Context, client *antfly.AntflyClient) error {
 	file, err := os.Open(*jsonlPath)
 	if err != nil {
 		return fmt.Errorf("open jsonl: %w", err)
 	}
-	defer file.Close()
+	lines := &lineReader{path: *jsonlPath, file: file, r: bufio.NewReader(file), watch: *watch}
+	defer lines.Close()
 
-	scanner := bufio.NewScanner(file)
-	// Increase buffer for large JSON lines
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	// Embedding and filtering are tuned separately: a field can feed the
+	// vector, be a structured field, both, or neither
+	embedSet, err := parseFieldSet("embed-fields", *embedFields)
+	if err != nil {
+		return err
+	}
+	if len(embedSet) == 0 {
+		return fmt.Errorf("-embed-fields must name at least one field")
+	}
+	storeSet, err := parseFieldSet("store-fields", *storeFields)
+	if err != nil {
+		return err
+	}
 
-	batch := make(map[string]any)
+	offsetPath := *watchOffset
+	if offsetPath == "" {
+		offsetPath = *jsonlPath + ".offset"
+	}
+	if *watch {
+		if lines.offset, err = loadOffset(offsetPath); err != nil {
+			return err
+		}
+		if _, err := file.Seek(lines.offset, io.SeekStart); err != nil {
+			return fmt.Errorf("seek to offset %d: %w", lines.offset, err)
+		}
+		fmt.Printf("Watching %s from byte %d (offset in %s)\n", *jsonlPath, lines.offset, offsetPath)
+	}
+
+	batch := newDocBatch()
 	imported := 0
+	droppedDescriptions := 0
+	multilingual := 0
+	perSource := make(map[string]int)
+	capped := 0
+	seenTexts := make(map[[16]byte]bool)
+	collapsed := 0
+	fewTags := 0
+	blocked := 0
+	unchanged := 0 // -skip-existing: stored with the same text_hash
+	changed := 0   // -skip-existing: stored with another text_hash
 	startTime := time.Now()
 
-	fmt.Println("Starting import (Antfly's termite will compute embeddings)...")
-	fmt.Printf("Model: %s, Field: combined_text\n", *embedModel)
+	// Progress prints on its own clock so display frequency doesn't track batch size
+	lastProgress := time.Now()
+	printProgress := func() {
+		elapsed := time.Since(startTime).Seconds()
+		rate := float64(imported) / elapsed
+		progressf("Imported: %d (%.1f/sec)", imported, rate)
+		lastProgress = time.Now()
+	}
 
-	for scanner.Scan() {
-		var desc GIFDescription
-		if err := json.Unmarshal(scanner.Bytes(), &desc); err != nil {
-			log.Printf("Warning: failed to parse line: %v", err)
+	if *clientEmbed {
+		fmt.Printf("Starting import (embedding via Termite at %s)...\n", *termiteURL)
+	} else {
+		fmt.Println("Starting import (Antfly's termite will compute embeddings)...")
+	}
+	fmt.Printf("Model: %s, Field: combined_text (from %s)\n", *embedModel, *embedFields)
+
+	// flush inserts the pending batch. Under -watch a failed insert is
+	// retried until it lands or Ctrl-C, and only then does the saved offset
+	// move past the lines read so far; after giving up it stays put, so the
+	// next run re-reads the lost batch.
+	offsetHeld := false
+	flush := func() {
+		if batch.Len() > 0 && *skipExisting {
+			same, differ, err := dropUnchanged(context.WithoutCancel(ctx), client, batch)
+			if err != nil {
+				log.Printf("Warning: can't check existing docs (%s), inserting them all: %v", batch.Span(), err)
+			}
+			unchanged += same
+			changed += differ
+		}
+		if batch.Len() > 0 {
+			// Still insert what was read when Ctrl-C ended a -watch
+			err := flushBatch(context.WithoutCancel(ctx), client, batch)
+			for attempt := 1; err != nil && *watch && ctx.Err() == nil; attempt++ {
+				delay := min(time.Second<<min(attempt, 6), time.Minute)
+				log.Printf("Warning: batch insert failed (%s), retrying in %s: %v", batch.Span(), delay, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+					err = flushBatch(context.WithoutCancel(ctx), client, batch)
+				}
+			}
+			if err != nil {
+				log.Printf("Warning: batch insert failed (%s): %v", batch.Span(), err)
+				offsetHeld = true
+			} else {
+				imported += batch.Len()
+			}
+			batch = newDocBatch()
+		}
+		if *watch && !offsetHeld {
+			if err := saveOffset(offsetPath, lines.offset); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+	// Caught up with the writer: insert what we have instead of waiting for a full batch
+	lines.idle = func() {
+		if batch.Len() > 0 {
+			flush()
+			printProgress()
+		}
+	}
+
+	lineNum := 0
+	for {
+		line, ok := lines.Next(ctx)
+		if !ok {
+			break
+		}
+		lineNum++
+		if *progressInterval > 0 && time.Since(lastProgress) >= *progressInterval {
+			printProgress()
+		}
+
+		desc, err := parseDescription(line)
+		if err != nil {
+			log.Printf("Warning: failed to parse line %d: %v", lineNum, err)
+			continue
+		}
+		if *sanitize {
+			desc.Sanitize()
+		}
+
+		// Moderation and quality gates first, so a dropped doc can't claim a
+		// dedupe or source slot
+		if blocklist.Match(desc.FreeText()...) {
+			blocked++
+			continue
+		}
+		if *minTags > 0 && countTags(desc.Tags) < *minTags {
+			fewTags++
 			continue
 		}
 
-		// Create combined text for embedding (Antfly will embed this via the configured Field)
-		text := desc.CombinedText()
+		// Identical text embeds to an identical vector; one copy is enough.
+		// The text is only claimed once the source cap lets the doc through.
+		var textKey [16]byte
+		if *dedupeByDesc {
+			textKey = md5.Sum([]byte(normalizeText(desc.CombinedText(embedSet))))
+			if seenTexts[textKey] {
+				collapsed++
+				continue
+			}
+		}
+
+		if *maxPerSource > 0 {
+			if key := sourceKey(desc.Source); key != "" {
+				if perSource[key] >= *maxPerSource {
+					capped++
+					continue
+				}
+				perSource[key]++
+			}
+		}
+		if *dedupeByDesc {
+			seenTexts[textKey] = true
+		}
 
 		// Generate document ID (prefers manifest ID if present)
 		docID := desc.DocID()
 
-		doc := map[string]any{
-			"gif_url":              desc.URL,
-			"original_description": desc.OriginalDescription,
-			"literal":              desc.Literal,
-			"source":               desc.Source,
-			"mood":                 desc.Mood,
-			"action":               desc.Action,
-			"context":              desc.Context,
-			"tags":                 desc.Tags,
-			"combined_text":        text,
+		doc, dropped := desc.BuildDoc(embedSet, storeSet)
+		droppedDescriptions += dropped
+		if _, ok := doc["combined_text_multilingual"]; ok {
+			multilingual++
 		}
-		if desc.Attribution != "" {
-			doc["attribution"] = desc.Attribution
-		} else if *attribution != "" {
-			doc["attribution"] = *attribution
-		}
-		batch[docID] = doc
+		batch.Add(docID, doc)
 
 		// Flush batch
-		if len(batch) >= *batchSize {
-			if err := flushBatch(ctx, client, batch); err != nil {
-				log.Printf("Warning: batch insert failed: %v", err)
-			}
-			imported += len(batch)
-			batch = make(map[string]any)
+		if batch.Len() >= *batchSize {
+			flush()
 
-			// Progress report
-			elapsed := time.Since(startTime).Seconds()
-			rate := float64(imported) / elapsed
-			fmt.Printf("\rImported: %d (%.1f/sec)", imported, rate)
+			if *progressInterval == 0 {
+				printProgress()
+			}
 
 			// Check limit
 			if *limit > 0 && imported >= *limit {
@@ -262,23 +1171,569 @@ func importGIFs(ctx context.Context, client *antfly.AntflyClient) error {
 	}
 
 	// Final batch
-	if len(batch) > 0 {
-		if err := flushBatch(ctx, client, batch); err != nil {
-			log.Printf("Warning: final batch insert failed: %v", err)
-		}
-		imported += len(batch)
-	}
+	flush()
+	printProgress()
 
 	elapsed := time.Since(startTime).Seconds()
 	fmt.Printf("\nCompleted: %d GIFs in %.1fs (%.1f/sec)\n",
 		imported, elapsed, float64(imported)/elapsed)
+	if blocklist != nil {
+		fmt.Printf("Blocked %d docs by -blocklist terms\n", blocked)
+	}
+	if *minTags > 0 {
+		fmt.Printf("Skipped %d docs with fewer than %d tags\n", fewTags, *minTags)
+	}
+	if *skipExisting {
+		fmt.Printf("Skipped %d unchanged docs, re-inserted %d with changed text\n", unchanged, changed)
+	}
+	if *dedupeByDesc {
+		fmt.Printf("Collapsed %d docs with duplicate descriptions\n", collapsed)
+	}
+	if *maxPerSource > 0 {
+		printSourceDistribution(perSource, capped)
+	}
+	if *multilingualModel != "" {
+		fmt.Printf("Routed %d non-English docs to %s\n", multilingual, *multilingualModel)
+	}
+	if droppedDescriptions > 0 {
+		fmt.Printf("Dropped %d descriptions past -max-descriptions %d\n", droppedDescriptions, *maxDescriptions)
+	}
+
+	return lines.err
+}
+
+// lineReader yields complete JSONL lines. With watch set it waits at the
+// end of the file for more instead of stopping, and never returns a
+// partial last line: that's a line the writer hasn't finished yet.
+type lineReader struct {
+	path   string
+	file   *os.File
+	r      *bufio.Reader
+	offset int64 // bytes of the lines returned so far
+	watch  bool
+	idle   func() // called each time a -watch poll finds nothing new
+	err    error
+}
+
+func (l *lineReader) Next(ctx context.Context) ([]byte, bool) {
+	for {
+		line, err := l.r.ReadBytes('\n')
+		if err == nil {
+			l.offset += int64(len(line))
+			return bytes.TrimRight(line, "\r\n"), true
+		}
+		if err != io.EOF {
+			l.err = fmt.Errorf("read jsonl: %w", err)
+			return nil, false
+		}
+		if !l.watch {
+			l.offset += int64(len(line))
+			return line, len(line) > 0
+		}
 
+		// Re-read a partial tail from its start once the writer finishes it
+		if len(line) > 0 {
+			if _, err := l.file.Seek(l.offset, io.SeekStart); err != nil {
+				l.err = fmt.Errorf("rewind partial line: %w", err)
+				return nil, false
+			}
+			l.r.Reset(l.file)
+		}
+		if err := l.restartIfReplaced(); err != nil {
+			l.err = err
+			return nil, false
+		}
+		if l.idle != nil {
+			l.idle()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(*watchInterval):
+		}
+	}
+}
+
+// restartIfReplaced goes back to the start when the file was truncated
+// below our offset (which includes a saved offset from an older, longer
+// file) or rotated to a new file at the same path
+func (l *lineReader) restartIfReplaced() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return nil // mid-rotation; look again on the next poll
+	}
+	current, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat jsonl: %w", err)
+	}
+	switch {
+	case !os.SameFile(info, current):
+		f, err := os.Open(l.path)
+		if err != nil {
+			return fmt.Errorf("reopen jsonl: %w", err)
+		}
+		l.file.Close()
+		l.file = f
+		log.Printf("%s was replaced, reading the new file from the start", l.path)
+	case current.Size() < l.offset:
+		if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("rewind truncated jsonl: %w", err)
+		}
+		log.Printf("%s is %d bytes, short of offset %d (truncated?), reading from the start", l.path, current.Size(), l.offset)
+	default:
+		return nil
+	}
+	l.offset = 0
+	l.r.Reset(l.file)
+	return nil
+}
+
+func (l *lineReader) Close() error {
+	return l.file.Close()
+}
+
+// loadOffset reads a saved -watch offset; a missing file means the start
+func loadOffset(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read watch offset: %w", err)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse watch offset %s: %w", path, err)
+	}
+	return offset, nil
+}
+
+// saveOffset writes the offset atomically, so a crash leaves the old one
+func saveOffset(path string, offset int64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write watch offset: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write watch offset: %w", err)
+	}
+	return nil
+}
+
+// countTags counts distinct non-empty tags, so "Funny", "funny " and ""
+// don't pad out a thin tag list
+func countTags(tags []string) int {
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if key := normalizeText(tag); key != "" {
+			seen[key] = true
+		}
+	}
+	return len(seen)
+}
+
+// printHead prints the docs the first -head lines would become, keyed by
+// doc ID, so field mapping can be checked before a real run
+func printHead() error {
+	embedSet, err := parseFieldSet("embed-fields", *embedFields)
+	if err != nil {
+		return err
+	}
+	storeSet, err := parseFieldSet("store-fields", *storeFields)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(*jsonlPath)
+	if err != nil {
+		return fmt.Errorf("open jsonl: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	lineNum := 0
+	for lineNum < *head && scanner.Scan() {
+		lineNum++
+		desc, err := parseDescription(scanner.Bytes())
+		if err != nil {
+			log.Printf("Warning: failed to parse line %d: %v", lineNum, err)
+			continue
+		}
+		if *sanitize {
+			desc.Sanitize()
+		}
+		doc, _ := desc.BuildDoc(embedSet, storeSet)
+		if err := enc.Encode(map[string]any{"id": desc.DocID(), "doc": doc}); err != nil {
+			return err
+		}
+	}
 	return scanner.Err()
 }
 
-func flushBatch(ctx context.Context, client *antfly.AntflyClient, batch map[string]any) error {
+// sourceKey normalizes a source for -max-per-source; "" means uncapped
+func sourceKey(source string) string {
+	key := strings.ToLower(strings.TrimSpace(source))
+	if key == "unknown" {
+		return ""
+	}
+	return key
+}
+
+// printSourceDistribution lists the most-ingested sources after a capped run
+func printSourceDistribution(perSource map[string]int, capped int) {
+	sources := make([]string, 0, len(perSource))
+	for s := range perSource {
+		sources = append(sources, s)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if perSource[sources[i]] != perSource[sources[j]] {
+			return perSource[sources[i]] > perSource[sources[j]]
+		}
+		return sources[i] < sources[j]
+	})
+
+	fmt.Printf("Sources: %d distinct, %d docs skipped by -max-per-source %d\n", len(sources), capped, *maxPerSource)
+	for _, s := range sources[:min(len(sources), 20)] {
+		fmt.Printf("  %5d  %s\n", perSource[s], s)
+	}
+	if len(sources) > 20 {
+		fmt.Printf("  ... and %d more\n", len(sources)-20)
+	}
+}
+
+// validateJSONL checks every line of the descriptions file and reports
+// problems with line numbers. It returns an error if any line is invalid.
+func validateJSONL() error {
+	file, err := os.Open(*jsonlPath)
+	if err != nil {
+		return fmt.Errorf("open jsonl: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	lineNum, invalid := 0, 0
+	for scanner.Scan() {
+		lineNum++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		desc, err := parseDescription(scanner.Bytes())
+		if err != nil {
+			fmt.Printf("%s:%d: invalid JSON: %v\n", *jsonlPath, lineNum, err)
+			invalid++
+			continue
+		}
+		if problems := desc.Validate(); len(problems) > 0 {
+			fmt.Printf("%s:%d: %s\n", *jsonlPath, lineNum, strings.Join(problems, "; "))
+			invalid++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read line %d: %w", lineNum+1, err)
+	}
+
+	fmt.Printf("Checked %d lines, %d invalid\n", lineNum, invalid)
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid lines", invalid)
+	}
+	return nil
+}
+
+// docBatch accumulates docs for one insert, remembering input order.
+// Antfly takes inserts as a map, so IDs keeps the sequence for anything
+// that reports per-doc (logs, dead letters) to be identical run-to-run.
+type docBatch struct {
+	IDs  []string
+	Docs map[string]any
+}
+
+func newDocBatch() *docBatch {
+	return &docBatch{Docs: make(map[string]any)}
+}
+
+// Add queues a doc; a repeated ID replaces the doc but keeps its first position
+func (b *docBatch) Add(id string, doc any) {
+	if _, ok := b.Docs[id]; !ok {
+		b.IDs = append(b.IDs, id)
+	}
+	b.Docs[id] = doc
+}
+
+// Remove drops a queued doc
+func (b *docBatch) Remove(id string) {
+	if _, ok := b.Docs[id]; !ok {
+		return
+	}
+	delete(b.Docs, id)
+	b.IDs = slices.DeleteFunc(b.IDs, func(queued string) bool { return queued == id })
+}
+
+func (b *docBatch) Len() int {
+	return len(b.IDs)
+}
+
+// Span describes the batch by its first and last IDs for log lines
+func (b *docBatch) Span() string {
+	if len(b.IDs) == 0 {
+		return "empty batch"
+	}
+	return b.IDs[0] + ".." + b.IDs[len(b.IDs)-1]
+}
+
+// dropUnchanged looks up the batch's docs in one query and removes those
+// already stored with the same text_hash; Antfly would only re-embed them
+// to identical vectors. It reports how many it dropped and how many exist
+// with different text (and stay, to be re-embedded).
+func dropUnchanged(ctx context.Context, client *antfly.AntflyClient, batch *docBatch) (int, int, error) {
+	ids := slices.Clone(batch.IDs)
+	q := query.NewDocIds(ids)
+	resp, err := client.Query(ctx, antfly.QueryRequest{
+		Table:          *tableName,
+		FullTextSearch: &q,
+		Fields:         []string{"text_hash"},
+		Limit:          len(ids),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(resp.Responses) == 0 {
+		return 0, 0, nil
+	}
+	if resp.Responses[0].Error != "" {
+		return 0, 0, fmt.Errorf("%s", resp.Responses[0].Error)
+	}
+
+	same, differ := 0, 0
+	for _, hit := range resp.Responses[0].Hits.Hits {
+		doc, ok := batch.Docs[hit.ID].(map[string]any)
+		if !ok {
+			continue
+		}
+		if stored, _ := hit.Source["text_hash"].(string); stored == doc["text_hash"] {
+			batch.Remove(hit.ID)
+			same++
+		} else {
+			differ++
+		}
+	}
+	return same, differ, nil
+}
+
+func flushBatch(ctx context.Context, client *antfly.AntflyClient, batch *docBatch) error {
+	if *clientEmbed {
+		if err := attachEmbeddings(ctx, batch); err != nil {
+			return err
+		}
+	}
 	_, err := client.Batch(ctx, *tableName, antfly.BatchRequest{
-		Inserts: batch,
+		Inserts: batch.Docs,
 	})
+	if err != nil && isConnReset(err) {
+		// The pooled connection went stale while we were idle; one fresh
+		// attempt before the batch is given up on
+		log.Printf("Warning: Antfly connection was reset (%v), reconnecting and retrying", err)
+		antflyHTTPClient.CloseIdleConnections()
+		_, err = client.Batch(ctx, *tableName, antfly.BatchRequest{
+			Inserts: batch.Docs,
+		})
+	}
 	return err
 }
+
+// antflyHTTPClient carries Antfly traffic, set up in main
+var antflyHTTPClient = http.DefaultClient
+
+// isConnReset is main.go's stale-connection check
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "server closed idle connection")
+}
+
+// embedTarget is a text field that -client-embed embeds into a vector index
+type embedTarget struct {
+	field string
+	index string
+	model string
+}
+
+// embedTargets lists what the server-side embedders would have embedded:
+// combined_text always, plus the multilingual and per-description fields
+// when those modes are on
+func embedTargets() []embedTarget {
+	targets := []embedTarget{{"combined_text", "embeddings", *embedModel}}
+	if *multilingualModel != "" {
+		targets = append(targets, embedTarget{"combined_text_multilingual", "embeddings_multilingual", *multilingualModel})
+	}
+	if *descriptionsMode == "multi" {
+		for i := range *maxDescriptions {
+			name := descriptionField(i)
+			targets = append(targets, embedTarget{name, name, *embedModel})
+		}
+	}
+	return targets
+}
+
+// attachEmbeddings embeds the batch's texts with one Termite request per
+// target and stores each vector as _embeddings.<index> on its doc
+func attachEmbeddings(ctx context.Context, batch *docBatch) error {
+	for _, t := range embedTargets() {
+		var ids, texts []string
+		for _, id := range batch.IDs {
+			if text, ok := batch.Docs[id].(map[string]any)[t.field].(string); ok && text != "" {
+				ids = append(ids, id)
+				texts = append(texts, text)
+			}
+		}
+		if len(texts) == 0 {
+			continue
+		}
+		vecs, err := embedTexts(ctx, t.model, texts)
+		if err != nil {
+			return fmt.Errorf("embed %s: %w", t.field, err)
+		}
+		for i, id := range ids {
+			doc := batch.Docs[id].(map[string]any)
+			embeddings, ok := doc["_embeddings"].(map[string]any)
+			if !ok {
+				embeddings = make(map[string]any)
+				doc["_embeddings"] = embeddings
+			}
+			embeddings[t.index] = vecs[i]
+		}
+	}
+	return nil
+}
+
+var termiteClient = &http.Client{Timeout: 2 * time.Minute}
+
+// headers, headerFlag and headerTransport are main.go's -*-header flags
+type headers http.Header
+
+func headerFlag(name, usage string) *headers {
+	h := headers{}
+	flag.Var(&h, name, usage)
+	return &h
+}
+
+func (h *headers) String() string {
+	if h == nil {
+		return ""
+	}
+	var pairs []string
+	for key, values := range *h {
+		for _, v := range values {
+			pairs = append(pairs, key+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (h *headers) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	if key = strings.TrimSpace(key); !ok || key == "" {
+		return fmt.Errorf("want key=value, got %q", value)
+	}
+	http.Header(*h).Add(key, v)
+	return nil
+}
+
+func (h *headers) apply(dst http.Header) {
+	for key, values := range *h {
+		dst[http.CanonicalHeaderKey(key)] = values
+	}
+}
+
+type headerTransport struct {
+	base    http.RoundTripper
+	headers headers
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	t.headers.apply(req.Header)
+	return t.base.RoundTrip(req)
+}
+
+func (t *headerTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// embedTexts embeds texts with model in one Termite request
+func embedTexts(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	jsonBody, err := json.Marshal(map[string]any{
+		"model": model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", *termiteURL+"/api/embed", bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	termiteHeaders.apply(req.Header)
+
+	resp, err := termiteClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("termite error %d: %s", resp.StatusCode, string(body))
+	}
+
+	embeddings, err := deserializeEmbeddings(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("termite returned %d vectors for %d texts", len(embeddings), len(texts))
+	}
+	return embeddings, nil
+}
+
+// deserializeEmbeddings parses Termite's binary response:
+// uint64(numVectors) + uint64(dimension) + float32 values, little-endian
+func deserializeEmbeddings(data []byte) ([][]float32, error) {
+	r := bytes.NewReader(data)
+
+	var numVectors, dimension uint64
+	if err := binary.Read(r, binary.LittleEndian, &numVectors); err != nil {
+		return nil, fmt.Errorf("read numVectors: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &dimension); err != nil {
+		return nil, fmt.Errorf("read dimension: %w", err)
+	}
+	// Bound each factor by the payload before multiplying, so a corrupt
+	// header can't overflow the size check or the allocations
+	if dimension == 0 || dimension > uint64(r.Len())/4 || numVectors > uint64(r.Len())/(dimension*4) {
+		return nil, fmt.Errorf("response holds %d bytes, want %d vectors of dimension %d", r.Len(), numVectors, dimension)
+	}
+
+	embeddings := make([][]float32, numVectors)
+	for v := range embeddings {
+		embeddings[v] = make([]float32, dimension)
+		if err := binary.Read(r, binary.LittleEndian, embeddings[v]); err != nil {
+			return nil, fmt.Errorf("read vector %d: %w", v, err)
+		}
+	}
+	return embeddings, nil
+}
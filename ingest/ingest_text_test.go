@@ -0,0 +1,209 @@
+// Tests for ingest_text.go, run on their own:
+//
+//	go test ingest_text.go ingest_text_test.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDescriptionSanitize(t *testing.T) {
+	g := GIFDescription{
+		OriginalDescription: "a &lt;b&gt;cat&lt;/b&gt;\x00",
+		Literal:             "cat &amp; dog\tplay",
+		Mood:                "happy\x1b[0m",
+		Context:             "  &quot;yes&quot;  ",
+		Tags:                []string{"fun&nbsp;times", "<i>cute</i>"},
+		Descriptions:        []string{"line\r\nbreak"},
+	}
+	g.Sanitize()
+
+	checks := []struct{ field, got, want string }{
+		{"original_description", g.OriginalDescription, "a cat"},
+		{"literal", g.Literal, "cat & dog play"},
+		{"mood", g.Mood, "happy [0m"},
+		{"context", g.Context, `"yes"`},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.field, c.got, c.want)
+		}
+	}
+	if want := []string{"fun times", "cute"}; !slices.Equal(g.Tags, want) {
+		t.Errorf("tags = %q, want %q", g.Tags, want)
+	}
+	if want := []string{"line break"}; !slices.Equal(g.Descriptions, want) {
+		t.Errorf("descriptions = %q, want %q", g.Descriptions, want)
+	}
+}
+
+// watchReader opens path for -watch reading from offset
+func watchReader(t *testing.T, path string, offset int64) *lineReader {
+	t.Helper()
+	old := *watchInterval
+	*watchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { *watchInterval = old })
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		t.Fatal(err)
+	}
+	l := &lineReader{path: path, file: f, r: bufio.NewReader(f), offset: offset, watch: true}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// nextLine reads one line, failing instead of waiting forever
+func nextLine(t *testing.T, l *lineReader) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	line, ok := l.Next(ctx)
+	if !ok {
+		t.Fatalf("no line (err %v)", l.err)
+	}
+	return string(line)
+}
+
+func TestLineReaderTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "d.jsonl")
+	if err := os.WriteFile(path, []byte("{\"a\":1}\n{\"b\":2}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A saved offset from a longer, since-truncated file
+	l := watchReader(t, path, 500)
+	if got := nextLine(t, l); got != `{"a":1}` {
+		t.Errorf("first line after restart = %q", got)
+	}
+	if l.offset != 8 {
+		t.Errorf("offset = %d, want 8", l.offset)
+	}
+}
+
+func TestLineReaderRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "d.jsonl")
+	if err := os.WriteFile(path, []byte("{\"a\":1}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := watchReader(t, path, 0)
+	if got := nextLine(t, l); got != `{"a":1}` {
+		t.Fatalf("first line = %q", got)
+	}
+
+	// Rotate: the writer moves on to a fresh file at the same path
+	next := filepath.Join(dir, "d.jsonl.new")
+	if err := os.WriteFile(next, []byte("{\"z\":9}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextLine(t, l); got != `{"z":9}` {
+		t.Errorf("line after rotation = %q", got)
+	}
+}
+
+// TestDeserializeEmbeddingsCorrupt feeds headers whose sizes don't fit the
+// payload, including ones whose byte count overflows uint64
+func TestDeserializeEmbeddingsCorrupt(t *testing.T) {
+	header := func(numVectors, dimension uint64, payload int) []byte {
+		b := binary.LittleEndian.AppendUint64(nil, numVectors)
+		b = binary.LittleEndian.AppendUint64(b, dimension)
+		return append(b, make([]byte, payload)...)
+	}
+	tests := map[string][]byte{
+		"zero dimension":      header(1, 0, 8),
+		"short payload":       header(2, 4, 16),
+		"huge dimension":      header(1, 1<<62, 16),
+		"overflowing product": header(1<<62, 4, 16),
+		"overflowing vectors": header(math.MaxUint64, 1, 16),
+		"truncated header":    header(1, 4, 0)[:12],
+	}
+	for name, data := range tests {
+		if _, err := deserializeEmbeddings(data); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+
+	got, err := deserializeEmbeddings(header(2, 2, 16))
+	if err != nil || len(got) != 2 || len(got[0]) != 2 {
+		t.Errorf("2x2 response = %v, %v", got, err)
+	}
+}
+
+func TestAcquireTableLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.lock")
+	old := *lockFile
+	*lockFile = path
+	defer func() { *lockFile = old }()
+	host, _ := os.Hostname()
+
+	writeLock := func(pid int) {
+		t.Helper()
+		data, _ := json.Marshal(lockInfo{PID: pid, Host: host, Started: time.Now()})
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A live holder on this host keeps the lock
+	writeLock(os.Getpid())
+	if _, err := acquireTableLock(); err == nil {
+		t.Fatal("took a lock held by a live process")
+	}
+
+	// A dead one's lock is taken over
+	writeLock(1 << 30)
+	lock, err := acquireTableLock()
+	if err != nil {
+		t.Fatalf("stale lock: %v", err)
+	}
+	lock.Release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file still there after Release: %v", err)
+	}
+}
+
+func TestBuildDocSchemaVersion(t *testing.T) {
+	g := GIFDescription{URL: "https://example.com/cat.gif", Literal: "a cat waves"}
+	doc, _ := g.BuildDoc(map[string]bool{"literal": true}, map[string]bool{})
+	if doc["schema_version"] != schemaVersion {
+		t.Errorf("schema_version = %v, want %d", doc["schema_version"], schemaVersion)
+	}
+}
+
+// TestBuildDocMultilingual checks non-English docs keep combined_text for
+// full-text search alongside the multilingual field
+func TestBuildDocMultilingual(t *testing.T) {
+	old := *multilingualModel
+	*multilingualModel = "sentence-transformers/paraphrase-multilingual-MiniLM-L12-v2"
+	defer func() { *multilingualModel = old }()
+
+	embedSet := map[string]bool{"literal": true}
+	es := GIFDescription{URL: "https://example.com/gato.gif", Literal: "un gato baila", Lang: "es"}
+	doc, _ := es.BuildDoc(embedSet, map[string]bool{})
+	if doc["combined_text"] == nil || doc["combined_text"] != doc["combined_text_multilingual"] {
+		t.Errorf("es doc: combined_text %q, combined_text_multilingual %q; want both set", doc["combined_text"], doc["combined_text_multilingual"])
+	}
+
+	en := GIFDescription{URL: "https://example.com/cat.gif", Literal: "a cat dances", Lang: "en"}
+	doc, _ = en.BuildDoc(embedSet, map[string]bool{})
+	if _, ok := doc["combined_text_multilingual"]; ok || doc["combined_text"] == nil {
+		t.Errorf("en doc = %v, want only combined_text", doc)
+	}
+}
@@ -10,6 +10,54 @@
 // - CLIP model: antflycli termite pull openai/clip-vit-base-patch32
 //
 // Run: go run main.go
+//
+// Two-phase mode splits embedding from inserting:
+//   go run main.go embed -embeddings-file embeddings.jsonl   (Termite only)
+//   go run main.go load -embeddings-file embeddings.jsonl    (Antfly only)
+//
+// Or skip the file and pipe docs (with their vectors) to another tool:
+//   go run main.go -output stdout | jq .doc.gif_url
+//
+// Export dumps the table (vectors included) in the same format, so a
+// backup or another cluster can be restored with load:
+//   go run main.go export -embeddings-file backup.jsonl
+//
+// Several models side by side in one table, one vector index each. They
+// have no server-side embedder, so search.go embeds the query itself:
+//   go run main.go -models siglip=google/siglip-base-patch16-224:768
+//   go run search.go -q "happy dance" -index siglip -client-embed -embed-model google/siglip-base-patch16-224
+//
+// Debug one GIF's vector (no table needed):
+//   go run main.go -embed-url https://example.com/dance.gif | jq length
+//
+// Pick a GIF for a phrase from the imported table (CLIP text vs. image
+// vectors), ready to paste into chat; -n prints several:
+//   go run main.go pick "when the build finally passes"
+//   go run main.go pick -n 5 "happy dance"
+//
+// Check how an existing table (from either importer) is configured:
+//   go run main.go describe-schema -table tgif_gifs_text
+//
+// Bring docs written by older versions up to the current schema_version,
+// deriving what it can (the flags pick which GIF-derived fields to fill):
+//   go run main.go migrate -skip-create -extract-palette -extract-motion
+//
+// Rows that failed to fetch, embed or insert land in -dead-letter; once the
+// cause is fixed, re-run just those (anything still failing is rewritten):
+//   go run main.go retry-dead-letter -skip-create
+//
+// Offline picking without Antfly: build a flat vector file while importing
+// (or embedding), then brute-force search it with CLIP text embeddings
+//   go run main.go embed -local-index gifs.vec
+//   go run main.go local-search -local-index gifs.vec -q "happy dance"
+//
+// Time-boxed runs (e.g., from cron) stop after a budget and resume where
+// the last one left off:
+//   go run main.go -skip-create -max-runtime 50m -checkpoint import.checkpoint
+//
+// One big file split across machines, each with its own checkpoint:
+//   go run main.go -skip-create -line-start 0 -line-count 1000000 -checkpoint a.checkpoint
+//   go run main.go -skip-create -line-start 1000000 -line-count 1000000 -checkpoint b.checkpoint
 
 package main
 
@@ -17,53 +65,240 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"math/bits"
+	"math/rand/v2"
 	"net/http"
+	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/antflydb/antfly-go/antfly"
+	"github.com/antflydb/antfly-go/antfly/oapi"
+	"github.com/antflydb/antfly-go/antfly/query"
 )
 
 var (
-	antflyURL   = flag.String("url", "http://localhost:8080/api/v1", "Antfly API URL")
-	termiteURL  = flag.String("termite-url", "http://localhost:11433", "Termite API URL")
-	tsvPath     = flag.String("tsv", "../TGIF-Release/data/tgif-v1.0.tsv", "Path to TGIF TSV file")
-	tableName   = flag.String("table", "tgif_gifs", "Antfly table name")
-	batchSize   = flag.Int("batch", 10, "Batch size for inserts (smaller due to embedding calls)")
-	limit       = flag.Int("limit", 0, "Limit number of GIFs to import (0 = all)")
-	skipCreate  = flag.Bool("skip-create", false, "Skip table creation")
-	clipModel   = flag.String("clip-model", "openai/clip-vit-base-patch32", "CLIP model for embeddings")
+	antflyURL      = flag.String("url", "http://localhost:8080/api/v1", "Antfly API URL")
+	termiteURL     = flag.String("termite-url", "http://localhost:11433", "Termite API URL, or a comma-separated list of replicas to round-robin with failover")
+	tsvPath        = flag.String("tsv", "../TGIF-Release/data/tgif-v1.0.tsv", "Path to TGIF TSV file (or CSV with -input-format csv)")
+	tableName      = flag.String("table", "tgif_gifs", "Antfly table name")
+	batchSize      = flag.Int("batch", 10, "Batch size for inserts (smaller due to embedding calls)")
+	limit          = flag.Int("limit", 0, "Limit number of GIFs to import (0 = all)")
+	skipCreate     = flag.Bool("skip-create", false, "Skip table creation")
+	lockFile       = flag.String("lock-file", "", "Advisory lock held while creating the table, so concurrent runs can't race on setup (default: <tmp>/gif-picker-<table>.lock)")
+	force          = flag.Bool("force", false, "Take over the -lock-file even if another run seems to hold it (e.g., left behind by a crash)")
+	verifyCreate   = flag.Bool("verify-after-create", false, "After creating the table, insert a probe doc, query it back by vector and delete it; abort if the table can't serve queries")
+	clipModel      = flag.String("clip-model", "openai/clip-vit-base-patch32", "CLIP model for embeddings")
+	fuseTextModel  = flag.String("fuse-text-model", "", "Also embed descriptions with this text model and store [image, text] concatenated, each L2-normalized (e.g., BAAI/bge-small-en-v1.5)")
+	imageWeight    = flag.Float64("image-weight", 1.0, "With -fuse-text-model, weight of the image half of the fused vector")
+	fuseTextWeight = flag.Float64("fuse-text-weight", 1.0, "With -fuse-text-model, weight of the text half of the fused vector")
+	dimension      = flag.Int("dimension", 0, "Vector dimension for the index (0 = detect by embedding a probe image)")
+
+	flushRetries  = flag.Int("flush-retries", 3, "Retries for a failed batch insert (jittered exponential backoff)")
+	outageRetries = flag.Int("outage-retries", 12, "Retries for a batch insert while Antfly is unavailable (503/connection refused), with longer backoff")
+	deadLetter    = flag.String("dead-letter", "dead_letter.jsonl", "Append rows that failed to fetch, embed or insert to this JSONL (empty = drop them)")
+	adaptiveBatch = flag.Bool("adaptive-batch", false, "Halve batch size on insert failure, grow it on sustained success")
+	minBatch      = flag.Int("min-batch", 1, "Lower bound for -adaptive-batch")
+	maxBatch      = flag.Int("max-batch", 100, "Upper bound for -adaptive-batch")
+
+	fetchLocally     = flag.Bool("fetch-locally", false, "Download GIFs ourselves and send bytes to Termite (for sandboxed Termite)")
+	preprocessMaxDim = flag.Int("preprocess-max-dim", 0, "With -fetch-locally, send Termite just the first frame, shrunk to fit this many pixels (0 = send the whole GIF)")
+	preprocessFormat = flag.String("preprocess-format", "png", "Encoding for -preprocess-max-dim frames: png or jpeg")
+	centerCrop       = flag.Bool("center-crop", false, "With -fetch-locally or -frames first-last, square up frames before sending them to Termite (CLIP wants square-ish inputs)")
+	cropStrategy     = flag.String("crop-strategy", "center", "How -center-crop squares a frame: center crops the long side, pad letterboxes it in black")
+	frameMode        = flag.String("frames", "single", "single embeds each GIF as is; first-last embeds its first and last frames as two vectors (downloads each GIF)")
+	termiteHeaders   = headerFlag("termite-header", "Header sent with every Termite request, as key=value (repeatable; e.g., for an auth gateway)")
+	antflyHeaders    = headerFlag("antfly-header", "Header sent with every Antfly request, as key=value (repeatable)")
+	fetchRetries     = flag.Int("fetch-retries", 2, "Retries for a failed local GIF download")
+	redactURLs       = flag.Bool("redact-urls", false, "Replace GIF URLs in log output with their docID (Antfly still stores the URL)")
+	dataset          = flag.String("dataset", "", "Dataset tag stored as 'dataset' on every doc (e.g., 'tgif')")
+
+	ci               = flag.Bool("ci", false, "CI-friendly output: one progress line per interval (no \\r), no cosmetic sleeps, periodic heartbeats")
+	heartbeat        = flag.Duration("heartbeat", time.Minute, "With -ci, print a heartbeat after this long without output")
+	progressInterval = flag.Duration("progress-interval", 2*time.Second, "How often to print progress (0 = after every batch)")
+	caCert           = flag.String("ca-cert", "", "PEM bundle of extra root CAs for TLS to Antfly/Termite")
+	idleConnTimeout  = flag.Duration("idle-conn-timeout", 30*time.Second, "Close pooled Antfly/Termite connections idle this long, before a proxy or load balancer silently drops them during a slow stretch (0 = never)")
+
+	describeMissing = flag.String("describe-missing", "", "Describe image-table docs lacking enriched fields into this JSONL (for ingest_text.go), then exit")
+	describeURL     = flag.String("describe-url", "https://api.openai.com/v1/chat/completions", "OpenAI-compatible chat completions endpoint for -describe-missing")
+	describeModel   = flag.String("describe-model", "gpt-4o-mini", "Vision model for -describe-missing (API key from DESCRIBE_API_KEY)")
+
+	embeddingsFile  = flag.String("embeddings-file", "embeddings.jsonl", "Intermediate file for the embed/load subcommands")
+	output          = flag.String("output", "antfly", "Where imported docs go: antfly, or stdout as embeddings-file JSON lines (progress and logs move to stderr)")
+	dedupImages     = flag.Bool("dedup-images", false, "Skip GIFs whose first-frame dHash is near an already-seen GIF (downloads each GIF)")
+	storeFrameCount = flag.Bool("store-frame-count", false, "Decode each GIF (downloads it) and store its frame_count")
+	minFrames       = flag.Int("min-frames", 0, "Skip GIFs with fewer frames than this, e.g. 2 drops static images (implies downloading)")
+	extractPalette  = flag.Bool("extract-palette", false, "Store the first frame's dominant colors as hex strings in 'palette' (downloads each GIF)")
+	extractMotion   = flag.Bool("extract-motion", false, "Store 'motion_score', the mean absolute pixel change between sampled consecutive frames (0 = still, 1 = every pixel flips), to filter calm vs frantic GIFs (downloads each GIF)")
+	dedupDistance   = flag.Int("dedup-distance", 4, "Max Hamming distance (of 64 bits) for -dedup-images to call two GIFs duplicates")
+	dedupFile       = flag.String("dedup-file", "seen_hashes.txt", "Persisted hash set for -dedup-images, so resumed runs remember earlier GIFs")
+	indexName       = flag.String("index-name", "embeddings", "Vector index name; vectors are stored under _embeddings.<name>")
+	modelsFlag      = flag.String("models", "", "Extra vector indexes embedded alongside -clip-model, as name=model[:dim],... (e.g., siglip=google/siglip-base-patch16-224:768); each gets its own aknn_v0 index and _embeddings.<name>, dim probed when omitted")
+	warmupTimeout   = flag.Duration("warmup-timeout", 2*time.Minute, "How long to wait for Termite to load the model before starting (0 = skip warmup)")
+	lineStart       = flag.Int("line-start", 0, "Skip this many input rows before processing (for splitting one file across machines)")
+	lineCount       = flag.Int("line-count", 0, "Process at most this many rows from -line-start, counting skipped and failed rows too (0 = to the end)")
+	maxRuntime      = flag.Duration("max-runtime", 0, "Stop cleanly after this long, flushing the current batch (0 = no limit)")
+	checkpointFile  = flag.String("checkpoint", "", "File recording the last input row imported; resume from it on the next run")
+	inputFormat     = flag.String("input-format", "tsv", "Input format: tsv (fast, unquoted) or csv (quoted fields via encoding/csv)")
+	trimFields      = flag.Bool("trim-fields", false, "Trim whitespace and one pair of surrounding quotes (\" or ') from each input field")
+	unquote         = flag.Bool("unquote", false, "Unwrap \"double-quoted\" fields, turning doubled \"\" escapes into \" (for TSV exports that quote like CSV)")
+	delimiter       = flag.String("delimiter", ",", "Field delimiter for -input-format csv (a single character, or \\t)")
+	urlCol          = flag.Int("url-col", 0, "0-based column holding the GIF URL")
+	descCol         = flag.Int("desc-col", 1, "0-based column holding the description")
+	localIndex      = flag.String("local-index", "", "Also append every embedded GIF to this flat vector file for local-search")
+	queryText       = flag.String("q", "", "local-search, pick: query text (pick also takes it as arguments)")
+	topK            = flag.Int("top-k", 10, "local-search: number of results")
+	pickCount       = flag.Int("n", 1, "pick: number of GIF URLs to print, best first")
+	allowHosts      = flag.String("allow-hosts", "", "Comma-separated host suffixes to ingest from (e.g., 'tumblr.com,giphy.com'); empty = any host")
+	blocklistFile   = flag.String("blocklist", "", "Skip rows whose description contains any term in this file (one term or phrase per line, # comments; whole words, case-insensitive)")
+	denyHosts       = flag.String("deny-hosts", "", "Comma-separated host suffixes never to ingest from (checked before -allow-hosts)")
+	forceHTTPS      = flag.Bool("force-https", false, "Rewrite http:// GIF URLs to https:// when the https URL answers (keeps http otherwise)")
+	embedBatch      = flag.Int("embed-batch", 1, "Images per Termite embed request (near-duplicates within one request aren't collapsed by -dedup-images)")
+	embedWorkers    = flag.Int("embed-workers", 0, "Concurrent Termite embed workers, with inserts on a separate flusher goroutine (0 = embed and insert inline)")
+	pipelineBuffer  = flag.Int("pipeline-buffer", 4, "Embed batches queued between reader, -embed-workers and the flusher")
+	pprofAddr       = flag.String("pprof-addr", "", "Serve net/http/pprof on this address during the run (e.g., localhost:6060)")
+	cpuProfile      = flag.String("cpuprofile", "", "Write a CPU profile of the ingest to this file")
+	memProfile      = flag.String("memprofile", "", "Write a heap profile to this file after the ingest")
+	logEmpty        = flag.String("log-empty-embeddings", "", "Append URLs Termite accepted but returned no embedding for to this file, for triage")
+	summaryOut      = flag.String("summary-out", "", "Write the run summary (counts, duration, table, model, config hash) as JSON to this file, also on partial or failed runs")
+	logFile         = flag.String("log-file", "", "Also write warnings, progress and the final summary to this file, rotating it by size (for unattended runs)")
+	logMaxSize      = flag.Int("log-max-size", 10, "Rotate -log-file once it would grow past this many MB")
+	logKeep         = flag.Int("log-keep", 5, "Rotated -log-file copies to keep (file.1 is the newest)")
+	logStdout       = flag.Bool("log-stdout", true, "With -log-file, keep printing to stdout/stderr too; false sends status output only to the file")
+	logJSON         = flag.Bool("log-json", false, "Print the final import summary as a JSON object")
+	maxFailures     = flag.Int("max-failures", 0, "Stop the import once more than this many rows failed to fetch, embed or insert (0 = never)")
+	maxURLLen       = flag.Int("max-url-len", 2048, "Skip rows whose URL is longer than this many bytes (usually a bad split gluing fields together) before any fetch or embed (0 = no cap)")
+	shardParallel   = flag.Bool("shard-parallel", false, "Split each insert batch by the table's shard key ranges and insert the parts concurrently")
+	head            = flag.Int("head", 0, "Print the docs built from the first N rows as JSON and exit (no Termite/Antfly calls)")
+	selfcheck       = flag.Bool("selfcheck-deserialize", false, "Round-trip known vectors through the Termite response parser, report any mismatch and exit (no Termite/Antfly calls)")
+	embedURL        = flag.String("embed-url", "", "Embed this one GIF URL the way the import would (honoring -fetch-locally/-preprocess-max-dim), print the vector to stdout and exit (no table needed)")
+	embedURLFormat  = flag.String("embed-url-format", "json", "Vector format for -embed-url: json (array of floats) or base64 (little-endian float32 bytes)")
+	urlTransformCmd = flag.String("url-transform-cmd", "", "Shell command that reads a GIF URL on stdin and prints the URL to use (replaces the built-in Tumblr fixer)")
+	sanitize        = flag.Bool("sanitize", false, "Clean descriptions: unescape HTML entities, strip markup and control characters, collapse whitespace")
+	vectorStats     = flag.Bool("vector-stats", false, "Log running vector norm and per-dimension mean/variance every -batch GIFs, warning on norm drift")
+	cacheBackend    = flag.String("cache-backend", "", "Share embeddings between runs and machines: fs (-cache-dir) or s3 (-cache-bucket); keyed by model + URL hash")
+	cacheDir        = flag.String("cache-dir", "embed_cache", "Directory for -cache-backend fs (a network filesystem works for a fleet)")
+	cacheBucket     = flag.String("cache-bucket", "", "Bucket for -cache-backend s3 (credentials from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)")
+	cachePrefix     = flag.String("cache-prefix", "embed-cache/", "Object key prefix for -cache-backend s3")
+	cacheEndpoint   = flag.String("cache-endpoint", "", "S3 endpoint for -cache-backend s3 (default https://s3.<AWS_REGION>.amazonaws.com; set for MinIO etc.)")
+	storeChecksum   = flag.Bool("store-checksum", false, "Store embed_checksum, a CRC32 of the vector's float32 bytes, so search.go -verify-checksums can detect corruption")
+	skipExisting    = flag.Bool("skip-existing", false, "Skip rows whose doc is already in the table with the same embed_model; docs from another model are re-embedded")
+	canonicalIDs    = flag.Bool("canonical-ids", false, "Derive docIDs from the provider's GIF ID (tumblr, giphy) so size/subdomain variants merge into one doc; other URLs keep the URL hash. Changes those docIDs, so start a table with it")
+	preserveOrder   = flag.Bool("preserve-order", false, "Store each doc's 0-based input row index (the TSV line) as 'seq', so output can be joined back to its source line whatever the worker or dedup order")
+	storeEmbedMs    = flag.Bool("store-embed-ms", false, "Store the latency of the Termite request that embedded each GIF as 'embed_ms' on the doc")
+	ingestTime      = flag.String("ingest-time", "", "RFC3339 timestamp stored as ingested_at on every doc, for reproducible runs (default: when each doc is built)")
 )
 
+// probeImage is a 1x1 white GIF used to warm up Termite without network fetches
+const probeImage = "data:image/gif;base64,R0lGODlhAQABAIAAAP///wAAACwAAAAAAQABAAACAkQBADs="
+
+// embeddedDoc is one line of the embed/load intermediate file
+type embeddedDoc struct {
+	ID  string         `json:"id"`
+	Doc map[string]any `json:"doc"`
+}
+
+// maxImageBytes caps local GIF downloads so one huge file can't exhaust memory
+const maxImageBytes = 32 << 20
+
 // tumblrIDRegex extracts the tumblr ID from a GIF URL
 var tumblrIDRegex = regexp.MustCompile(`tumblr_([a-zA-Z0-9]+)`)
 
 // httpClient with timeout for Termite requests
 var httpClient = &http.Client{Timeout: 60 * time.Second}
 
+// antflyHTTPClient is used for Antfly requests; main swaps in the configured transport
+var antflyHTTPClient = http.DefaultClient
+
 // getImageEmbedding calls Termite's multimodal API directly to embed an image URL
 func getImageEmbedding(ctx context.Context, imageURL string) ([]float32, error) {
+	// In -fetch-locally mode Termite never sees the URL, only a data: URI
+	if *fetchLocally {
+		data, contentType, err := downloadImage(ctx, imageURL)
+		if err != nil {
+			return nil, fmt.Errorf("fetch locally: %w", err)
+		}
+		imageURL = dataURI(contentType, data)
+	}
+
+	return embedImageURL(ctx, imageURL)
+}
+
+// dataURI inlines image bytes so Termite doesn't need to fetch anything
+func dataURI(contentType string, data []byte) string {
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// embedImageURL sends one image URL (or data: URI) to Termite's embed API
+func embedImageURL(ctx context.Context, imageURL string) ([]float32, error) {
+	embeddings, err := embedImageURLs(ctx, []string{imageURL})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// embedImageURLs sends several images in one embed request. Termite may
+// drop inputs it can't fetch, so callers must check the count matches.
+func embedImageURLs(ctx context.Context, imageURLs []string) ([][]float32, error) {
+	return embedImageURLsWith(ctx, *clipModel, imageURLs)
+}
+
+// embedImageURLsWith is embedImageURLs with a model other than -clip-model
+func embedImageURLsWith(ctx context.Context, model string, imageURLs []string) ([][]float32, error) {
 	// Build multimodal embed request
 	// Format: {"model": "...", "input": [{"type": "image_url", "image_url": {"url": "..."}}]}
-	reqBody := map[string]any{
-		"model": *clipModel,
-		"input": []map[string]any{
-			{
-				"type": "image_url",
-				"image_url": map[string]string{
-					"url": imageURL,
-				},
+	inputs := make([]map[string]any, len(imageURLs))
+	for i, u := range imageURLs {
+		inputs[i] = map[string]any{
+			"type": "image_url",
+			"image_url": map[string]string{
+				"url": u,
 			},
-		},
+		}
+	}
+	reqBody := map[string]any{
+		"model": model,
+		"input": inputs,
 	}
 
 	jsonBody, err := json.Marshal(reqBody)
@@ -71,268 +306,4793 @@ func getImageEmbedding(ctx context.Context, imageURL string) ([]float32, error)
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", *termiteURL+"/api/embed", bytes.NewReader(jsonBody))
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := httpClient.Do(req)
+	body, err := termites.embed(ctx, jsonBody)
 	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read response: %w", err)
-	}
+	// Response is binary: uint64(numVectors) + uint64(dimension) + float32 values
+	return deserializeEmbeddings(body)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("termite error %d: %s", resp.StatusCode, string(body))
-	}
+// Replicas failing this many requests in a row sit out termiteEjectFor
+const (
+	termiteEjectAfter = 3
+	termiteEjectFor   = 30 * time.Second
+)
 
-	// Response is binary: uint64(numVectors) + uint64(dimension) + float32 values
-	return deserializeEmbedding(body)
+// termitePool round-robins embed requests over the -termite-url replicas.
+// A request failing on one replica (connection error, 502, 503 or 504) is
+// retried on the next; a replica that keeps failing is ejected for a while.
+// A plain 500 usually means Termite couldn't fetch or decode the image, so
+// it's returned as is rather than blamed on the replica.
+type termitePool struct {
+	mu        sync.Mutex
+	endpoints []*termiteEndpoint
+	next      int
 }
 
-// deserializeEmbedding parses Termite's binary embedding response
-func deserializeEmbedding(data []byte) ([]float32, error) {
-	r := bytes.NewReader(data)
+type termiteEndpoint struct {
+	url          string
+	failures     int // total, for the end-of-run report
+	consecutive  int
+	ejectedUntil time.Time
+}
 
-	var numVectors uint64
-	if err := binary.Read(r, binary.LittleEndian, &numVectors); err != nil {
-		return nil, fmt.Errorf("read numVectors: %w", err)
-	}
-	if numVectors == 0 {
-		return nil, fmt.Errorf("no embeddings returned")
-	}
+// termites is built from -termite-url in main
+var termites *termitePool
 
-	var dimension uint64
-	if err := binary.Read(r, binary.LittleEndian, &dimension); err != nil {
-		return nil, fmt.Errorf("read dimension: %w", err)
+func newTermitePool(urls string) *termitePool {
+	pool := &termitePool{}
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u != "" {
+			pool.endpoints = append(pool.endpoints, &termiteEndpoint{url: u})
+		}
 	}
+	return pool
+}
 
-	embedding := make([]float32, dimension)
-	for i := range embedding {
-		if err := binary.Read(r, binary.LittleEndian, &embedding[i]); err != nil {
-			return nil, fmt.Errorf("read float %d: %w", i, err)
+// pick returns the next replica that isn't ejected, or if every one is,
+// the one due back soonest
+func (p *termitePool) pick() *termiteEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var soonest *termiteEndpoint
+	for range p.endpoints {
+		e := p.endpoints[p.next%len(p.endpoints)]
+		p.next++
+		if now.After(e.ejectedUntil) {
+			return e
+		}
+		if soonest == nil || e.ejectedUntil.Before(soonest.ejectedUntil) {
+			soonest = e
 		}
 	}
-
-	return embedding, nil
+	return soonest
 }
 
-func main() {
-	flag.Parse()
-	ctx := context.Background()
-
-	// Create client
-	client, err := antfly.NewAntflyClient(*antflyURL, http.DefaultClient)
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+func (p *termitePool) record(e *termiteEndpoint, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		e.consecutive = 0
+		return
 	}
-
-	// Create table with CLIP embeddings index
-	if !*skipCreate {
-		if err := createTable(ctx, client); err != nil {
-			log.Fatalf("Failed to create table: %v", err)
+	e.failures++
+	e.consecutive++
+	if e.consecutive >= termiteEjectAfter {
+		if time.Now().After(e.ejectedUntil) {
+			log.Printf("Warning: ejecting Termite %s for %s after %d straight failures", e.url, termiteEjectFor, e.consecutive)
 		}
+		e.ejectedUntil = time.Now().Add(termiteEjectFor)
 	}
+}
 
-	// Import GIFs
-	if err := importGIFs(ctx, client); err != nil {
-		log.Fatalf("Failed to import GIFs: %v", err)
+// embed POSTs an /api/embed body, trying each replica at most once
+func (p *termitePool) embed(ctx context.Context, jsonBody []byte) ([]byte, error) {
+	var lastErr error
+	for range p.endpoints {
+		e := p.pick()
+		body, retry, err := postEmbed(ctx, e.url, jsonBody)
+		if err == nil {
+			p.record(e, true)
+			return body, nil
+		}
+		lastErr = err
+		if !retry || ctx.Err() != nil {
+			return nil, err
+		}
+		p.record(e, false)
 	}
+	return nil, lastErr
 }
 
-func createTable(ctx context.Context, client *antfly.AntflyClient) error {
-	fmt.Printf("Creating table '%s' with CLIP embeddings index (precomputed vectors)...\n", *tableName)
-
-	// Use direct HTTP request with correct API format (no nested wrappers)
-	// This avoids any potential SDK quirks
-	reqBody := fmt.Sprintf(`{
-		"indexes": {
-			"embeddings": {
-				"name": "embeddings",
-				"type": "aknn_v0",
-				"dimension": 512
-			}
-		}
-	}`)
+// Report lists per-replica failures when there's more than one replica
+func (p *termitePool) Report() {
+	if len(p.endpoints) < 2 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.endpoints {
+		fmt.Printf("Termite %s: %d failures\n", e.url, e.failures)
+	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST",
-		strings.TrimSuffix(*antflyURL, "/api/v1")+"/api/v1/tables/"+*tableName,
-		strings.NewReader(reqBody))
+// postEmbed sends one embed request to one replica. retry reports whether
+// the failure is the replica's (unreachable or a gateway/unavailable status)
+// rather than the input's.
+func postEmbed(ctx context.Context, baseURL string, jsonBody []byte) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/api/embed", bytes.NewReader(jsonBody))
 	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+		return nil, false, fmt.Errorf("create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	termiteHeaders.apply(req.Header)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("send request: %w", err)
+		return nil, true, fmt.Errorf("send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode == http.StatusConflict || strings.Contains(string(body), "already exists") {
-		fmt.Printf("Table '%s' already exists, continuing...\n", *tableName)
-		return nil
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("read response: %w", err)
 	}
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("create table failed %d: %s", resp.StatusCode, string(body))
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("termite error %d: %s", resp.StatusCode, string(body))
+		if isModelMissing(resp.StatusCode, body) {
+			var req struct {
+				Model string `json:"model"`
+			}
+			json.Unmarshal(jsonBody, &req)
+			return nil, false, &modelMissingError{model: req.Model, err: err}
+		}
+		retry := resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		return nil, retry, err
 	}
+	return body, false, nil
+}
 
-	fmt.Printf("Created table '%s'\n", *tableName)
+// modelMissingError is Termite rejecting a request because the model was
+// never pulled. Every later request would fail the same way, so it stops
+// the run instead of failing (and retrying) row by row.
+type modelMissingError struct {
+	model string
+	err   error
+}
 
-	// Wait for shards to be ready (with extra buffer time)
-	if err := waitForShards(ctx, client, 30*time.Second); err != nil {
-		return err
-	}
-	// Longer wait to avoid race conditions with shard startup
-	fmt.Println("Waiting 30s for shard stability...")
-	time.Sleep(30 * time.Second)
-	return nil
+func (e *modelMissingError) Error() string {
+	return fmt.Sprintf("termite doesn't have model %s, run: antflycli termite pull %s (%v)", e.model, e.model, e.err)
 }
 
-func waitForShards(ctx context.Context, client *antfly.AntflyClient, timeout time.Duration) error {
-	fmt.Println("Waiting for shards to be ready...")
-	deadline := time.Now().Add(timeout)
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+func (e *modelMissingError) Unwrap() error {
+	return e.err
+}
 
-	pollCount := 0
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			pollCount++
-			if time.Now().After(deadline) {
-				return fmt.Errorf("timeout waiting for shards")
-			}
+// isModelMissing reports Termite's answer for a model it hasn't pulled:
+// 404 with "model not found: <name>". Other 404s (a wrong -termite-url
+// path) and input errors that merely mention the model don't count.
+func isModelMissing(status int, body []byte) bool {
+	return status == http.StatusNotFound && strings.Contains(strings.ToLower(string(body)), "model not found")
+}
 
-			status, err := client.GetTable(ctx, *tableName)
-			if err != nil {
-				continue
-			}
+// embedResult is the outcome for one image of an embedImages call
+type embedResult struct {
+	Embedding []float32
+	Last      []float32            // last frame's vector, with -frames first-last
+	Extra     map[string][]float32 // -models vectors by index name
+	Err       error
+	Elapsed   time.Duration // duration of the request that produced it
+}
 
-			if len(status.Shards) > 0 && pollCount >= 6 {
-				fmt.Printf("Shards ready after %d polls\n", pollCount)
-				return nil
+// embedImages embeds images in one request, mapping vectors back by order.
+// If the request fails or Termite returns fewer vectors than inputs (it
+// skips images it can't fetch), there's no telling which input is missing,
+// so every image is retried on its own to pin the failure down.
+func embedImages(ctx context.Context, images []string) []embedResult {
+	results := make([]embedResult, len(images))
+	if len(images) > 1 {
+		start := time.Now()
+		embeddings, err := embedImageURLs(ctx, images)
+		elapsed := time.Since(start)
+		if err == nil && len(embeddings) == len(images) {
+			for i := range images {
+				results[i] = embedResult{Embedding: embeddings[i], Elapsed: elapsed}
 			}
+			return results
 		}
+		var missing *modelMissingError
+		if errors.As(err, &missing) {
+			// One at a time would only fail identically
+			for i := range results {
+				results[i] = embedResult{Err: err, Elapsed: elapsed}
+			}
+			return results
+		}
+		if err == nil {
+			log.Printf("Warning: Termite returned %d vectors for %d images, embedding them one at a time", len(embeddings), len(images))
+		} else {
+			log.Printf("Warning: batched embed of %d images failed, embedding them one at a time", len(images))
+		}
+	}
+
+	for i, image := range images {
+		start := time.Now()
+		embedding, err := embedImageURL(ctx, image)
+		results[i] = embedResult{Embedding: embedding, Err: err, Elapsed: time.Since(start)}
 	}
+	return results
 }
 
-func importGIFs(ctx context.Context, client *antfly.AntflyClient) error {
-	file, err := os.Open(*tsvPath)
-	if err != nil {
-		return fmt.Errorf("open tsv: %w", err)
+// embedRows embeds the rows' images and, with -fuse-text-model, fuses in
+// their description embeddings. Vectors the table can't index fail here,
+// by row, rather than later as a whole failed batch insert.
+func embedRows(ctx context.Context, rows []pendingRow) []embedResult {
+	results := embedRowsCached(ctx, rows)
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		if err := checkTableDimension(results[i].Embedding); err != nil {
+			results[i].Embedding, results[i].Err = nil, err
+		}
 	}
-	defer file.Close()
+	if len(extraModels) > 0 {
+		embedExtraModels(ctx, rows, results)
+	}
+	return results
+}
 
-	scanner := bufio.NewScanner(file)
-	batch := make(map[string]any)
-	imported := 0
-	skipped := 0
-	embedFailed := 0
-	startTime := time.Now()
+// extraModel is one -models entry: a vector index filled by its own model
+type extraModel struct {
+	index string
+	model string
+	dim   int // from the flag, the probe or the existing index
+}
 
-	fmt.Println("Starting import with direct CLIP image embeddings...")
-	fmt.Printf("Termite URL: %s, Model: %s\n", *termiteURL, *clipModel)
+// extraModels is parsed from -models in main
+var extraModels []*extraModel
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "\t", 2)
-		if len(parts) != 2 {
-			skipped++
+// parseModels parses -models' name=model[:dim] list
+func parseModels(list string) ([]*extraModel, error) {
+	var models []*extraModel
+	seen := map[string]bool{*indexName: true, lastFrameIndex(): true}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
 			continue
 		}
+		name, model, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || model == "" {
+			return nil, fmt.Errorf("-models entry %q is not name=model[:dim]", entry)
+		}
+		m := &extraModel{index: name, model: model}
+		// Model names have slashes but no colons, so a trailing :N is the dim
+		if i := strings.LastIndex(model, ":"); i >= 0 {
+			dim, err := strconv.Atoi(model[i+1:])
+			if err != nil || dim <= 0 {
+				return nil, fmt.Errorf("-models entry %q: bad dimension %q", entry, model[i+1:])
+			}
+			m.model, m.dim = model[:i], dim
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("-models index name %q is already used", name)
+		}
+		seen[name] = true
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// embedExtraModels adds each -models vector to the rows the primary model
+// embedded, one request per model. A row missing any of them fails as a
+// whole, so no doc lands with only some of its indexes filled. The embed
+// cache only covers -clip-model; these are always computed.
+func embedExtraModels(ctx context.Context, rows []pendingRow, results []embedResult) {
+	var idx []int
+	var images []string
+	for i := range results {
+		if results[i].Err == nil {
+			idx = append(idx, i)
+			images = append(images, rows[i].image)
+		}
+	}
+	if len(idx) == 0 {
+		return
+	}
+	for _, m := range extraModels {
+		vecs, err := embedImageURLsWith(ctx, m.model, images)
+		if err == nil && len(vecs) != len(images) {
+			err = fmt.Errorf("termite returned %d vectors for %d images", len(vecs), len(images))
+		}
+		for j, i := range idx {
+			if results[i].Err != nil {
+				continue
+			}
+			vecErr := err
+			if vecErr == nil && m.dim > 0 && len(vecs[j]) != m.dim {
+				vecErr = fmt.Errorf("got a %d-dim vector but index '%s' expects %d", len(vecs[j]), m.index, m.dim)
+			}
+			if vecErr != nil {
+				results[i].Embedding, results[i].Err = nil, fmt.Errorf("%s (%s): %w", m.index, m.model, vecErr)
+				continue
+			}
+			if results[i].Extra == nil {
+				results[i].Extra = make(map[string][]float32, len(extraModels))
+			}
+			results[i].Extra[m.index] = vecs[j]
+		}
+	}
+}
 
-		gifURL := fixTumblrURL(parts[0])
-		description := parts[1]
-		tumblrID := extractTumblrID(gifURL)
+// embedRowsCached serves rows from the embed cache when there is one
+func embedRowsCached(ctx context.Context, rows []pendingRow) []embedResult {
+	if embeddingCache == nil {
+		return embedRowsUncached(ctx, rows)
+	}
 
-		// Get image embedding from Termite
-		embedding, err := getImageEmbedding(ctx, gifURL)
+	// Serve what the cache has and embed only the misses
+	results := make([]embedResult, len(rows))
+	var missIdx []int
+	var missRows []pendingRow
+	for i, p := range rows {
+		vec, ok, err := embeddingCache.Get(ctx, cacheKey(p.gifURL))
 		if err != nil {
-			log.Printf("Warning: failed to embed %s: %v", gifURL, err)
-			embedFailed++
+			log.Printf("Warning: embed cache lookup for %s: %v", logURL(p.gifURL, p.docID), err)
+		}
+		if ok {
+			results[i] = embedResult{Embedding: vec}
+			if p.lastImage != "" {
+				// Both frames are cached as one vector, first then last
+				results[i] = embedResult{Embedding: vec[:len(vec)/2], Last: vec[len(vec)/2:]}
+			}
+			cacheHits.Add(1)
 			continue
 		}
+		missIdx = append(missIdx, i)
+		missRows = append(missRows, p)
+	}
+	if len(missRows) == 0 {
+		return results
+	}
+	cacheMisses.Add(int64(len(missRows)))
 
-		// Generate document ID from URL hash
-		hash := md5.Sum([]byte(gifURL))
-		docID := fmt.Sprintf("gif_%x", hash[:8])
+	fresh := embedRowsUncached(ctx, missRows)
+	for j, i := range missIdx {
+		results[i] = fresh[j]
+		if fresh[j].Err == nil {
+			vec := fresh[j].Embedding
+			if fresh[j].Last != nil {
+				vec = append(vec[:len(vec):len(vec)], fresh[j].Last...)
+			}
+			if err := embeddingCache.Put(ctx, cacheKey(missRows[j].gifURL), vec); err != nil {
+				log.Printf("Warning: embed cache store for %s: %v", logURL(missRows[j].gifURL, missRows[j].docID), err)
+			}
+		}
+	}
+	return results
+}
 
-		// Convert []float32 to []any for JSON
-		embeddingAny := make([]any, len(embedding))
-		for i, v := range embedding {
-			embeddingAny[i] = v
+// embedRowsUncached always asks Termite
+func embedRowsUncached(ctx context.Context, rows []pendingRow) []embedResult {
+	if *frameMode == "first-last" {
+		return embedFirstLast(ctx, rows)
+	}
+	results := embedImages(ctx, pendingImages(rows))
+	if *fuseTextModel != "" {
+		descriptions := make([]string, len(rows))
+		for i, p := range rows {
+			descriptions[i] = p.description
 		}
+		fuseText(ctx, descriptions, results)
+	}
+	return results
+}
 
-		batch[docID] = map[string]any{
-			"gif_url":     gifURL,
-			"description": description,
-			"tumblr_id":   tumblrID,
-			"_embeddings": map[string]any{
-				"embeddings": embeddingAny, // matches index name
-			},
+// embedFirstLast embeds every row's first and last frames in one request,
+// so a batch costs Termite 2n images but only one round trip. A row fails
+// if either of its frames does.
+func embedFirstLast(ctx context.Context, rows []pendingRow) []embedResult {
+	images := pendingImages(rows)
+	for _, p := range rows {
+		images = append(images, p.lastImage)
+	}
+	all := embedImages(ctx, images)
+
+	results := all[:len(rows)]
+	for i := range results {
+		last := all[len(rows)+i]
+		if results[i].Err == nil && last.Err != nil {
+			results[i].Embedding, results[i].Err = nil, fmt.Errorf("last frame: %w", last.Err)
+		}
+		if results[i].Err == nil {
+			results[i].Last = last.Embedding
 		}
+	}
+	return results
+}
 
-		// Flush batch
-		if len(batch) >= *batchSize {
-			if err := flushBatch(ctx, client, batch); err != nil {
-				log.Printf("Warning: batch insert failed: %v", err)
-			}
-			imported += len(batch)
-			batch = make(map[string]any)
+// embedCache stores vectors by key; implementations must be safe for
+// concurrent use, since -embed-workers embed in parallel
+type embedCache interface {
+	Get(ctx context.Context, key string) ([]float32, bool, error)
+	Put(ctx context.Context, key string, vec []float32) error
+}
 
-			// Progress report
-			elapsed := time.Since(startTime).Seconds()
-			rate := float64(imported) / elapsed
-			fmt.Printf("\rImported: %d (%.1f/sec, %d embed failures)", imported, rate, embedFailed)
+// embeddingCache is set by -cache-backend; nil disables caching
+var embeddingCache embedCache
 
-			// Check limit
-			if *limit > 0 && imported >= *limit {
-				fmt.Printf("\nReached limit of %d\n", *limit)
-				break
-			}
+var cacheHits, cacheMisses atomic.Int64
+
+// newEmbedCache builds the -cache-backend implementation
+func newEmbedCache() (embedCache, error) {
+	switch *cacheBackend {
+	case "":
+		return nil, nil
+	case "fs":
+		if err := os.MkdirAll(*cacheDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create cache dir: %w", err)
 		}
+		return fsCache{dir: *cacheDir}, nil
+	case "s3":
+		return newS3Cache()
+	default:
+		return nil, fmt.Errorf("-cache-backend must be fs or s3, got %q", *cacheBackend)
 	}
+}
 
-	// Final batch
-	if len(batch) > 0 {
-		if err := flushBatch(ctx, client, batch); err != nil {
-			log.Printf("Warning: final batch insert failed: %v", err)
+// cacheKey hashes everything that determines a vector: the model(s),
+// fusion weights, frame handling, preprocessing and the URL. A different
+// model can never hit another's entry.
+func cacheKey(gifURL string) string {
+	model := *clipModel
+	if *fuseTextModel != "" {
+		model = fmt.Sprintf("%s+%s@%g/%g", *clipModel, *fuseTextModel, *imageWeight, *fuseTextWeight)
+	}
+	if *frameMode != "single" {
+		model += "/" + *frameMode
+	}
+	if *preprocessMaxDim > 0 || *centerCrop {
+		model += fmt.Sprintf("/%dpx.%s", *preprocessMaxDim, *preprocessFormat)
+		if *centerCrop {
+			model += "/crop-" + *cropStrategy
 		}
-		imported += len(batch)
 	}
+	sum := sha256.Sum256([]byte(model + "\x00" + gifURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeVector and decodeVector are the cache's value format: raw
+// little-endian float32s
+func encodeVector(vec []float32) []byte {
+	buf := make([]byte, 4*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return buf
+}
 
-	elapsed := time.Since(startTime).Seconds()
-	fmt.Printf("\nCompleted: %d GIFs in %.1fs (%.1f/sec), %d skipped, %d embed failures\n",
-		imported, elapsed, float64(imported)/elapsed, skipped, embedFailed)
+// printURLEmbedding embeds one GIF as a single-frame import row would be
+// and writes the vector to stdout in -embed-url-format
+func printURLEmbedding(ctx context.Context, gifURL string) error {
+	if *embedURLFormat != "json" && *embedURLFormat != "base64" {
+		return fmt.Errorf("-embed-url-format must be json or base64, got %q", *embedURLFormat)
+	}
+	image := gifURL
+	if *fetchLocally {
+		data, contentType, err := downloadImage(ctx, gifURL)
+		if err != nil {
+			return fmt.Errorf("fetch: %w", err)
+		}
+		image = dataURI(contentType, data)
+		if *preprocessMaxDim > 0 || *centerCrop {
+			frame, frameType, err := firstFrame(data, *preprocessMaxDim)
+			if err != nil {
+				return fmt.Errorf("preprocess: %w", err)
+			}
+			image = dataURI(frameType, frame)
+		}
+	}
 
-	return scanner.Err()
+	vec, err := embedImageURL(ctx, image)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d-dim embedding from %s\n", len(vec), *clipModel)
+	if *embedURLFormat == "base64" {
+		fmt.Println(base64.StdEncoding.EncodeToString(encodeVector(vec)))
+		return nil
+	}
+	data, err := json.Marshal(vec)
+	if err != nil {
+		return fmt.Errorf("encode vector: %w", err)
+	}
+	fmt.Println(string(data))
+	return nil
 }
 
-func flushBatch(ctx context.Context, client *antfly.AntflyClient, batch map[string]any) error {
-	_, err := client.Batch(ctx, *tableName, antfly.BatchRequest{
-		Inserts: batch,
-	})
-	return err
+func decodeVector(data []byte) ([]float32, error) {
+	if len(data) == 0 || len(data)%4 != 0 {
+		return nil, fmt.Errorf("corrupt cache entry of %d bytes", len(data))
+	}
+	vec := make([]float32, len(data)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vec, nil
 }
 
-// fixTumblrURL updates old Tumblr CDN URLs to the new domain
-func fixTumblrURL(url string) string {
-	// Old CDN domains redirect to 64.media.tumblr.com
-	url = strings.Replace(url, "38.media.tumblr.com", "64.media.tumblr.com", 1)
-	url = strings.Replace(url, "33.media.tumblr.com", "64.media.tumblr.com", 1)
-	url = strings.Replace(url, "31.media.tumblr.com", "64.media.tumblr.com", 1)
-	return url
+// fsCache keeps one file per key, fanned out by the first two hex digits
+type fsCache struct {
+	dir string
+}
+
+func (c fsCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c fsCache) Get(_ context.Context, key string) ([]float32, bool, error) {
+	data, err := os.ReadFile(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	vec, err := decodeVector(data)
+	return vec, err == nil, err
+}
+
+// Put writes to a temp file and renames, so concurrent writers (or readers
+// on other machines) never see a partial entry
+func (c fsCache) Put(_ context.Context, key string, vec []float32) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(encodeVector(vec)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// s3Cache stores entries as objects via the S3 REST API, signed with
+// SigV4, so any S3-compatible store works without an SDK
+type s3Cache struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+func newS3Cache() (*s3Cache, error) {
+	if *cacheBucket == "" {
+		return nil, fmt.Errorf("-cache-backend s3 needs -cache-bucket")
+	}
+	c := &s3Cache{
+		endpoint:  strings.TrimSuffix(*cacheEndpoint, "/"),
+		bucket:    *cacheBucket,
+		prefix:    *cachePrefix,
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Timeout: 30 * time.Second, Transport: httpClient.Transport},
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("-cache-backend s3 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.endpoint == "" {
+		c.endpoint = "https://s3." + c.region + ".amazonaws.com"
+	}
+	return c, nil
+}
+
+func (c *s3Cache) Get(ctx context.Context, key string) ([]float32, bool, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("s3 get %d: %s", resp.StatusCode, body)
+	}
+	vec, err := decodeVector(body)
+	return vec, err == nil, err
+}
+
+func (c *s3Cache) Put(ctx context.Context, key string, vec []float32) error {
+	resp, err := c.do(ctx, http.MethodPut, key, encodeVector(vec))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("s3 put %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// do sends a path-style object request signed with AWS Signature V4
+func (c *s3Cache) do(ctx context.Context, method, key string, payload []byte) (*http.Response, error) {
+	objectPath := "/" + c.bucket + "/" + c.prefix + key
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+objectPath, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonicalRequest := strings.Join([]string{
+		method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{day, c.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+
+	return c.client.Do(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// fuseText replaces each successful image embedding with the weighted
+// concatenation [w_img·norm(image), w_text·norm(text)]. If the text embed
+// fails, those rows fail too, rather than mixing vector sizes in the index.
+func fuseText(ctx context.Context, descriptions []string, results []embedResult) {
+	start := time.Now()
+	texts, err := embedTexts(ctx, *fuseTextModel, descriptions)
+	elapsed := time.Since(start)
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		results[i].Elapsed += elapsed
+		if err != nil {
+			results[i].Embedding, results[i].Err = nil, fmt.Errorf("embed description with %s: %w", *fuseTextModel, err)
+			continue
+		}
+		results[i].Embedding = fuseVectors(results[i].Embedding, texts[i])
+	}
+}
+
+// fuseVectors L2-normalizes image and text, weights them and concatenates
+func fuseVectors(image, text []float32) []float32 {
+	fused := make([]float32, 0, len(image)+len(text))
+	fused = appendScaled(fused, image, *imageWeight)
+	return appendScaled(fused, text, *fuseTextWeight)
+}
+
+func appendScaled(dst, vec []float32, weight float64) []float32 {
+	var sq float64
+	for _, x := range vec {
+		sq += float64(x) * float64(x)
+	}
+	scale := weight
+	if sq > 0 {
+		scale /= math.Sqrt(sq)
+	}
+	for _, x := range vec {
+		dst = append(dst, float32(float64(x)*scale))
+	}
+	return dst
+}
+
+// warmupTermite embeds the probe image until Termite answers, so lazy model
+// loading doesn't skew the reported rate or fail the first batch
+func warmupTermite(ctx context.Context) error {
+	if *warmupTimeout <= 0 {
+		return nil
+	}
+	fmt.Printf("Warming up %s on Termite (timeout %v)...\n", *clipModel, *warmupTimeout)
+
+	ctx, cancel := context.WithTimeout(ctx, *warmupTimeout)
+	defer cancel()
+
+	start := time.Now()
+	for {
+		_, err := embedImageURL(ctx, probeImage)
+		if err == nil {
+			fmt.Printf("Termite ready after %.1fs\n", time.Since(start).Seconds())
+			return nil
+		}
+		// Waiting won't make a model that was never pulled appear
+		var missing *modelMissingError
+		if errors.As(err, &missing) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("termite not ready after %v: %w", *warmupTimeout, err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// downloadImage fetches GIF bytes via httpClient, retrying transient failures.
+// It returns the body and its image content type.
+func downloadImage(ctx context.Context, imageURL string) ([]byte, string, error) {
+	var err error
+	for attempt := 0; attempt <= *fetchRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			case <-time.After(backoffWithJitter(attempt)):
+			}
+		}
+
+		var data []byte
+		var contentType string
+		data, contentType, err = fetchImageOnce(ctx, imageURL)
+		if err == nil {
+			return data, contentType, nil
+		}
+		if errors.Is(err, errNotImage) {
+			break // retrying won't change the content type
+		}
+	}
+	return nil, "", err
+}
+
+// errNotImage marks a download whose response isn't an image
+var errNotImage = errors.New("not an image")
+
+func fetchImageOnce(ctx context.Context, imageURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download error %d", resp.StatusCode)
+	}
+
+	// Tumblr serves a text/html placeholder page for removed GIFs
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("%w: content type %q", errNotImage, contentType)
+	}
+	contentType, _, _ = strings.Cut(contentType, ";")
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("read response: %w", err)
+	}
+	if len(data) > maxImageBytes {
+		return nil, "", fmt.Errorf("image larger than %d bytes", maxImageBytes)
+	}
+	return data, contentType, nil
+}
+
+// deserializeEmbedding parses Termite's binary embedding response
+func deserializeEmbedding(data []byte) ([]float32, error) {
+	embeddings, err := deserializeEmbeddings(data)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// errEmptyEmbedding marks a request Termite accepted but produced no vector
+// for, usually an image format or frame layout it can't decode
+var errEmptyEmbedding = errors.New("no embeddings returned")
+
+// deserializeEmbeddings parses every vector in a Termite embed response
+func deserializeEmbeddings(data []byte) ([][]float32, error) {
+	r := bytes.NewReader(data)
+
+	var numVectors uint64
+	if err := binary.Read(r, binary.LittleEndian, &numVectors); err != nil {
+		return nil, fmt.Errorf("read numVectors: %w", err)
+	}
+	if numVectors == 0 {
+		return nil, errEmptyEmbedding
+	}
+
+	var dimension uint64
+	if err := binary.Read(r, binary.LittleEndian, &dimension); err != nil {
+		return nil, fmt.Errorf("read dimension: %w", err)
+	}
+	// Bound each factor by the payload before multiplying, so a corrupt
+	// header can't overflow the size check or the allocations
+	if dimension == 0 || dimension > uint64(r.Len())/4 || numVectors > uint64(r.Len())/(dimension*4) {
+		return nil, fmt.Errorf("response holds %d bytes, want %d vectors of dimension %d", r.Len(), numVectors, dimension)
+	}
+
+	embeddings := make([][]float32, numVectors)
+	for v := range embeddings {
+		embeddings[v] = make([]float32, dimension)
+		if err := binary.Read(r, binary.LittleEndian, embeddings[v]); err != nil {
+			return nil, fmt.Errorf("read vector %d: %w", v, err)
+		}
+	}
+
+	return embeddings, nil
+}
+
+// serializeEmbeddings builds a Termite binary response for vectors of
+// equal length: the inverse of deserializeEmbeddings
+func serializeEmbeddings(vectors [][]float32) []byte {
+	var buf bytes.Buffer
+	dim := 0
+	if len(vectors) > 0 {
+		dim = len(vectors[0])
+	}
+	binary.Write(&buf, binary.LittleEndian, uint64(len(vectors)))
+	binary.Write(&buf, binary.LittleEndian, uint64(dim))
+	for _, v := range vectors {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// selfcheckDeserialize feeds deserializeEmbeddings payloads with known
+// contents, comparing float bits so -0, NaN and subnormals must survive
+// exactly, and checks malformed payloads are rejected rather than misread
+func selfcheckDeserialize() error {
+	cases := []struct {
+		name    string
+		vectors [][]float32
+	}{
+		{"dimension 1", [][]float32{{0.5}}},
+		{"one vector", [][]float32{{1, -2.25, 3.125, 0}}},
+		{"three vectors", [][]float32{{1, 2, 3, 4}, {-1, -2, -3, -4}, {0.1, 0.2, 0.3, 0.4}}},
+		{"special values", [][]float32{{
+			float32(math.Copysign(0, -1)), float32(math.NaN()), float32(math.Inf(1)), float32(math.Inf(-1)),
+			math.SmallestNonzeroFloat32, math.MaxFloat32,
+		}}},
+	}
+	for _, c := range cases {
+		got, err := deserializeEmbeddings(serializeEmbeddings(c.vectors))
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+		if len(got) != len(c.vectors) {
+			return fmt.Errorf("%s: got %d vectors, want %d", c.name, len(got), len(c.vectors))
+		}
+		for v := range c.vectors {
+			if len(got[v]) != len(c.vectors[v]) {
+				return fmt.Errorf("%s: vector %d has dimension %d, want %d", c.name, v, len(got[v]), len(c.vectors[v]))
+			}
+			for i, want := range c.vectors[v] {
+				if math.Float32bits(got[v][i]) != math.Float32bits(want) {
+					return fmt.Errorf("%s: vector %d[%d] is %08x, want %08x", c.name, v, i, math.Float32bits(got[v][i]), math.Float32bits(want))
+				}
+			}
+		}
+		fmt.Printf("ok   %s\n", c.name)
+	}
+
+	// Payloads that must fail, not decode to garbage
+	full := serializeEmbeddings([][]float32{{1, 2}, {3, 4}})
+	bad := []struct {
+		name    string
+		payload []byte
+	}{
+		{"no vectors", serializeEmbeddings(nil)},
+		{"truncated header", full[:12]},
+		{"truncated floats", full[:len(full)-1]},
+		{"empty", nil},
+	}
+	for _, c := range bad {
+		if _, err := deserializeEmbeddings(c.payload); err == nil {
+			return fmt.Errorf("%s: payload accepted, want an error", c.name)
+		}
+		fmt.Printf("ok   %s rejected\n", c.name)
+	}
+	return nil
+}
+
+func main() {
+	// Optional subcommand ahead of the flags: embed | load | export | local-search | retry-dead-letter | describe-schema | migrate | pick
+	command := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.Parse()
+	termites = newTermitePool(*termiteURL)
+
+	// The first Ctrl-C lets the import stop cleanly; a second one kills it
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+	}()
+
+	// Anything failing before the import starts exits with exitStartup
+	startupFatal := func(format string, args ...any) {
+		if *summaryOut != "" {
+			summary := &importSummary{Outcome: "startup-failed", Error: fmt.Sprintf(format, args...)}
+			summary.Table, summary.Model, summary.ConfigHash = *tableName, *clipModel, configHash()
+			summary.FinishedAt = time.Now().UTC()
+			if err := writeSummary(*summaryOut, summary); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+		if ctx.Err() != nil {
+			fatal(exitSignal, format, args...)
+		}
+		fatal(exitStartup, format, args...)
+	}
+
+	if *ci && *heartbeat > 0 {
+		go heartbeats(*heartbeat)
+	}
+
+	if *pprofAddr != "" {
+		go func() {
+			log.Printf("pprof listening on http://%s/debug/pprof/", *pprofAddr)
+			if err := http.ListenAndServe(*pprofAddr, nil); err != nil {
+				log.Printf("Warning: pprof server stopped: %v", err)
+			}
+		}()
+	}
+
+	switch command {
+	case "", "embed", "load", "export", "local-search", "retry-dead-letter", "describe-schema", "migrate", "pick":
+	default:
+		startupFatal("Unknown command %q (want embed, load, export, local-search, retry-dead-letter, describe-schema, migrate or pick)", command)
+	}
+
+	if *blocklistFile != "" {
+		b, err := loadBlocklist(*blocklistFile)
+		if err != nil {
+			startupFatal("%v", err)
+		}
+		blocklist = b
+	}
+	if *ingestTime != "" {
+		t, err := time.Parse(time.RFC3339, *ingestTime)
+		if err != nil {
+			startupFatal("-ingest-time must be RFC3339 (e.g. 2024-01-02T15:04:05Z): %v", err)
+		}
+		fixedIngestTime = t.UTC().Format(time.RFC3339)
+	}
+	if *urlCol < 0 || *descCol < 0 {
+		startupFatal("-url-col and -desc-col must be >= 0")
+	}
+	if *flushRetries < 0 || *outageRetries < 0 || *fetchRetries < 0 {
+		startupFatal("-flush-retries, -outage-retries and -fetch-retries must be >= 0")
+	}
+	if *pipelineBuffer < 0 {
+		startupFatal("-pipeline-buffer must be >= 0")
+	}
+	if *preprocessFormat != "png" && *preprocessFormat != "jpeg" {
+		startupFatal("-preprocess-format must be png or jpeg, got %q", *preprocessFormat)
+	}
+	if *cropStrategy != "center" && *cropStrategy != "pad" {
+		startupFatal("-crop-strategy must be center or pad, got %q", *cropStrategy)
+	}
+	if *centerCrop && !*fetchLocally && *frameMode != "first-last" {
+		startupFatal("-center-crop needs -fetch-locally (or -frames first-last): Termite fetches URLs as is")
+	}
+	models, err := parseModels(*modelsFlag)
+	if err != nil {
+		startupFatal("%v", err)
+	}
+	extraModels = models
+	if *frameMode != "single" && *frameMode != "first-last" {
+		startupFatal("-frames must be single or first-last, got %q", *frameMode)
+	}
+	if *frameMode == "first-last" && *fuseTextModel != "" {
+		startupFatal("-frames first-last can't be combined with -fuse-text-model")
+	}
+
+	// Stdout carries only docs; every other print goes to stderr
+	docsOut := os.Stdout
+	switch *output {
+	case "antfly":
+	case "stdout":
+		if command != "" {
+			startupFatal("-output stdout only applies to a plain import, not %s", command)
+		}
+		os.Stdout = os.Stderr
+	default:
+		startupFatal("-output must be antfly or stdout, got %q", *output)
+	}
+
+	// Status output (never docs, which go to docsOut) is teed into -log-file
+	if *logFile != "" {
+		if err := openRunLog(*logFile, int64(*logMaxSize)<<20, *logKeep, *logStdout); err != nil {
+			startupFatal("%v", err)
+		}
+		defer closeRunLog()
+	}
+
+	// Parser self-check: offline, exits non-zero on any mismatch
+	if *selfcheck {
+		if err := selfcheckDeserialize(); err != nil {
+			startupFatal("Deserialize self-check failed: %v", err)
+		}
+		fmt.Println("Deserialize self-check passed")
+		return
+	}
+
+	// Preview mode: no Termite or Antfly calls, so no embeddings either
+	if *head > 0 {
+		if err := printHead(); err != nil {
+			startupFatal("Head failed: %v", err)
+		}
+		return
+	}
+
+	// Route Termite and Antfly traffic through the proxy/CA-aware transport
+	transport, err := newTransport()
+	if err != nil {
+		startupFatal("Failed to configure HTTP transport: %v", err)
+	}
+	httpClient.Transport = transport
+	antflyHTTPClient = &http.Client{Transport: transport}
+	if len(*antflyHeaders) > 0 {
+		antflyHTTPClient.Transport = &headerTransport{base: transport, headers: *antflyHeaders}
+	}
+
+	// Debug one-shot: Termite only, and never the cache, to see its answer
+	if *embedURL != "" {
+		if err := printURLEmbedding(ctx, *embedURL); err != nil {
+			startupFatal("Failed to embed %s: %v", *embedURL, err)
+		}
+		return
+	}
+
+	if embeddingCache, err = newEmbedCache(); err != nil {
+		startupFatal("Failed to open embed cache: %v", err)
+	}
+
+	// Create client
+	client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
+	if err != nil {
+		startupFatal("Failed to create client: %v", err)
+	}
+
+	// Local search needs only Termite and the -local-index file
+	if command == "local-search" {
+		if err := localSearch(ctx); err != nil {
+			fatal(1, "Local search failed: %v", err)
+		}
+		return
+	}
+
+	// Read-only: print the best GIF URLs for a phrase
+	if command == "pick" {
+		if err := pickGIFs(ctx, client); err != nil {
+			fatal(1, "Pick failed: %v", err)
+		}
+		return
+	}
+
+	// Read-only: print how -table is configured
+	if command == "describe-schema" {
+		if err := describeSchema(ctx, client); err != nil {
+			fatal(1, "Failed to describe schema: %v", err)
+		}
+		return
+	}
+
+	// Export reads the existing table; no create or import
+	if command == "export" {
+		if err := exportTable(ctx, client); err != nil {
+			fatal(1, "Failed to export table: %v", err)
+		}
+		return
+	}
+
+	// Migrate patches docs in place; no create or import
+	if command == "migrate" {
+		if err := migrateTable(ctx, client); err != nil {
+			fatal(1, "Failed to migrate table: %v", err)
+		}
+		return
+	}
+
+	// Describe-only mode reads the existing table; no create or import
+	if *describeMissing != "" {
+		if err := describeMissingGIFs(ctx, client); err != nil {
+			fatal(1, "Failed to describe GIFs: %v", err)
+		}
+		return
+	}
+
+	// Phase one: embed to a file (or stdout), never touching Antfly
+	if command == "embed" || *output == "stdout" {
+		out := docsOut
+		if *output != "stdout" {
+			if out, err = os.Create(*embeddingsFile); err != nil {
+				startupFatal("Failed to create embeddings file: %v", err)
+			}
+			defer out.Close()
+		}
+		var summary *importSummary
+		err = profiled(func() (err error) {
+			summary, err = importGIFs(ctx, client, json.NewEncoder(out))
+			return err
+		})
+		out.Close()
+		finishImport(summary, err)
+	}
+
+	// Create table with CLIP embeddings index
+	dim := 0
+	if !*skipCreate {
+		dim, err = detectDimension(ctx)
+		if err != nil {
+			startupFatal("Failed to detect embedding dimension: %v", err)
+		}
+		lock, err := acquireTableLock()
+		if err != nil {
+			startupFatal("Failed to lock table setup: %v", err)
+		}
+		err = createTable(ctx, client, dim)
+		lock.Release()
+		if err != nil {
+			startupFatal("Failed to create table: %v", err)
+		}
+	}
+
+	// Docs carry _embeddings.<index-name>, so the table must have that index
+	if err := checkIndex(ctx, client); err != nil {
+		startupFatal("Index check failed: %v", err)
+	}
+	// An existing table keeps its old dimension even when the model changed
+	if dim > 0 && tableDimension > 0 && dim != tableDimension {
+		startupFatal("Index '%s' of '%s' is %d-dim but %s produces %d-dim vectors; use a new -table or the matching model", *indexName, *tableName, tableDimension, *clipModel, dim)
+	}
+
+	// Phase two: insert a previously embedded file
+	if command == "load" {
+		if err := profiled(func() error { return loadEmbeddings(ctx, client) }); err != nil {
+			fatal(1, "Failed to load embeddings: %v", err)
+		}
+		return
+	}
+
+	if command == "retry-dead-letter" {
+		if err := profiled(func() error { return retryDeadLetters(ctx, client) }); err != nil {
+			fatal(1, "Failed to retry dead letters: %v", err)
+		}
+		return
+	}
+
+	// Import GIFs
+	var summary *importSummary
+	err = profiled(func() (err error) {
+		summary, err = importGIFs(ctx, client, nil)
+		return err
+	})
+	finishImport(summary, err)
+}
+
+// Exit codes beyond log.Fatal's 1, so cron and CI can tell outcomes apart
+const (
+	exitStartup     = 3   // config, connection or table setup failed before importing
+	exitMaxFailures = 4   // -max-failures exceeded
+	exitSignal      = 130 // stopped by SIGINT/SIGTERM
+)
+
+// fatal logs and exits with the given code
+func fatal(code int, format string, args ...any) {
+	log.Printf(format, args...)
+	closeRunLog()
+	os.Exit(code)
+}
+
+// rotatingFile is an append-only log that moves itself to path.1 (and
+// older copies up to path.<keep>) before a write would take it past
+// maxSize. Both the log package and the stdout copier write to it, so
+// writes are serialized.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File // nil after Close, or while a failed rotate can't reopen path
+	size    int64
+	closed  bool
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open log file: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if rotateErr = r.rotate(); r.f == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts path.N-1 to path.N down to path to path.1, dropping the
+// oldest, then starts a fresh path. With keep 0 the old log is discarded.
+// If path can't be moved aside, it reopens it and keeps appending past
+// maxSize rather than losing the log; the error is still returned.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	var err error
+	if r.keep <= 0 {
+		os.Remove(r.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+		for i := r.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if rerr := os.Rename(r.path, r.path+".1"); rerr != nil {
+			err = fmt.Errorf("rotate log file: %w", rerr)
+		}
+	}
+	return errors.Join(err, r.open())
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// runLog is the open -log-file. Status lines are printed with fmt.Print
+// all over the importer, so rather than thread a writer through every call
+// os.Stdout is swapped for a pipe and copied into the file; the log
+// package writes to the file directly.
+var runLog struct {
+	file    *rotatingFile
+	stdout  *os.File      // write end of the pipe standing in for os.Stdout
+	console *os.File      // the real os.Stdout, restored on close
+	copied  chan struct{} // closed once the pipe is drained
+}
+
+// openRunLog starts teeing status output into path. With toConsole false
+// it goes only to the file.
+func openRunLog(path string, maxSize int64, keep int, toConsole bool) error {
+	file, err := openRotatingFile(path, maxSize, keep)
+	if err != nil {
+		return err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("log file pipe: %w", err)
+	}
+	failed := new(atomic.Bool)
+	stdout := &logTee{file: file, console: os.Stdout, always: toConsole, failed: failed}
+	stderr := &logTee{file: file, console: os.Stderr, always: toConsole, failed: failed}
+	runLog.file, runLog.stdout, runLog.console, runLog.copied = file, pw, os.Stdout, make(chan struct{})
+	go func() {
+		defer close(runLog.copied)
+		// logTee never fails, so this drains the pipe until closeRunLog
+		io.Copy(stdout, pr)
+	}()
+	os.Stdout = pw
+	log.SetOutput(stderr)
+
+	fmt.Fprintf(file, "=== %s %s\n", time.Now().UTC().Format(time.RFC3339), strings.Join(os.Args, " "))
+	return nil
+}
+
+// logTee writes to -log-file and, when teeing or when the file write fails
+// (full disk, a rotation that couldn't reopen the file), to the console.
+// It never returns an error, so a broken log file can't stop the output.
+type logTee struct {
+	file    io.Writer
+	console io.Writer
+	always  bool
+	failed  *atomic.Bool // shared by stdout and stderr, to warn once
+}
+
+func (t *logTee) Write(p []byte) (int, error) {
+	if t.always {
+		t.console.Write(p)
+	}
+	if _, err := t.file.Write(p); err != nil {
+		if !t.failed.Swap(true) {
+			fmt.Fprintf(t.console, "Warning: -log-file: %v (echoing output to the console)\n", err)
+		}
+		if !t.always {
+			t.console.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// closeRunLog flushes what's still in the stdout pipe into -log-file and
+// closes it; a no-op without -log-file. Anything that exits must call it,
+// or the end of the run (usually the summary) is lost.
+func closeRunLog() {
+	if runLog.file == nil {
+		return
+	}
+	runLog.stdout.Close()
+	<-runLog.copied
+	os.Stdout = runLog.console
+	log.SetOutput(os.Stderr)
+	runLog.file.Close()
+	runLog.file = nil
+}
+
+// importSummary is the end-of-run report of importGIFs
+type importSummary struct {
+	Outcome     string         `json:"outcome"` // completed, limit, max-runtime, interrupted, max-failures, failed or startup-failed
+	Imported    int            `json:"imported"`
+	Skipped     int            `json:"skipped"`
+	Blocked     int            `json:"blocked"`
+	BlockTerms  int            `json:"blocked_terms"` // description matched -blocklist
+	Duplicates  int            `json:"duplicates"`
+	InvalidURLs int            `json:"invalid_urls"`
+	LongURLs    int            `json:"long_urls"` // over -max-url-len
+	Existing    int            `json:"existing"`  // already embedded with the current model (-skip-existing)
+	Merged      int            `json:"merged"`    // URL variants collapsed by -canonical-ids
+	Failed      map[string]int `json:"failed"`    // fetch, embed, empty, insert
+	DurationSec float64        `json:"duration_sec"`
+	Rate        float64        `json:"rate"`
+	LastRow     int            `json:"last_row"`
+
+	// Filled in for -summary-out
+	Error      string    `json:"error,omitempty"`
+	Table      string    `json:"table,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	ConfigHash string    `json:"config_hash,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+}
+
+// startupError marks an importGIFs failure before any row was read (input,
+// checkpoint, Termite warmup...), which exits with exitStartup like the
+// checks in main
+type startupError struct{ err error }
+
+func (e startupError) Error() string { return e.err.Error() }
+func (e startupError) Unwrap() error { return e.err }
+
+// finishImport records a finished (or failed) importGIFs run in
+// -summary-out, then exits with the outcome's code
+func finishImport(summary *importSummary, err error) {
+	if summary == nil {
+		summary = &importSummary{Outcome: "failed"}
+		if errors.As(err, new(startupError)) {
+			summary.Outcome = "startup-failed"
+		}
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	if *summaryOut != "" {
+		summary.Table = *tableName
+		summary.Model = embedModelName()
+		summary.ConfigHash = configHash()
+		summary.FinishedAt = time.Now().UTC()
+		if werr := writeSummary(*summaryOut, summary); werr != nil {
+			log.Printf("Warning: %v", werr)
+		}
+	}
+	var setup startupError
+	if errors.As(err, &setup) {
+		if errors.Is(setup.err, context.Canceled) {
+			fatal(exitSignal, "Interrupted before the import started: %v", setup.err)
+		}
+		fatal(exitStartup, "Failed to start import: %v", setup.err)
+	}
+	if err != nil {
+		fatal(1, "Failed to import GIFs: %v", err)
+	}
+	closeRunLog()
+	os.Exit(summary.exitCode())
+}
+
+// configHash fingerprints every flag's value, so runs with identical
+// settings can be grouped (and differing ones spotted) on a dashboard
+func configHash() string {
+	h := sha256.New()
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value)
+	})
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// writeSummary replaces path atomically, so a reader never sees half a report
+func writeSummary(path string, summary *importSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal summary: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write summary: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write summary: %w", err)
+	}
+	return nil
+}
+
+func (s *importSummary) exitCode() int {
+	switch s.Outcome {
+	case "interrupted":
+		return exitSignal
+	case "max-failures":
+		return exitMaxFailures
+	}
+	return 0
+}
+
+// profiled runs an ingest phase under -cpuprofile, then writes -memprofile
+func profiled(run func() error) error {
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return fmt.Errorf("create cpu profile: %w", err)
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return fmt.Errorf("start cpu profile: %w", err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	runErr := run()
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		if err != nil {
+			return errors.Join(runErr, fmt.Errorf("create heap profile: %w", err))
+		}
+		defer f.Close()
+		runtime.GC() // up-to-date live heap, not the last GC's
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			return errors.Join(runErr, fmt.Errorf("write heap profile: %w", err))
+		}
+	}
+	return runErr
+}
+
+// headers is a repeatable key=value flag
+type headers http.Header
+
+func headerFlag(name, usage string) *headers {
+	h := headers{}
+	flag.Var(&h, name, usage)
+	return &h
+}
+
+func (h *headers) String() string {
+	if h == nil {
+		return ""
+	}
+	var pairs []string
+	for key, values := range *h {
+		for _, v := range values {
+			pairs = append(pairs, key+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (h *headers) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	if key = strings.TrimSpace(key); !ok || key == "" {
+		return fmt.Errorf("want key=value, got %q", value)
+	}
+	http.Header(*h).Add(key, v)
+	return nil
+}
+
+// apply sets the headers on an outgoing request, replacing any defaults
+func (h *headers) apply(dst http.Header) {
+	for key, values := range *h {
+		dst[http.CanonicalHeaderKey(key)] = values
+	}
+}
+
+// headerTransport adds -antfly-header to every request the SDK makes
+type headerTransport struct {
+	base    http.RoundTripper
+	headers headers
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	t.headers.apply(req.Header)
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections lets antflyHTTPClient.CloseIdleConnections reach the
+// wrapped transport's pool
+func (t *headerTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// newTransport builds the shared HTTP transport. Proxies come from
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY; -ca-cert adds an internal root CA
+// on top of the system pool.
+func newTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.IdleConnTimeout = *idleConnTimeout
+	if *caCert == "" {
+		return transport, nil
+	}
+
+	pem, err := os.ReadFile(*caCert)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", *caCert)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
+
+// lastFrameIndex holds the last-frame vectors of -frames first-last
+func lastFrameIndex() string {
+	return *indexName + "_last"
+}
+
+func createTable(ctx context.Context, client *antfly.AntflyClient, dim int) error {
+	if err := checkDimension(ctx, dim); err != nil {
+		return err
+	}
+	fmt.Printf("Creating table '%s' with CLIP embeddings index '%s' (precomputed %d-dim vectors)...\n", *tableName, *indexName, dim)
+
+	// Use direct HTTP request with correct API format (no nested wrappers)
+	// This avoids any potential SDK quirks
+	indexes := map[string]any{
+		*indexName: map[string]any{"name": *indexName, "type": "aknn_v0", "dimension": dim},
+	}
+	if *frameMode == "first-last" {
+		// Second vector per doc; search queries both to match either frame
+		indexes[lastFrameIndex()] = map[string]any{"name": lastFrameIndex(), "type": "aknn_v0", "dimension": dim}
+	}
+	for _, m := range extraModels {
+		if m.dim == 0 {
+			vecs, err := embedImageURLsWith(ctx, m.model, []string{probeImage})
+			if err != nil {
+				return fmt.Errorf("embed probe image with %s (set its :dim in -models to skip): %w", m.model, err)
+			}
+			m.dim = len(vecs[0])
+			fmt.Printf("Detected %d-dim embeddings from %s\n", m.dim, m.model)
+		}
+		indexes[m.index] = map[string]any{"name": m.index, "type": "aknn_v0", "dimension": m.dim}
+	}
+	reqBody, err := json.Marshal(map[string]any{"indexes": indexes})
+	if err != nil {
+		return fmt.Errorf("encode create request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		strings.TrimSuffix(*antflyURL, "/api/v1")+"/api/v1/tables/"+*tableName,
+		bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := antflyHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusConflict || strings.Contains(string(body), "already exists") {
+		fmt.Printf("Table '%s' already exists, continuing...\n", *tableName)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("create table failed %d: %s", resp.StatusCode, string(body))
+	}
+
+	fmt.Printf("Created table '%s'\n", *tableName)
+
+	// Wait for shards to be ready (with extra buffer time)
+	if err := waitForShards(ctx, client, 30*time.Second); err != nil {
+		return err
+	}
+	// CI can't afford a blind sleep; wait until the table actually answers
+	if *ci {
+		if err := waitForQueryable(ctx, client, 2*time.Minute); err != nil {
+			return err
+		}
+	} else {
+		// Longer wait to avoid race conditions with shard startup
+		fmt.Println("Waiting 30s for shard stability...")
+		time.Sleep(30 * time.Second)
+	}
+	if *verifyCreate {
+		return verifyQueryable(ctx, client, dim)
+	}
+	return nil
+}
+
+// verifyTimeout bounds how long -verify-after-create waits for its probe
+// doc to show up in a vector query
+const verifyTimeout = 2 * time.Minute
+
+// verifyQueryable round-trips a throwaway doc through the vector index:
+// insert, find it by its own vector, delete. Shards can exist and take
+// inserts well before the index serves queries.
+func verifyQueryable(ctx context.Context, client *antfly.AntflyClient, dim int) error {
+	fmt.Println("Verifying the table serves vector queries...")
+	id := fmt.Sprintf("_verify_%d", time.Now().UnixNano())
+	vec := make([]float32, dim)
+	vec[0] = 1
+	_, err := client.Batch(ctx, *tableName, antfly.BatchRequest{
+		Inserts:   map[string]any{id: map[string]any{"_embeddings": map[string]any{*indexName: vec}}},
+		SyncLevel: antfly.SyncLevelAknn,
+	})
+	if err != nil {
+		return fmt.Errorf("table not ready for queries: insert probe doc: %w", err)
+	}
+	defer func() {
+		if _, err := client.Batch(ctx, *tableName, antfly.BatchRequest{Deletes: []string{id}}); err != nil {
+			log.Printf("Warning: failed to delete probe doc %s: %v", id, err)
+		}
+	}()
+
+	deadline := time.Now().Add(verifyTimeout)
+	for {
+		resp, err := client.Query(ctx, antfly.QueryRequest{
+			Table:          *tableName,
+			Indexes:        []string{*indexName},
+			SemanticSearch: id, // the SDK wants text with indexes; the vector wins
+			Embeddings:     map[string][]float32{*indexName: vec},
+			Limit:          1,
+		})
+		if err == nil && len(resp.Responses) > 0 {
+			if r := resp.Responses[0]; r.Error != "" {
+				err = fmt.Errorf("%s", r.Error)
+			} else if len(r.Hits.Hits) > 0 && r.Hits.Hits[0].ID == id {
+				fmt.Println("Table serves vector queries")
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("probe doc %s not returned", id)
+			}
+			return fmt.Errorf("table not ready for queries after %s: %w", verifyTimeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitForQueryable polls a one-row query until the table serves reads
+func waitForQueryable(ctx context.Context, client *antfly.AntflyClient, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := client.Query(ctx, antfly.QueryRequest{Table: *tableName, Limit: 1})
+		if err == nil {
+			fmt.Println("Table is serving queries")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("table not queryable after %s: %w", timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// lastOutput is when progressf last wrote, in unix nanoseconds
+var lastOutput atomic.Int64
+
+// progressf rewrites the current progress line, or with -ci prints a new
+// line each time since carriage returns garble CI logs
+func progressf(format string, args ...any) {
+	lastOutput.Store(time.Now().UnixNano())
+	if *ci {
+		fmt.Printf(format+"\n", args...)
+		return
+	}
+	fmt.Printf("\r"+format, args...)
+}
+
+// heartbeats prints a line whenever progress has been quiet for every, so
+// CI doesn't kill a job stuck in a long embed stretch as idle
+func heartbeats(every time.Duration) {
+	start := time.Now()
+	lastOutput.Store(start.UnixNano())
+	for range time.Tick(every / 2) {
+		if time.Since(time.Unix(0, lastOutput.Load())) >= every {
+			progressf("Heartbeat: still running after %s", time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+// detectDimension returns -dimension, or embeds the probe image once and
+// reads the model's output size, so a non-default -clip-model can't create
+// an index that rejects every insert
+func detectDimension(ctx context.Context) (int, error) {
+	if *dimension > 0 {
+		return *dimension, nil
+	}
+	return probeDimension(ctx)
+}
+
+// probeDimension embeds the probe image (and text, when fusing) to learn
+// the vector size the configured model(s) produce
+func probeDimension(ctx context.Context) (int, error) {
+	if *warmupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *warmupTimeout)
+		defer cancel()
+	}
+	embedding, err := embedImageURL(ctx, probeImage)
+	if err != nil {
+		return 0, fmt.Errorf("embed probe image with %s (set -dimension to skip): %w", *clipModel, err)
+	}
+	fmt.Printf("Detected %d-dim embeddings from %s\n", len(embedding), *clipModel)
+	if *fuseTextModel == "" {
+		return len(embedding), nil
+	}
+
+	// Fused vectors are image and text back to back, so the index needs both
+	texts, err := embedTexts(ctx, *fuseTextModel, []string{"probe"})
+	if err != nil {
+		return 0, fmt.Errorf("embed probe text with %s (set -dimension to skip): %w", *fuseTextModel, err)
+	}
+	fmt.Printf("Detected %d-dim embeddings from %s, fused dimension %d\n", len(texts[0]), *fuseTextModel, len(embedding)+len(texts[0]))
+	return len(embedding) + len(texts[0]), nil
+}
+
+// knownDimensions are the output sizes of models we've run through Termite.
+// They let -dimension be checked without a probe.
+var knownDimensions = map[string]int{
+	"openai/clip-vit-base-patch32":                                512,
+	"openai/clip-vit-base-patch16":                                512,
+	"openai/clip-vit-large-patch14":                               768,
+	"BAAI/bge-small-en-v1.5":                                      384,
+	"BAAI/bge-base-en-v1.5":                                       768,
+	"BAAI/bge-large-en-v1.5":                                      1024,
+	"sentence-transformers/all-MiniLM-L6-v2":                      384,
+	"sentence-transformers/paraphrase-multilingual-MiniLM-L12-v2": 384,
+}
+
+// checkDimension refuses an explicit -dimension that doesn't match what the
+// model(s) produce, before an index is created that rejects every insert.
+// Known models are checked from the table, others by a probe; if the probe
+// can't reach Termite we warn and trust -dimension.
+func checkDimension(ctx context.Context, dim int) error {
+	if *dimension == 0 {
+		return nil // dim came from a probe
+	}
+	model := *clipModel
+	expected, known := knownDimensions[*clipModel]
+	if *fuseTextModel != "" {
+		model += "+" + *fuseTextModel
+		textDim, ok := knownDimensions[*fuseTextModel]
+		expected, known = expected+textDim, known && ok
+	}
+	if !known {
+		probed, err := probeDimension(ctx)
+		if err != nil {
+			log.Printf("Warning: can't verify -dimension %d against %s: %v", dim, model, err)
+			return nil
+		}
+		expected = probed
+	}
+	if dim != expected {
+		return fmt.Errorf("-dimension is %d but %s produces %d-dim vectors; pass -dimension %d (or 0 to detect it)", dim, model, expected, expected)
+	}
+	return nil
+}
+
+// tableDimension is the live index's vector size, read by checkIndex before
+// any rows are embedded (0 when unknown, e.g. for the embed subcommand)
+var tableDimension int
+
+// checkTableDimension rejects a vector the table's index can't hold
+func checkTableDimension(vec []float32) error {
+	if tableDimension > 0 && len(vec) != tableDimension {
+		return fmt.Errorf("got a %d-dim vector but index '%s' of '%s' expects %d (wrong -clip-model?)", len(vec), *indexName, *tableName, tableDimension)
+	}
+	return nil
+}
+
+// checkIndex verifies the table has the vector index our docs reference.
+// A mismatch would otherwise insert vectors Antfly silently never indexes.
+// It also records the index's dimension in tableDimension, and each
+// -models index's in its extraModel.
+func checkIndex(ctx context.Context, client *antfly.AntflyClient) error {
+	status, err := client.GetTable(ctx, *tableName)
+	if err != nil {
+		return fmt.Errorf("get table: %w", err)
+	}
+	names := make([]string, 0, len(status.Indexes))
+	for name := range status.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	index, ok := status.Indexes[*indexName]
+	if !ok {
+		return fmt.Errorf("table '%s' has no index '%s' (has: %s); set -index-name to match",
+			*tableName, *indexName, strings.Join(names, ", "))
+	}
+	if config, err := index.AsEmbeddingIndexConfig(); err == nil && config.Dimension > 0 {
+		tableDimension = config.Dimension
+		fmt.Printf("Index '%s' expects %d-dim vectors\n", *indexName, tableDimension)
+	}
+
+	for _, m := range extraModels {
+		index, ok := status.Indexes[m.index]
+		if !ok {
+			return fmt.Errorf("table '%s' has no index '%s' for %s (has: %s); -models indexes are only added when the table is created",
+				*tableName, m.index, m.model, strings.Join(names, ", "))
+		}
+		if config, err := index.AsEmbeddingIndexConfig(); err == nil && config.Dimension > 0 {
+			if m.dim > 0 && m.dim != config.Dimension {
+				return fmt.Errorf("index '%s' of '%s' is %d-dim but -models gives %s as %d", m.index, *tableName, config.Dimension, m.model, m.dim)
+			}
+			m.dim = config.Dimension
+			fmt.Printf("Index '%s' (%s) expects %d-dim vectors\n", m.index, m.model, m.dim)
+		}
+	}
+	return nil
+}
+
+// lockInfo identifies the run holding the table-setup lock
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// tableLock is an advisory lock file held while creating -table, so two
+// runs launched together don't both create it and race on its shards
+type tableLock struct {
+	path string
+}
+
+// lockFilePath is -lock-file, or a per-table file in the temp dir
+func lockFilePath() string {
+	if *lockFile != "" {
+		return *lockFile
+	}
+	return filepath.Join(os.TempDir(), "gif-picker-"+*tableName+".lock")
+}
+
+// acquireTableLock creates the lock file, refusing if another live run
+// holds it. A lock left by a dead process on this host is taken over;
+// -force takes over any lock (e.g., one on a shared disk from another host).
+func acquireTableLock() (*tableLock, error) {
+	path := lockFilePath()
+	host, _ := os.Hostname()
+	info, err := json.Marshal(lockInfo{PID: os.Getpid(), Host: host, Started: time.Now().UTC()})
+	if err != nil {
+		return nil, fmt.Errorf("encode lock: %w", err)
+	}
+	for range 2 {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, err = f.Write(info)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("write lock %s: %w", path, err)
+			}
+			return &tableLock{path: path}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("create lock %s: %w", path, err)
+		}
+
+		holder, stale := readLock(path, host)
+		if !stale && !*force {
+			return nil, fmt.Errorf("another run is setting up '%s' (%s holds %s); wait for it, or pass -force if that run is gone", *tableName, holder, path)
+		}
+		log.Printf("Warning: taking over lock %s from %s", path, holder)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("remove stale lock: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("lock %s was recreated by another run", path)
+}
+
+// readLock describes a lock's holder and whether it's stale: held by a
+// process on this host that no longer exists. Locks from other hosts (or
+// being written right now) can't be judged, so they're never stale.
+func readLock(path, host string) (string, bool) {
+	data, err := os.ReadFile(path)
+	var info lockInfo
+	if err != nil || json.Unmarshal(data, &info) != nil {
+		return "an unknown run", false
+	}
+	holder := fmt.Sprintf("pid %d on %s since %s", info.PID, info.Host, info.Started.Format(time.RFC3339))
+	return holder, info.Host == host && !processAlive(info.PID)
+}
+
+// processAlive probes pid with signal 0; EPERM means it exists but isn't ours
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Release removes the lock file
+func (l *tableLock) Release() {
+	if err := os.Remove(l.path); err != nil {
+		log.Printf("Warning: release lock %s: %v", l.path, err)
+	}
+}
+
+func waitForShards(ctx context.Context, client *antfly.AntflyClient, timeout time.Duration) error {
+	fmt.Println("Waiting for shards to be ready...")
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	pollCount := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			pollCount++
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timeout waiting for shards")
+			}
+
+			status, err := client.GetTable(ctx, *tableName)
+			if err != nil {
+				continue
+			}
+
+			if len(status.Shards) > 0 && pollCount >= 6 {
+				fmt.Printf("Shards ready after %d polls\n", pollCount)
+				return nil
+			}
+		}
+	}
+}
+
+// importGIFs embeds each TSV row and inserts it into Antfly. With a non-nil
+// embedOut, docs are written there instead (the embed subcommand).
+func importGIFs(ctx context.Context, client *antfly.AntflyClient, embedOut *json.Encoder) (summary *importSummary, err error) {
+	// A signal stops reading new rows and aborts in-flight downloads and
+	// embeds at once (embedCtx); inserts run on a context that isn't
+	// canceled, so the last batch and checkpoint land
+	embedCtx := ctx
+	ctx = context.WithoutCancel(ctx)
+
+	file, err := os.Open(*tsvPath)
+	if err != nil {
+		return nil, startupError{fmt.Errorf("open tsv: %w", err)}
+	}
+	defer file.Close()
+
+	// The wall-clock budget covers warmup too; cron only cares about the total
+	var deadline time.Time
+	if *maxRuntime > 0 {
+		deadline = time.Now().Add(*maxRuntime)
+	}
+
+	resumeFrom := 0
+	if *checkpointFile != "" {
+		if resumeFrom, err = loadCheckpoint(*checkpointFile); err != nil {
+			return nil, startupError{err}
+		}
+		if resumeFrom > 0 {
+			fmt.Printf("Resuming after row %d from %s\n", resumeFrom, *checkpointFile)
+		}
+	}
+
+	// Load the model before the rate timer starts
+	if err := warmupTermite(ctx); err != nil {
+		return nil, startupError{err}
+	}
+
+	var seen *hashIndex
+	if *dedupImages {
+		if seen, err = loadHashIndex(*dedupFile); err != nil {
+			return nil, startupError{err}
+		}
+		defer seen.Close()
+		fmt.Printf("Image dedup: %d known hashes from %s\n", seen.Len(), *dedupFile)
+	}
+
+	rows, err := newRowReader(file)
+	if err != nil {
+		return nil, startupError{err}
+	}
+
+	fixURL := newURLTransformer(*urlTransformCmd)
+	existence := newExistenceChecker(client)
+	canonicalSeen := &variantSet{ids: make(map[string]bool)}
+	gate := newRowGate(fixURL, canonicalSeen)
+
+	var emptyLog *os.File
+	if *logEmpty != "" {
+		if emptyLog, err = os.OpenFile(*logEmpty, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err != nil {
+			return nil, startupError{fmt.Errorf("open empty-embeddings log: %w", err)}
+		}
+		defer emptyLog.Close()
+	}
+
+	var local *localIndexWriter
+	if *localIndex != "" {
+		if local, err = openLocalIndex(*localIndex); err != nil {
+			return nil, startupError{err}
+		}
+		defer local.Close()
+	}
+	// Per-shard inserts need the table's key ranges; without them, insert whole batches
+	var shards *shardRouter
+	if *shardParallel && embedOut == nil {
+		if shards, err = newShardRouter(ctx, client); err != nil {
+			log.Printf("Warning: no shard routing (%v), inserting whole batches", err)
+		} else {
+			fmt.Printf("Inserting across %d shards in parallel\n", len(shards.ranges))
+		}
+	}
+
+	batch := newDocBatch()
+	imported := 0
+	skipped := 0
+	embedFailed := 0
+	fetchFailed := 0
+	emptyEmbeds := 0
+	duplicates := 0
+	invalidURLs := 0
+	longURLs := 0
+	existing := 0                   // -skip-existing: already embedded with this model
+	reembedded := 0                 // -skip-existing: stored under another model
+	var mergedVariants atomic.Int64 // -canonical-ids: URL variants of an earlier row's GIF
+	static := 0
+	blocked := 0
+	blockedTerms := 0
+	upgraded := 0
+	keptHTTP := 0
+	insertFailed := 0
+	rowNo := 0
+	timedOut := false
+	interrupted := false
+	startTime := time.Now()
+	sizer := newBatchSizer()
+	latencies := newLatencyHistogram()
+	var stats *vectorStatsTracker
+	if *vectorStats {
+		stats = &vectorStatsTracker{}
+	}
+
+	// snapshot reports the counters so far; a failed run still gets one
+	snapshot := func(outcome string) *importSummary {
+		elapsed := time.Since(startTime).Seconds()
+		return &importSummary{
+			Outcome:     outcome,
+			Imported:    imported,
+			Skipped:     skipped,
+			Blocked:     blocked,
+			BlockTerms:  blockedTerms,
+			Duplicates:  duplicates,
+			InvalidURLs: invalidURLs,
+			LongURLs:    longURLs,
+			Existing:    existing,
+			Merged:      int(mergedVariants.Load()),
+			Failed: map[string]int{
+				"fetch":  fetchFailed,
+				"embed":  embedFailed,
+				"empty":  emptyEmbeds,
+				"insert": insertFailed,
+			},
+			DurationSec: elapsed,
+			Rate:        float64(imported) / elapsed,
+			LastRow:     rowNo,
+		}
+	}
+	defer func() {
+		if err != nil {
+			summary = snapshot("failed")
+		}
+	}()
+
+	// Progress prints on its own clock so display frequency doesn't track batch size
+	lastProgress := time.Now()
+	printProgress := func() {
+		elapsed := time.Since(startTime).Seconds()
+		rate := float64(imported) / elapsed
+		progressf("Imported: %d (%.1f/sec, %d embed failures)", imported, rate, embedFailed)
+		lastProgress = time.Now()
+	}
+
+	// Rows waiting for an embed request; -embed-batch sends them together
+	var pending []pendingRow
+	doneRow := 0 // last row whose doc has been written or batched
+	limitReached := false
+	failureStop := false
+	aborted := false // an embed was cut short by a signal
+
+	// Failures are counted from both the reader and the flusher goroutine
+	var failures atomic.Int64
+	tooManyFailures := func() bool {
+		return *maxFailures > 0 && failures.Load() > int64(*maxFailures)
+	}
+
+	// emit stores one embedded row: dedup record, local index, then the
+	// embeddings file or an Antfly batch. It reports true once -limit is hit.
+	emit := func(p pendingRow, res embedResult) (bool, error) {
+		embedding := res.Embedding
+		// An earlier variant of this GIF beat it here; first stored wins
+		if p.canonical && !canonicalSeen.Claim(p.docID) {
+			mergedVariants.Add(1)
+			doneRow = p.rowNo
+			return false, nil
+		}
+		// Only remember GIFs that made it into the table
+		if p.hashed {
+			if err := seen.Add(p.imageHash, p.docID); err != nil {
+				return false, fmt.Errorf("record hash: %w", err)
+			}
+		}
+
+		if stats != nil {
+			stats.Add(embedding)
+			if stats.window == *batchSize {
+				stats.Report()
+			}
+		}
+
+		doc := buildDoc(p.gifURL, p.description, embedding)
+		if res.Last != nil {
+			doc["_embeddings"].(map[string]any)[lastFrameIndex()] = res.Last
+		}
+		for index, vec := range res.Extra {
+			doc["_embeddings"].(map[string]any)[index] = vec
+		}
+		if *storeFrameCount && p.frames > 0 {
+			doc["frame_count"] = p.frames
+		}
+		if len(p.palette) > 0 {
+			doc["palette"] = p.palette
+		}
+		if p.hasMotion {
+			doc["motion_score"] = p.motion
+		}
+		if *storeEmbedMs {
+			doc["embed_ms"] = res.Elapsed.Milliseconds()
+		}
+		if seq := rowSeq(p.rowNo); seq != nil {
+			doc["seq"] = *seq
+		}
+
+		if local != nil {
+			if err := local.Add(p.docID, p.gifURL, p.description, embedding); err != nil {
+				return false, fmt.Errorf("write local index: %w", err)
+			}
+		}
+		doneRow = p.rowNo
+
+		if embedOut != nil {
+			if err := embedOut.Encode(embeddedDoc{ID: p.docID, Doc: doc}); err != nil {
+				return false, fmt.Errorf("write embeddings file: %w", err)
+			}
+			imported++
+			if *limit > 0 && imported >= *limit {
+				fmt.Printf("\nReached limit of %d\n", *limit)
+				limitReached = true
+				return true, nil
+			}
+			return false, nil
+		}
+		batch.Add(p.docID, doc)
+
+		// Flush batch
+		if batch.Len() >= sizer.size {
+			attempts, failed, err := insertBatch(ctx, client, shards, batch)
+			if err != nil {
+				log.Printf("Warning: batch insert failed (%s): %v", failed.Span(), err)
+				writeDeadLetters(failed, err)
+			}
+			sizer.record(err == nil && attempts == 1)
+			insertFailed += failed.Len()
+			failures.Add(int64(failed.Len()))
+			imported += batch.Len() - failed.Len()
+			batch = newDocBatch()
+
+			// Everything up to this row is in Antfly now
+			if *checkpointFile != "" {
+				if err := saveCheckpoint(*checkpointFile, doneRow); err != nil {
+					return false, err
+				}
+			}
+
+			if *progressInterval == 0 {
+				printProgress()
+			}
+
+			// Check limit
+			if *limit > 0 && imported+insertFailed >= *limit {
+				fmt.Printf("\nReached limit of %d\n", *limit)
+				limitReached = true
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// handleEmbedded emits one embed batch's rows in input order
+	handleEmbedded := func(embedded []pendingRow, results []embedResult) (bool, error) {
+		if *progressInterval > 0 && time.Since(lastProgress) >= *progressInterval {
+			printProgress()
+		}
+		for i, res := range results {
+			p := embedded[i]
+			if res.Err != nil && embedCtx.Err() != nil {
+				// Not the row's fault; leave it and the rest for the next run
+				aborted = true
+				return true, nil
+			}
+			var missing *modelMissingError
+			if errors.As(res.Err, &missing) {
+				return true, missing
+			}
+			latencies.Add(res.Elapsed)
+			switch {
+			case errors.Is(res.Err, errEmptyEmbedding):
+				// Termite answered fine; the image itself is the problem
+				log.Printf("Warning: Termite returned no embedding for %s (unsupported image?)", logURL(p.gifURL, p.docID))
+				emptyEmbeds++
+				failures.Add(1)
+				if emptyLog != nil {
+					fmt.Fprintf(emptyLog, "%s\t%s\n", p.gifURL, p.docID)
+				}
+				appendDeadLetters(deadLetterRecord{ID: p.docID, GifURL: p.gifURL, Description: p.description, Stage: "empty", Error: res.Err.Error(), Seq: rowSeq(p.rowNo)})
+			case res.Err != nil:
+				log.Printf("Warning: failed to embed %s: %s", logURL(p.gifURL, p.docID), redactErr(res.Err, p.gifURL, p.docID))
+				embedFailed++
+				failures.Add(1)
+				appendDeadLetters(deadLetterRecord{ID: p.docID, GifURL: p.gifURL, Description: p.description, Stage: "embed", Error: res.Err.Error(), Seq: rowSeq(p.rowNo)})
+			default:
+				if stop, err := emit(p, res); stop || err != nil {
+					return stop, err
+				}
+			}
+			if tooManyFailures() {
+				failureStop = true
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// With -embed-workers the reader hands embed batches to a worker pool and
+	// a single flusher goroutine emits them, so Termite and Antfly calls
+	// overlap. The flusher restores input order, keeping batches and the
+	// checkpoint identical to an inline run. Counters touched by emit belong
+	// to the flusher until it finishes.
+	type embedJob struct {
+		seq     int
+		rows    []pendingRow
+		results []embedResult
+	}
+	var jobs, embedded chan embedJob
+	var workers sync.WaitGroup
+	stopped := make(chan struct{}) // closed by the flusher at -limit or on error
+	flusherDone := make(chan error, 1)
+	nextSeq := 0
+	if *embedWorkers > 0 {
+		jobs = make(chan embedJob, *pipelineBuffer)
+		embedded = make(chan embedJob, *pipelineBuffer)
+		for range *embedWorkers {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for job := range jobs {
+					job.results = embedRows(embedCtx, job.rows)
+					embedded <- job
+				}
+			}()
+		}
+		go func() {
+			waiting := make(map[int]embedJob)
+			next := 0
+			var flushErr error
+			done := false
+			for job := range embedded {
+				if done {
+					continue // drain so workers can exit
+				}
+				waiting[job.seq] = job
+				for !done {
+					ready, ok := waiting[next]
+					if !ok {
+						break
+					}
+					delete(waiting, next)
+					next++
+					stop, err := handleEmbedded(ready.rows, ready.results)
+					if stop || err != nil {
+						flushErr = err
+						done = true
+						close(stopped)
+					}
+				}
+			}
+			flusherDone <- flushErr
+		}()
+	}
+
+	// embedPending embeds the waiting rows in one Termite request and emits
+	// them, or queues them for the workers
+	embedPending := func() (bool, error) {
+		rowsToEmbed := pending
+		pending = nil
+		if jobs == nil {
+			return handleEmbedded(rowsToEmbed, embedRows(embedCtx, rowsToEmbed))
+		}
+		select {
+		case jobs <- embedJob{seq: nextSeq, rows: rowsToEmbed}:
+			nextSeq++
+			return false, nil
+		case <-stopped:
+			return true, nil
+		}
+	}
+
+	fmt.Println("Starting import with direct CLIP image embeddings...")
+	fmt.Printf("Termite URL: %s, Model: %s\n", *termiteURL, *clipModel)
+	if *fetchLocally {
+		fmt.Println("Fetching GIFs locally and sending bytes to Termite")
+	}
+
+	for {
+		fields, ok := rows.Next()
+		if !ok {
+			break
+		}
+		rowNo++
+		if rowNo <= max(resumeFrom, *lineStart) {
+			continue
+		}
+		if *lineCount > 0 && rowNo > *lineStart+*lineCount {
+			rowNo-- // past this machine's window
+			break
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			rowNo-- // this row wasn't processed; the next run starts here
+			timedOut = true
+			fmt.Printf("\nReached max runtime of %s\n", *maxRuntime)
+			break
+		}
+		if embedCtx.Err() != nil {
+			rowNo--
+			interrupted = true
+			fmt.Println("\nInterrupted, storing embedded GIFs (Ctrl-C again to abort)")
+			break
+		}
+		if tooManyFailures() {
+			rowNo--
+			break
+		}
+
+		row, skip := gate.Check(rowNo, fields)
+		switch skip {
+		case rowShort, rowBadURL:
+			skipped++
+		case rowLongURL:
+			longURLs++
+		case rowInvalidURL:
+			invalidURLs++
+		case rowHostBlocked:
+			blocked++
+		case rowTermBlocked:
+			blockedTerms++
+		case rowMerged:
+			mergedVariants.Add(1)
+		}
+		if skip != rowKept {
+			continue
+		}
+		gifURL, description, docID, canonical := row.gifURL, row.description, row.docID, row.canonical
+		var err error
+
+		if *skipExisting {
+			model, found, err := existence.lookup(ctx, docID, func() []string {
+				return upcomingDocIDs(rows.Peek(prefetchRows), fixURL)
+			})
+			switch {
+			case err != nil:
+				log.Printf("Warning: can't check %s for -skip-existing, embedding it: %v", docID, err)
+			case found && model == embedModelName():
+				existing++
+				continue
+			case found:
+				reembedded++
+			}
+		}
+
+		// Upgrade after the ID is fixed, so -force-https doesn't change docIDs
+		if *forceHTTPS && strings.HasPrefix(gifURL, "http://") {
+			if secure, ok := httpsVariant(ctx, gifURL); ok {
+				gifURL = secure
+				upgraded++
+			} else {
+				keptHTTP++
+			}
+		}
+
+		// Download once when anything needs the bytes locally
+		var imageData []byte
+		var contentType string
+		countFrames := *storeFrameCount || *minFrames > 0
+		firstLast := *frameMode == "first-last"
+		if *fetchLocally || *dedupImages || countFrames || firstLast || *extractPalette || *extractMotion {
+			imageData, contentType, err = downloadImage(embedCtx, gifURL)
+			if err != nil && embedCtx.Err() != nil {
+				rowNo--
+				interrupted = true
+				fmt.Println("\nInterrupted, storing embedded GIFs (Ctrl-C again to abort)")
+				break
+			}
+			if err != nil {
+				log.Printf("Warning: failed to fetch %s: %s", logURL(gifURL, docID), redactErr(err, gifURL, docID))
+				fetchFailed++
+				failures.Add(1)
+				appendDeadLetters(deadLetterRecord{ID: docID, GifURL: gifURL, Description: description, Stage: "fetch", Error: err.Error(), Seq: rowSeq(rowNo)})
+				continue
+			}
+		}
+
+		// An undecodable GIF is still embedded, just without a frame count
+		frames := 0
+		if countFrames {
+			if frames, err = frameCount(imageData); err != nil {
+				log.Printf("Warning: can't count frames of %s: %v", logURL(gifURL, docID), err)
+			} else if frames < *minFrames {
+				static++
+				continue
+			}
+		}
+
+		var palette []string
+		if *extractPalette {
+			if palette, err = dominantColors(imageData, paletteSize); err != nil {
+				log.Printf("Warning: can't extract palette of %s: %v", logURL(gifURL, docID), err)
+			}
+		}
+		var motion float64
+		hasMotion := false
+		if *extractMotion {
+			if motion, err = motionScore(imageData); err != nil {
+				log.Printf("Warning: can't score motion of %s: %v", logURL(gifURL, docID), err)
+			} else {
+				hasMotion = true
+			}
+		}
+
+		// A match on our own docID is just a rerun of this row, not a duplicate
+		var imageHash uint64
+		hashed := false
+		if seen != nil {
+			imageHash, err = dHash(imageData)
+			if err != nil {
+				log.Printf("Warning: can't hash %s, not deduplicating it: %v", logURL(gifURL, docID), err)
+			} else if dup, ok := seen.Near(imageHash, *dedupDistance); ok && dup != docID {
+				duplicates++
+				continue
+			} else {
+				hashed = true
+			}
+		}
+
+		image, lastImage := gifURL, ""
+		if firstLast {
+			// Always inline: Termite can't pick frames out of a URL
+			if first, last, frameType, err := firstLastFrames(imageData, *preprocessMaxDim); err != nil {
+				log.Printf("Warning: can't extract frames of %s, embedding it whole twice: %v", logURL(gifURL, docID), err)
+				image = dataURI(contentType, imageData)
+				lastImage = image
+			} else {
+				image, lastImage = dataURI(frameType, first), dataURI(frameType, last)
+			}
+		} else if *fetchLocally {
+			image = dataURI(contentType, imageData)
+			if *preprocessMaxDim > 0 || *centerCrop {
+				if frame, frameType, err := firstFrame(imageData, *preprocessMaxDim); err != nil {
+					log.Printf("Warning: can't preprocess %s, sending it whole: %v", logURL(gifURL, docID), err)
+				} else {
+					image = dataURI(frameType, frame)
+				}
+			}
+		}
+		pending = append(pending, pendingRow{
+			rowNo:       rowNo,
+			docID:       docID,
+			gifURL:      gifURL,
+			description: description,
+			image:       image,
+			lastImage:   lastImage,
+			imageHash:   imageHash,
+			hashed:      hashed,
+			frames:      frames,
+			palette:     palette,
+			motion:      motion,
+			hasMotion:   hasMotion,
+			canonical:   canonical,
+		})
+		if len(pending) >= max(*embedBatch, 1) {
+			if stop, err := embedPending(); err != nil {
+				return nil, err
+			} else if stop {
+				break
+			}
+		}
+	}
+
+	// Rows left over from a partial embed batch
+	if len(pending) > 0 {
+		if _, err := embedPending(); err != nil {
+			return nil, err
+		}
+	}
+	if jobs != nil {
+		close(jobs)
+		workers.Wait()
+		close(embedded)
+		if err := <-flusherDone; err != nil {
+			return nil, err
+		}
+	}
+
+	// Final batch
+	if batch.Len() > 0 {
+		_, failed, err := insertBatch(ctx, client, shards, batch)
+		if err != nil {
+			log.Printf("Warning: final batch insert failed (%s): %v", failed.Span(), err)
+			writeDeadLetters(failed, err)
+		}
+		insertFailed += failed.Len()
+		failures.Add(int64(failed.Len()))
+		imported += batch.Len() - failed.Len()
+	}
+	printProgress()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Stopping in the flusher can leave read rows unemitted; resume from the last one stored
+	if aborted {
+		interrupted = true
+	}
+	if limitReached || failureStop || aborted {
+		rowNo = doneRow
+	}
+	if *checkpointFile != "" {
+		if err := saveCheckpoint(*checkpointFile, rowNo); err != nil {
+			return nil, err
+		}
+	}
+
+	elapsed := time.Since(startTime).Seconds()
+	fmt.Printf("\nCompleted: %d GIFs in %.1fs (%.1f/sec), %d skipped, %d embed failures, %d empty embeddings, %d insert failures\n",
+		imported, elapsed, float64(imported)/elapsed, skipped, embedFailed+fetchFailed, emptyEmbeds, insertFailed)
+	if seen != nil {
+		fmt.Printf("Collapsed %d near-duplicate GIFs\n", duplicates)
+	}
+	if invalidURLs > 0 {
+		fmt.Printf("Skipped %d rows with invalid URLs\n", invalidURLs)
+	}
+	if longURLs > 0 {
+		fmt.Printf("Skipped %d rows with URLs over %d bytes\n", longURLs, *maxURLLen)
+	}
+	if *canonicalIDs {
+		fmt.Printf("Merged %d URL variants into their canonical GIF\n", mergedVariants.Load())
+	}
+	if *skipExisting {
+		fmt.Printf("Skipped %d docs already embedded with %s, re-embedded %d from other models\n", existing, embedModelName(), reembedded)
+	}
+	if *minFrames > 0 {
+		fmt.Printf("Skipped %d GIFs with fewer than %d frames\n", static, *minFrames)
+	}
+	if len(gate.allowList) > 0 || len(gate.denyList) > 0 {
+		fmt.Printf("Blocked %d GIFs by -allow-hosts/-deny-hosts\n", blocked)
+	}
+	if blocklist != nil {
+		fmt.Printf("Blocked %d GIFs by -blocklist terms\n", blockedTerms)
+	}
+	if *forceHTTPS {
+		fmt.Printf("HTTPS: upgraded %d URLs, kept http for %d unreachable over https\n", upgraded, keptHTTP)
+	}
+	latencies.Print()
+	termites.Report()
+	if embeddingCache != nil {
+		fmt.Printf("Embed cache (%s): %d hits, %d misses\n", *cacheBackend, cacheHits.Load(), cacheMisses.Load())
+	}
+	if stats != nil {
+		stats.Summary()
+	}
+	if *checkpointFile != "" {
+		fmt.Printf("Checkpoint: row %d in %s\n", rowNo, *checkpointFile)
+	}
+	if timedOut {
+		fmt.Println("Stopped early; rerun with the same -checkpoint to continue")
+	}
+
+	summary = snapshot("completed")
+	switch {
+	case tooManyFailures():
+		summary.Outcome = "max-failures"
+		fmt.Printf("Stopped after %d failures (-max-failures %d)\n", failures.Load(), *maxFailures)
+	case interrupted:
+		summary.Outcome = "interrupted"
+	case limitReached:
+		summary.Outcome = "limit"
+	case timedOut:
+		summary.Outcome = "max-runtime"
+	}
+	if *logJSON {
+		data, err := json.Marshal(summary)
+		if err != nil {
+			return nil, fmt.Errorf("marshal summary: %w", err)
+		}
+		fmt.Println(string(data))
+	}
+
+	return summary, nil
+}
+
+// pendingImages lists what Termite should embed for each row
+func pendingImages(rows []pendingRow) []string {
+	images := make([]string, len(rows))
+	for i, p := range rows {
+		images[i] = p.image
+	}
+	return images
+}
+
+// pendingRow is a row that passed fetching and dedup and awaits embedding
+type pendingRow struct {
+	rowNo       int
+	docID       string
+	gifURL      string
+	description string
+	image       string // URL or data: URI sent to Termite
+	lastImage   string // last frame's data: URI, with -frames first-last
+	imageHash   uint64
+	hashed      bool
+	frames      int      // 0 when not counted or undecodable
+	palette     []string // dominant colors, with -extract-palette
+	motion      float64  // motion score, with -extract-motion
+	hasMotion   bool
+	canonical   bool // -canonical-ids: one of possibly several URL variants
+}
+
+// variantSet holds the -canonical-ids docIDs already stored this run
+type variantSet struct {
+	mu  sync.Mutex // the -embed-workers reader and flusher share it
+	ids map[string]bool
+}
+
+func (v *variantSet) Has(docID string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.ids[docID]
+}
+
+// Claim marks docID stored, reporting false if it already was
+func (v *variantSet) Claim(docID string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.ids[docID] {
+		return false
+	}
+	v.ids[docID] = true
+	return true
+}
+
+// localIndexWriter appends records to a flat vector file. Each record is
+// self-delimiting, so resumed runs can keep appending to the same file:
+//
+//	uint16 len + docID, uint16 len + gif_url, uint32 len + description,
+//	uint32 dimension + dimension float32s (all little-endian)
+type localIndexWriter struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func openLocalIndex(path string) (*localIndexWriter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open local index: %w", err)
+	}
+	return &localIndexWriter{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (l *localIndexWriter) Add(docID, gifURL, description string, embedding []float32) error {
+	if len(docID) > math.MaxUint16 || len(gifURL) > math.MaxUint16 {
+		return fmt.Errorf("%s: id or url too long for local index", docID)
+	}
+	binary.Write(l.w, binary.LittleEndian, uint16(len(docID)))
+	l.w.WriteString(docID)
+	binary.Write(l.w, binary.LittleEndian, uint16(len(gifURL)))
+	l.w.WriteString(gifURL)
+	binary.Write(l.w, binary.LittleEndian, uint32(len(description)))
+	l.w.WriteString(description)
+	binary.Write(l.w, binary.LittleEndian, uint32(len(embedding)))
+	return binary.Write(l.w, binary.LittleEndian, embedding)
+}
+
+func (l *localIndexWriter) Close() error {
+	if err := l.w.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// localEntry is one GIF loaded from a -local-index file
+type localEntry struct {
+	ID          string
+	GifURL      string
+	Description string
+	Vector      []float32
+}
+
+// readLocalIndex loads a whole -local-index file into memory
+func readLocalIndex(path string) ([]localEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open local index: %w", err)
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	readString := func(n int) (string, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return string(buf), err
+	}
+
+	var entries []localEntry
+	for {
+		var idLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &idLen); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read record %d: %w", len(entries), err)
+		}
+
+		var e localEntry
+		var urlLen uint16
+		var descLen, dim uint32
+		var err error
+		if e.ID, err = readString(int(idLen)); err == nil {
+			if err = binary.Read(r, binary.LittleEndian, &urlLen); err == nil {
+				e.GifURL, err = readString(int(urlLen))
+			}
+		}
+		if err == nil {
+			if err = binary.Read(r, binary.LittleEndian, &descLen); err == nil {
+				e.Description, err = readString(int(descLen))
+			}
+		}
+		if err == nil {
+			if err = binary.Read(r, binary.LittleEndian, &dim); err == nil {
+				e.Vector = make([]float32, dim)
+				err = binary.Read(r, binary.LittleEndian, e.Vector)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read record %d (truncated file?): %w", len(entries), err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// localSearch embeds -q with the CLIP text tower and ranks every GIF in
+// -local-index by cosine similarity. Brute force is fine for tens of
+// thousands of vectors.
+func localSearch(ctx context.Context) error {
+	if *localIndex == "" || *queryText == "" {
+		return fmt.Errorf("local-search needs -local-index and -q")
+	}
+	entries, err := readLocalIndex(*localIndex)
+	if err != nil {
+		return err
+	}
+	queryVec, err := embedText(ctx, *queryText)
+	if err != nil {
+		return fmt.Errorf("embed query: %w", err)
+	}
+	if *fuseTextModel != "" {
+		// Match a fused index: CLIP text half against images, text model half against descriptions
+		fused := []embedResult{{Embedding: queryVec}}
+		fuseText(ctx, []string{*queryText}, fused)
+		if fused[0].Err != nil {
+			return fmt.Errorf("embed query: %w", fused[0].Err)
+		}
+		queryVec = fused[0].Embedding
+	}
+
+	type scored struct {
+		entry *localEntry
+		score float64
+	}
+	results := make([]scored, 0, len(entries))
+	for i := range entries {
+		if len(entries[i].Vector) != len(queryVec) {
+			continue
+		}
+		results = append(results, scored{&entries[i], cosine(queryVec, entries[i].Vector)})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].score > results[j].score })
+	results = results[:min(*topK, len(results))]
+
+	fmt.Printf("Searched %d GIFs in %s\n", len(entries), *localIndex)
+	for i, r := range results {
+		fmt.Printf("%2d. %.4f %s\n    %s\n", i+1, r.score, r.entry.GifURL, r.entry.Description)
+	}
+	return nil
+}
+
+// pickGIFs embeds the query with CLIP's text tower, finds the nearest GIFs
+// in -table's image index and prints just their URLs, one per line, so the
+// output can go straight to the clipboard. Everything else goes to stderr.
+func pickGIFs(ctx context.Context, client *antfly.AntflyClient) error {
+	text := *queryText
+	if text == "" {
+		text = strings.Join(flag.Args(), " ")
+	}
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("pick needs a query, e.g. pick \"happy dance\"")
+	}
+	n := max(*pickCount, 1)
+
+	queryVec, err := embedText(ctx, text)
+	if err != nil {
+		return fmt.Errorf("embed query: %w", err)
+	}
+	if *fuseTextModel != "" {
+		fused := []embedResult{{Embedding: queryVec}}
+		fuseText(ctx, []string{text}, fused)
+		if fused[0].Err != nil {
+			return fmt.Errorf("embed query: %w", fused[0].Err)
+		}
+		queryVec = fused[0].Embedding
+	}
+
+	// Over-fetch when -blocklist may drop some
+	limit := n
+	if blocklist != nil {
+		limit = n * 5
+	}
+	resp, err := client.Query(ctx, antfly.QueryRequest{
+		Table:          *tableName,
+		Indexes:        []string{*indexName},
+		SemanticSearch: text, // the SDK wants text with indexes; the vector wins
+		Embeddings:     map[string][]float32{*indexName: queryVec},
+		Fields:         []string{"gif_url", "description"},
+		Limit:          limit,
+	})
+	if err != nil {
+		return fmt.Errorf("query: %w", err)
+	}
+	if len(resp.Responses) == 0 {
+		return fmt.Errorf("no response from '%s'", *tableName)
+	}
+	if r := resp.Responses[0]; r.Error != "" {
+		return fmt.Errorf("query: %s", r.Error)
+	}
+
+	picked := 0
+	for _, hit := range resp.Responses[0].Hits.Hits {
+		gifURL := stringField(hit.Source, "gif_url")
+		if gifURL == "" || blocklist.Match(stringField(hit.Source, "description")) {
+			continue
+		}
+		fmt.Println(gifURL)
+		if picked++; picked == n {
+			break
+		}
+	}
+	if picked == 0 {
+		return fmt.Errorf("no GIFs in '%s' for %q", *tableName, text)
+	}
+	return nil
+}
+
+// embedText embeds a text query with -clip-model, landing in the same
+// space as the image vectors
+func embedText(ctx context.Context, text string) ([]float32, error) {
+	embeddings, err := embedTexts(ctx, *clipModel, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// embedTexts embeds several texts with model in one Termite request
+func embedTexts(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	jsonBody, err := json.Marshal(map[string]any{
+		"model": model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	body, err := termites.embed(ctx, jsonBody)
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := deserializeEmbeddings(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("termite returned %d vectors for %d texts", len(embeddings), len(texts))
+	}
+	return embeddings, nil
+}
+
+// cosine returns the cosine similarity of two equal-length vectors
+func cosine(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// rowReader yields the input's rows as fields. TSV is a plain line split
+// (the last mapped column keeps any further tabs, as descriptions may
+// contain them); CSV goes through encoding/csv for quoted fields that
+// contain delimiters, quotes or newlines.
+type rowReader struct {
+	scanner *bufio.Scanner
+	csv     *csv.Reader
+	err     error
+	ahead   [][]string // rows read by Peek, returned by Next first
+	done    bool       // input exhausted (or failed) during a Peek
+}
+
+func newRowReader(r io.Reader) (*rowReader, error) {
+	switch *inputFormat {
+	case "tsv":
+		return &rowReader{scanner: bufio.NewScanner(r)}, nil
+	case "csv":
+		delim := *delimiter
+		if delim == `\t` {
+			delim = "\t"
+		}
+		runes := []rune(delim)
+		if len(runes) != 1 {
+			return nil, fmt.Errorf("-delimiter must be a single character, got %q", *delimiter)
+		}
+		cr := csv.NewReader(r)
+		cr.Comma = runes[0]
+		cr.FieldsPerRecord = -1 // short rows are counted as skipped, not fatal
+		return &rowReader{csv: cr}, nil
+	default:
+		return nil, fmt.Errorf("unknown -input-format %q (want tsv or csv)", *inputFormat)
+	}
+}
+
+// Next returns the next row's fields. A malformed CSV row comes back as nil
+// fields so the caller skips it; ok is false at the end of input or on a
+// read error (see Err).
+func (r *rowReader) Next() ([]string, bool) {
+	if len(r.ahead) > 0 {
+		fields := r.ahead[0]
+		r.ahead = r.ahead[1:]
+		return fields, true
+	}
+	if r.done {
+		return nil, false
+	}
+	return r.read()
+}
+
+// Peek returns up to n upcoming rows without consuming them
+func (r *rowReader) Peek(n int) [][]string {
+	for len(r.ahead) < n && !r.done {
+		fields, ok := r.read()
+		if !ok {
+			r.done = true
+			break
+		}
+		r.ahead = append(r.ahead, fields)
+	}
+	return r.ahead[:min(n, len(r.ahead))]
+}
+
+func (r *rowReader) read() ([]string, bool) {
+	if r.scanner != nil {
+		if !r.scanner.Scan() {
+			r.err = r.scanner.Err()
+			return nil, false
+		}
+		return cleanFields(strings.SplitN(r.scanner.Text(), "\t", max(*urlCol, *descCol)+1)), true
+	}
+
+	record, err := r.csv.Read()
+	if err == io.EOF {
+		return nil, false
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		log.Printf("Warning: malformed CSV row at line %d: %v", parseErr.StartLine, parseErr.Err)
+		return nil, true
+	}
+	if err != nil {
+		r.err = err
+		return nil, false
+	}
+	return cleanFields(record), true
+}
+
+// cleanFields applies -trim-fields and -unquote to a row in place
+func cleanFields(fields []string) []string {
+	if !*trimFields && !*unquote {
+		return fields
+	}
+	for i, f := range fields {
+		fields[i] = cleanField(f)
+	}
+	return fields
+}
+
+// cleanField trims padding around and inside the quotes, so
+// ` "a ""b"" c " ` becomes `a "b" c` with both options set
+func cleanField(f string) string {
+	if *trimFields {
+		f = strings.TrimSpace(f)
+	}
+	if len(f) < 2 {
+		return f
+	}
+	switch first, last := f[0], f[len(f)-1]; {
+	case *unquote && first == '"' && last == '"':
+		f = strings.ReplaceAll(f[1:len(f)-1], `""`, `"`)
+	case *trimFields && first == last && (first == '"' || first == '\''):
+		f = f[1 : len(f)-1]
+	default:
+		return f
+	}
+	if *trimFields {
+		f = strings.TrimSpace(f)
+	}
+	return f
+}
+
+func (r *rowReader) Err() error {
+	return r.err
+}
+
+// normDriftThreshold is how far (as a fraction) a window's mean norm may
+// stray from the running mean before -vector-stats warns
+const normDriftThreshold = 0.2
+
+// vectorStatsTracker keeps running embedding statistics with Welford's
+// algorithm, plus the mean norm of the current reporting window. A jump in
+// the window norm usually means the model changed or is returning garbage.
+type vectorStatsTracker struct {
+	n          int
+	meanNorm   float64
+	dimMean    []float64
+	dimM2      []float64
+	window     int
+	windowNorm float64
+}
+
+func (v *vectorStatsTracker) Add(vec []float32) {
+	if v.dimMean == nil {
+		v.dimMean = make([]float64, len(vec))
+		v.dimM2 = make([]float64, len(vec))
+	}
+	if len(vec) != len(v.dimMean) {
+		log.Printf("Warning: vector dimension changed from %d to %d", len(v.dimMean), len(vec))
+		return
+	}
+
+	var sq float64
+	for _, x := range vec {
+		sq += float64(x) * float64(x)
+	}
+	norm := math.Sqrt(sq)
+
+	v.n++
+	v.meanNorm += (norm - v.meanNorm) / float64(v.n)
+	for i, x := range vec {
+		delta := float64(x) - v.dimMean[i]
+		v.dimMean[i] += delta / float64(v.n)
+		v.dimM2[i] += delta * (float64(x) - v.dimMean[i])
+	}
+	v.window++
+	v.windowNorm += norm
+}
+
+// averages returns the mean over dimensions of the per-dimension means and variances
+func (v *vectorStatsTracker) averages() (float64, float64) {
+	var mean, variance float64
+	for i := range v.dimMean {
+		mean += v.dimMean[i]
+		if v.n > 1 {
+			variance += v.dimM2[i] / float64(v.n-1)
+		}
+	}
+	dims := float64(len(v.dimMean))
+	return mean / dims, variance / dims
+}
+
+// Report logs the window's stats against the running ones and starts a new window
+func (v *vectorStatsTracker) Report() {
+	if v.window == 0 {
+		return
+	}
+	windowNorm := v.windowNorm / float64(v.window)
+	mean, variance := v.averages()
+	log.Printf("Vector stats: n=%d norm=%.4f (last %d: %.4f) dim mean=%.5f dim var=%.5f",
+		v.n, v.meanNorm, v.window, windowNorm, mean, variance)
+	if v.n > v.window && math.Abs(windowNorm-v.meanNorm) > normDriftThreshold*v.meanNorm {
+		log.Printf("Warning: mean vector norm of the last %d GIFs (%.4f) drifted from the running mean (%.4f)", v.window, windowNorm, v.meanNorm)
+	}
+	v.window = 0
+	v.windowNorm = 0
+}
+
+func (v *vectorStatsTracker) Summary() {
+	if v.n == 0 {
+		return
+	}
+	mean, variance := v.averages()
+	fmt.Printf("Vector stats: %d vectors of dimension %d, mean norm %.4f, dim mean %.5f, dim variance %.5f\n",
+		v.n, len(v.dimMean), v.meanNorm, mean, variance)
+}
+
+// latencyBounds are the upper edges of the embed latency histogram buckets;
+// anything slower lands in a final overflow bucket
+var latencyBounds = []time.Duration{
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyHistogram counts Termite embed calls (including failures) by duration
+type latencyHistogram struct {
+	counts []int
+	total  time.Duration
+	max    time.Duration
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int, len(latencyBounds)+1)}
+}
+
+func (h *latencyHistogram) Add(d time.Duration) {
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d < latencyBounds[i] })
+	h.counts[i]++
+	h.total += d
+	h.max = max(h.max, d)
+}
+
+func (h *latencyHistogram) Print() {
+	n := 0
+	for _, c := range h.counts {
+		n += c
+	}
+	if n == 0 {
+		return
+	}
+	fmt.Printf("Embed latency: mean %s, max %s\n", (h.total / time.Duration(n)).Round(time.Millisecond), h.max.Round(time.Millisecond))
+	for i, c := range h.counts {
+		label := fmt.Sprintf(">= %s", latencyBounds[len(latencyBounds)-1])
+		if i < len(latencyBounds) {
+			label = fmt.Sprintf("< %s", latencyBounds[i])
+		}
+		fmt.Printf("  %-8s %6d %s\n", label, c, strings.Repeat("#", c*40/n))
+	}
+}
+
+// loadCheckpoint returns the number of input rows a previous run finished,
+// or 0 when there is no checkpoint yet
+func loadCheckpoint(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read checkpoint: %w", err)
+	}
+	line, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("parse checkpoint %s: %w", path, err)
+	}
+	return line, nil
+}
+
+// saveCheckpoint writes via a temp file so a kill mid-write can't leave a
+// truncated checkpoint behind
+func saveCheckpoint(path string, line int) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(line)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// firstFrame decodes a GIF's first frame, squares it with -center-crop,
+// shrinks it to fit maxDim (0 keeps it full size), and re-encodes it with
+// -preprocess-format. CLIP only sees one frame anyway, and a small still is
+// far cheaper for Termite than a huge animation.
+func firstFrame(data []byte, maxDim int) ([]byte, string, error) {
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decode gif: %w", err)
+	}
+	return encodeFrame(prepareFrame(img, maxDim))
+}
+
+// prepareFrame applies -center-crop and then shrinks img to fit maxDim
+func prepareFrame(img image.Image, maxDim int) image.Image {
+	if *centerCrop {
+		img = squareFrame(img, *cropStrategy)
+	}
+	if maxDim <= 0 {
+		return img
+	}
+	return shrink(img, maxDim)
+}
+
+// squareFrame makes img square. CLIP resizes the short side and crops the
+// middle itself, so a wide reaction GIF loses its edges either way; doing it
+// here means the crop is ours to choose: "center" keeps the middle square,
+// "pad" keeps every pixel and letterboxes the short side in black.
+func squareFrame(img image.Image, strategy string) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == h {
+		return img
+	}
+	if strategy == "pad" {
+		side := max(w, h)
+		out := image.NewRGBA(image.Rect(0, 0, side, side))
+		draw.Draw(out, out.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		off := image.Pt((side-w)/2, (side-h)/2)
+		draw.Draw(out, b.Sub(b.Min).Add(off), img, b.Min, draw.Src)
+		return out
+	}
+	side := min(w, h)
+	out := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(out, out.Bounds(), img, b.Min.Add(image.Pt((w-side)/2, (h-side)/2)), draw.Src)
+	return out
+}
+
+// encodeFrame encodes a still with -preprocess-format
+func encodeFrame(img image.Image) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch *preprocessFormat {
+	case "jpeg":
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+		return buf.Bytes(), "image/jpeg", err
+	default:
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), "image/png", err
+	}
+}
+
+// firstLastFrames renders a GIF's first and last frames as stills, shrunk
+// to fit maxDim (0 keeps them full size). Later frames are often just the
+// pixels that changed, so the last frame is composited over everything
+// before it, honouring each frame's disposal method.
+func firstLastFrames(data []byte, maxDim int) (first, last []byte, contentType string, err error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("decode gif: %w", err)
+	}
+	if len(g.Image) == 0 {
+		return nil, nil, "", fmt.Errorf("gif has no frames")
+	}
+
+	var firstImg, lastImg image.Image
+	compositeFrames(g, func(i int, canvas *image.RGBA) {
+		if i == 0 {
+			firstImg = cloneRGBA(canvas)
+		}
+		if i == len(g.Image)-1 {
+			lastImg = canvas
+		}
+	})
+
+	if first, contentType, err = encodeFrame(prepareFrame(firstImg, maxDim)); err != nil {
+		return nil, nil, "", fmt.Errorf("encode first frame: %w", err)
+	}
+	if last, _, err = encodeFrame(prepareFrame(lastImg, maxDim)); err != nil {
+		return nil, nil, "", fmt.Errorf("encode last frame: %w", err)
+	}
+	return first, last, contentType, nil
+}
+
+// compositeFrames renders each frame of g onto a full-size canvas the way
+// a viewer shows it, honoring disposal, and calls visit with the canvas
+// after each frame is drawn. visit must copy the canvas to keep it.
+func compositeFrames(g *gif.GIF, visit func(i int, canvas *image.RGBA)) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		visit(i, canvas)
+		if i == len(g.Image)-1 {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+}
+
+// motionSamples is how many consecutive frame pairs -extract-motion compares
+const motionSamples = 8
+
+// motionScore is the mean absolute RGB difference, scaled to 0..1, between
+// up to motionSamples evenly spaced pairs of consecutive composited frames.
+// Single-frame GIFs score 0.
+func motionScore(data []byte) (float64, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("decode gif: %w", err)
+	}
+	n := len(g.Image)
+	if n < 2 {
+		return 0, nil
+	}
+
+	// Pairs (i-1, i), spread over the whole animation
+	sampled := make(map[int]bool)
+	pairs := min(motionSamples, n-1)
+	for k := range pairs {
+		sampled[1+k*(n-1)/pairs] = true
+	}
+
+	var prev *image.RGBA
+	var total float64
+	compared := 0
+	compositeFrames(g, func(i int, canvas *image.RGBA) {
+		if sampled[i] && prev != nil {
+			total += frameDiff(prev, canvas)
+			compared++
+		}
+		prev = nil
+		if sampled[i+1] {
+			prev = cloneRGBA(canvas)
+		}
+	})
+	if compared == 0 {
+		return 0, nil
+	}
+	return math.Round(total/float64(compared)*1e4) / 1e4, nil
+}
+
+// frameDiff is the mean absolute RGB difference of two same-size frames, 0..1
+func frameDiff(a, b *image.RGBA) float64 {
+	var sum uint64
+	for i := 0; i+3 < len(a.Pix) && i+3 < len(b.Pix); i += 4 {
+		for c := range 3 {
+			d := int(a.Pix[i+c]) - int(b.Pix[i+c])
+			if d < 0 {
+				d = -d
+			}
+			sum += uint64(d)
+		}
+	}
+	pixels := min(len(a.Pix), len(b.Pix)) / 4
+	if pixels == 0 {
+		return 0
+	}
+	return float64(sum) / float64(pixels*3*255)
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	copy(out.Pix, img.Pix)
+	return out
+}
+
+// shrink box-averages img down so neither side exceeds maxDim, keeping the
+// aspect ratio. Smaller images are returned as is.
+func shrink(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxDim && h <= maxDim {
+		return img
+	}
+	scale := float64(maxDim) / float64(max(w, h))
+	nw, nh := max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+
+	out := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := range nh {
+		y0, y1 := b.Min.Y+y*h/nh, b.Min.Y+(y+1)*h/nh
+		for x := range nw {
+			x0, x1 := b.Min.X+x*w/nw, b.Min.X+(x+1)*w/nw
+			var r, g, bl, a, n uint64
+			for py := y0; py < max(y1, y0+1); py++ {
+				for px := x0; px < max(x1, x0+1); px++ {
+					pr, pg, pb, pa := img.At(px, py).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			out.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return out
+}
+
+// paletteSize is how many colors -extract-palette stores per GIF
+const paletteSize = 5
+
+// dominantColors histograms a GIF's first frame into 4-bit-per-channel
+// buckets and returns the average color of the n fullest as "#rrggbb",
+// most common first. Transparent pixels don't count.
+func dominantColors(data []byte, n int) ([]string, error) {
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode gif: %w", err)
+	}
+
+	type bucket struct{ r, g, b, count uint64 }
+	var buckets [4096]bucket
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			bk := &buckets[(r>>12)<<8|(g>>12)<<4|b>>12]
+			bk.r, bk.g, bk.b = bk.r+uint64(r>>8), bk.g+uint64(g>>8), bk.b+uint64(b>>8)
+			bk.count++
+		}
+	}
+
+	filled := make([]bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		if bk.count > 0 {
+			filled = append(filled, bk)
+		}
+	}
+	sort.Slice(filled, func(i, j int) bool { return filled[i].count > filled[j].count })
+
+	colors := make([]string, 0, n)
+	for _, bk := range filled[:min(n, len(filled))] {
+		colors = append(colors, fmt.Sprintf("#%02x%02x%02x", bk.r/bk.count, bk.g/bk.count, bk.b/bk.count))
+	}
+	return colors, nil
+}
+
+// frameCount decodes every frame of a GIF and returns how many there are
+func frameCount(data []byte) (int, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("decode gif: %w", err)
+	}
+	return len(g.Image), nil
+}
+
+// dHash computes a 64-bit difference hash of a GIF's first frame: shrink to
+// 9x8 grayscale and record whether each pixel is brighter than its right
+// neighbour. Re-encodes and resizes of the same GIF land within a few bits.
+func dHash(data []byte) (uint64, error) {
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("decode gif: %w", err)
+	}
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return 0, fmt.Errorf("empty image")
+	}
+
+	// Box-average each cell of a 9x8 grid
+	var gray [8][9]float64
+	for y := 0; y < 8; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/8, b.Min.Y+(y+1)*b.Dy()/8
+		for x := 0; x < 9; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/9, b.Min.X+(x+1)*b.Dx()/9
+			var sum float64
+			n := 0
+			for py := y0; py < max(y1, y0+1); py++ {
+				for px := x0; px < max(x1, x0+1); px++ {
+					r, g, bl, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			gray[y][x] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// hashIndex is the persisted set of seen image hashes. Hashes are bucketed
+// by each of their 8 bytes: two hashes within 7 bits of each other must
+// share at least one byte exactly, so Near only scans matching buckets.
+type hashIndex struct {
+	mu      sync.Mutex // the -embed-workers reader and flusher share it
+	owners  map[uint64]string
+	buckets [8]map[byte][]uint64
+	file    *os.File
+}
+
+// loadHashIndex reads "hash docID" lines from path and opens it for appending
+func loadHashIndex(path string) (*hashIndex, error) {
+	idx := &hashIndex{owners: make(map[uint64]string)}
+	for i := range idx.buckets {
+		idx.buckets[i] = make(map[byte][]uint64)
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			var hash uint64
+			var docID string
+			if _, err := fmt.Sscanf(line, "%x %s", &hash, &docID); err == nil {
+				idx.insert(hash, docID)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read dedup file: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open dedup file: %w", err)
+	}
+	idx.file = file
+	return idx, nil
+}
+
+func (idx *hashIndex) insert(hash uint64, docID string) {
+	if _, ok := idx.owners[hash]; ok {
+		return
+	}
+	idx.owners[hash] = docID
+	for i := range idx.buckets {
+		key := byte(hash >> (8 * i))
+		idx.buckets[i][key] = append(idx.buckets[i][key], hash)
+	}
+}
+
+// Near returns the docID of a seen hash within maxDist bits, if any
+func (idx *hashIndex) Near(hash uint64, maxDist int) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	maxDist = min(maxDist, 7) // bucketing only guarantees recall below 8
+	for i := range idx.buckets {
+		for _, other := range idx.buckets[i][byte(hash>>(8*i))] {
+			if bits.OnesCount64(hash^other) <= maxDist {
+				return idx.owners[other], true
+			}
+		}
+	}
+	return "", false
+}
+
+// Add records a new hash in memory and on disk
+func (idx *hashIndex) Add(hash uint64, docID string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.owners[hash]; ok {
+		return nil
+	}
+	idx.insert(hash, docID)
+	_, err := fmt.Fprintf(idx.file, "%016x %s\n", hash, docID)
+	return err
+}
+
+func (idx *hashIndex) Len() int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return len(idx.owners)
+}
+
+func (idx *hashIndex) Close() error {
+	return idx.file.Close()
+}
+
+// loadEmbeddings inserts docs from an embed-subcommand file into the table
+func loadEmbeddings(ctx context.Context, client *antfly.AntflyClient) error {
+	file, err := os.Open(*embeddingsFile)
+	if err != nil {
+		return fmt.Errorf("open embeddings file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// Each line carries a full vector, so allow long lines
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	batch := newDocBatch()
+	loaded := 0
+	failed := 0
+	startTime := time.Now()
+	sizer := newBatchSizer()
+
+	fmt.Printf("Loading %s into '%s'...\n", *embeddingsFile, *tableName)
+
+	for scanner.Scan() {
+		var rec embeddedDoc
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.ID == "" {
+			log.Printf("Warning: skipping malformed line: %v", err)
+			failed++
+			continue
+		}
+		if vec, ok := rec.Doc["_embeddings"].(map[string]any)[*indexName].([]any); ok && tableDimension > 0 && len(vec) != tableDimension {
+			log.Printf("Warning: skipping %s: %d-dim vector, table '%s' expects %d", rec.ID, len(vec), *tableName, tableDimension)
+			failed++
+			continue
+		}
+		batch.Add(rec.ID, rec.Doc)
+
+		if batch.Len() >= sizer.size {
+			attempts, err := flushBatch(ctx, client, batch)
+			if err != nil {
+				log.Printf("Warning: batch insert failed (%s): %v", batch.Span(), err)
+				writeDeadLetters(batch, err)
+			}
+			sizer.record(err == nil && attempts == 1)
+			loaded += batch.Len()
+			batch = newDocBatch()
+			progressf("Loaded: %d (%.1f/sec)", loaded, float64(loaded)/time.Since(startTime).Seconds())
+
+			if *limit > 0 && loaded >= *limit {
+				fmt.Printf("\nReached limit of %d\n", *limit)
+				break
+			}
+		}
+	}
+
+	if batch.Len() > 0 {
+		if _, err := flushBatch(ctx, client, batch); err != nil {
+			log.Printf("Warning: final batch insert failed (%s): %v", batch.Span(), err)
+			writeDeadLetters(batch, err)
+		}
+		loaded += batch.Len()
+	}
+
+	elapsed := time.Since(startTime).Seconds()
+	fmt.Printf("\nCompleted: %d GIFs in %.1fs (%.1f/sec), %d malformed lines\n",
+		loaded, elapsed, float64(loaded)/elapsed, failed)
+
+	return scanner.Err()
+}
+
+// docBatch accumulates docs for one insert, remembering input order.
+// Antfly takes inserts as a map, so IDs keeps the sequence for anything
+// that reports per-doc (logs, dead letters) to be identical run-to-run.
+type docBatch struct {
+	IDs  []string
+	Docs map[string]any
+}
+
+func newDocBatch() *docBatch {
+	return &docBatch{Docs: make(map[string]any)}
+}
+
+// Add queues a doc; a repeated ID replaces the doc but keeps its first position
+func (b *docBatch) Add(id string, doc any) {
+	if _, ok := b.Docs[id]; !ok {
+		b.IDs = append(b.IDs, id)
+	}
+	b.Docs[id] = doc
+}
+
+func (b *docBatch) Len() int {
+	return len(b.IDs)
+}
+
+// Span describes the batch by its first and last IDs for log lines
+func (b *docBatch) Span() string {
+	if len(b.IDs) == 0 {
+		return "empty batch"
+	}
+	return b.IDs[0] + ".." + b.IDs[len(b.IDs)-1]
+}
+
+// flushBatch inserts a batch, retrying with jittered exponential backoff.
+// Antfly being unavailable (a rolling restart: 503 or connection refused)
+// gets its own longer retry budget; a 4xx rejection fails immediately,
+// since resending the same docs can't succeed.
+func flushBatch(ctx context.Context, client *antfly.AntflyClient, batch *docBatch) (int, error) {
+	var err error
+	attempt := 0
+	outages := 0
+	reconnected := 0 // at most 1: a second reset is a real failure
+	for {
+		attempt++
+		_, err = client.Batch(ctx, *tableName, antfly.BatchRequest{
+			Inserts: batch.Docs,
+		})
+		if err == nil {
+			return attempt, nil
+		}
+
+		var delay time.Duration
+		switch {
+		case isRejected(err):
+			return attempt, err
+		case isConnReset(err) && reconnected == 0:
+			// A connection that sat idle through a slow embed was cut by
+			// something in between; the rest of the pool likely was too
+			reconnected++
+			antflyHTTPClient.CloseIdleConnections()
+			log.Printf("Warning: Antfly connection was reset (%v), reconnecting and retrying", err)
+			continue
+		case isUnavailable(err):
+			outages++
+			if outages > *outageRetries {
+				return attempt, err
+			}
+			delay = outageBackoff(outages)
+			log.Printf("Warning: Antfly unavailable (%v), retrying in %v (%d/%d)", err, delay.Round(time.Millisecond), outages, *outageRetries)
+		default:
+			retries := attempt - outages - reconnected
+			if retries > *flushRetries {
+				return attempt, err
+			}
+			delay = backoffWithJitter(retries)
+			log.Printf("Warning: batch insert failed (%v), retrying in %v (%d/%d)", err, delay.Round(time.Millisecond), retries, *flushRetries)
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// antflyStatusRegex pulls the HTTP status out of SDK errors, which only
+// carry it in the message ("received status 503: ...")
+var antflyStatusRegex = regexp.MustCompile(`received status (\d{3})`)
+
+func antflyStatus(err error) int {
+	m := antflyStatusRegex.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	status, _ := strconv.Atoi(m[1])
+	return status
+}
+
+// isUnavailable reports whether Antfly is down or restarting rather than
+// refusing the batch
+func isUnavailable(err error) bool {
+	return antflyStatus(err) == http.StatusServiceUnavailable || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// isConnReset reports a request that died on a connection the other end
+// (or a proxy) had already closed, as happens to pooled keep-alive
+// connections left idle past the proxy's timeout
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "server closed idle connection")
+}
+
+// isRejected reports a 4xx other than timeouts and rate limits, which do
+// deserve a retry
+func isRejected(err error) bool {
+	status := antflyStatus(err)
+	return status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// outageBackoff waits 5s * 2^(outage-1), capped at a minute and jittered,
+// long enough to ride out an Antfly node restart
+func outageBackoff(outage int) time.Duration {
+	d := min(5*time.Second<<(outage-1), time.Minute)
+	return d/2 + rand.N(d/2)
+}
+
+// deadLetterRecord is one line of the -dead-letter file: enough of the
+// source row to re-run it
+type deadLetterRecord struct {
+	ID          string `json:"id"`
+	GifURL      string `json:"gif_url"`
+	Description string `json:"description"`
+	Stage       string `json:"stage"`
+	Error       string `json:"error"`
+	Seq         *int   `json:"seq,omitempty"` // -preserve-order's seq, restored on retry
+}
+
+// rowSeq is the seq -preserve-order stamps on row rowNo's doc, nil without it
+func rowSeq(rowNo int) *int {
+	if !*preserveOrder {
+		return nil
+	}
+	seq := rowNo - 1
+	return &seq
+}
+
+// writeDeadLetters appends every doc of a failed batch to -dead-letter
+func writeDeadLetters(batch *docBatch, batchErr error) {
+	recs := make([]deadLetterRecord, 0, batch.Len())
+	for _, id := range batch.IDs {
+		doc, _ := batch.Docs[id].(map[string]any)
+		rec := deadLetterRecord{
+			ID:          id,
+			GifURL:      stringField(doc, "gif_url"),
+			Description: stringField(doc, "description"),
+			Stage:       "insert",
+			Error:       batchErr.Error(),
+		}
+		// An int from import, a float64 from a load of an embeddings file
+		switch seq := doc["seq"].(type) {
+		case int:
+			rec.Seq = &seq
+		case float64:
+			n := int(seq)
+			rec.Seq = &n
+		}
+		recs = append(recs, rec)
+	}
+	appendDeadLetters(recs...)
+}
+
+// appendDeadLetters adds records to -dead-letter. Failures here only warn;
+// losing a dead letter shouldn't abort the import that produced it.
+func appendDeadLetters(recs ...deadLetterRecord) {
+	if *deadLetter == "" || len(recs) == 0 {
+		return
+	}
+	file, err := os.OpenFile(*deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Warning: can't open dead-letter file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			log.Printf("Warning: can't write dead letter for %s: %v", rec.ID, err)
+			return
+		}
+	}
+}
+
+// retryDeadLetters re-embeds and re-inserts every row in -dead-letter. The
+// file is moved aside first, so rows that fail again are written to a
+// fresh -dead-letter by the usual paths.
+func retryDeadLetters(ctx context.Context, client *antfly.AntflyClient) error {
+	if *deadLetter == "" {
+		return fmt.Errorf("retry-dead-letter needs -dead-letter")
+	}
+	data, err := os.ReadFile(*deadLetter)
+	if err != nil {
+		return fmt.Errorf("read dead letters: %w", err)
+	}
+
+	// Keep the last record per ID: a row can fail more than once
+	var ids []string
+	recs := make(map[string]deadLetterRecord)
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var rec deadLetterRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.ID == "" || rec.GifURL == "" {
+			log.Printf("Warning: skipping malformed dead letter on line %d", i+1)
+			continue
+		}
+		if _, ok := recs[rec.ID]; !ok {
+			ids = append(ids, rec.ID)
+		}
+		recs[rec.ID] = rec
+	}
+
+	previous := *deadLetter + ".prev"
+	if err := os.Rename(*deadLetter, previous); err != nil {
+		return fmt.Errorf("move dead letters aside: %w", err)
+	}
+	fmt.Printf("Retrying %d dead letters (previous file kept as %s)\n", len(ids), previous)
+
+	if err := warmupTermite(ctx); err != nil {
+		return err
+	}
+
+	batch := newDocBatch()
+	retried, failed := 0, 0
+	flush := func() {
+		if _, err := flushBatch(ctx, client, batch); err != nil {
+			log.Printf("Warning: batch insert failed (%s): %v", batch.Span(), err)
+			writeDeadLetters(batch, err)
+			failed += batch.Len()
+		} else {
+			retried += batch.Len()
+		}
+		batch = newDocBatch()
+	}
+
+	for _, id := range ids {
+		rec := recs[id]
+		embedding, err := getImageEmbedding(ctx, rec.GifURL)
+		if err == nil && *fuseTextModel != "" {
+			fused := []embedResult{{Embedding: embedding}}
+			fuseText(ctx, []string{rec.Description}, fused)
+			embedding, err = fused[0].Embedding, fused[0].Err
+		}
+		if err == nil {
+			err = checkTableDimension(embedding)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to embed %s: %s", logURL(rec.GifURL, id), redactErr(err, rec.GifURL, id))
+			rec.Stage, rec.Error = "embed", err.Error()
+			appendDeadLetters(rec)
+			failed++
+			continue
+		}
+		doc := buildDoc(rec.GifURL, rec.Description, embedding)
+		if rec.Seq != nil {
+			doc["seq"] = *rec.Seq
+		}
+		batch.Add(id, doc)
+		if batch.Len() >= *batchSize {
+			flush()
+		}
+	}
+	if batch.Len() > 0 {
+		flush()
+	}
+
+	fmt.Printf("Recovered %d of %d dead letters, %d still failing\n", retried, len(ids), failed)
+	if failed > 0 {
+		fmt.Printf("Remaining failures written to %s\n", *deadLetter)
+	}
+	return nil
+}
+
+// buildDoc assembles the Antfly doc for one embedded GIF
+func buildDoc(gifURL, description string, embedding []float32) map[string]any {
+	// Convert []float32 to []any for JSON
+	embeddingAny := make([]any, len(embedding))
+	for i, v := range embedding {
+		embeddingAny[i] = v
+	}
+
+	doc := map[string]any{
+		"gif_url":        gifURL,
+		"description":    description,
+		"tumblr_id":      extractTumblrID(gifURL),
+		"embed_model":    embedModelName(),
+		"ingested_at":    ingestedAt(),
+		"schema_version": schemaVersion,
+		"_embeddings": map[string]any{
+			*indexName: embeddingAny, // must match the vector index name
+		},
+	}
+	if *dataset != "" {
+		doc["dataset"] = *dataset
+	}
+	if *storeChecksum && len(embedding) > 0 {
+		doc["embed_checksum"] = embedChecksum(embedding)
+	}
+	return doc
+}
+
+// fixedIngestTime is -ingest-time normalized to UTC, set in main
+var fixedIngestTime string
+
+// ingestedAt is the ingested_at value for a doc built now
+func ingestedAt() string {
+	if fixedIngestTime != "" {
+		return fixedIngestTime
+	}
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// embedModelName names the vector space a doc's embedding lives in, stored
+// as embed_model so a model change can be spotted per doc
+func embedModelName() string {
+	if *fuseTextModel != "" {
+		return *clipModel + "+" + *fuseTextModel
+	}
+	return *clipModel
+}
+
+// prefetchRows is how many upcoming input rows -skip-existing checks per
+// Antfly query
+const prefetchRows = 500
+
+// existenceChecker answers -skip-existing from batched lookups: the first
+// row it hasn't seen triggers one query for that row and the next
+// prefetchRows, so a run costs one round trip per prefetchRows rows rather
+// than one per row. Answers are dropped once used, keeping memory flat.
+type existenceChecker struct {
+	client  *antfly.AntflyClient
+	checked map[string]bool   // docIDs fetched and not yet asked about
+	models  map[string]string // embed_model of the checked docIDs that exist
+}
+
+func newExistenceChecker(client *antfly.AntflyClient) *existenceChecker {
+	return &existenceChecker{client: client, checked: make(map[string]bool), models: make(map[string]string)}
+}
+
+// lookup reports the embed_model docID was stored with. Docs from before
+// embed_model existed come back found with an empty model, so they get
+// re-embedded too. upcoming lists the docIDs worth fetching alongside.
+func (e *existenceChecker) lookup(ctx context.Context, docID string, upcoming func() []string) (model string, found bool, err error) {
+	if !e.checked[docID] {
+		ids := []string{docID}
+		for _, id := range upcoming() {
+			if !e.checked[id] && id != docID {
+				ids = append(ids, id)
+			}
+		}
+		if err := e.fetch(ctx, ids); err != nil {
+			return "", false, err
+		}
+	}
+	model, found = e.models[docID]
+	delete(e.checked, docID)
+	delete(e.models, docID)
+	return model, found, nil
+}
+
+// fetch reads embed_model for every existing doc among ids in one query
+func (e *existenceChecker) fetch(ctx context.Context, ids []string) error {
+	q := query.NewDocIds(ids)
+	resp, err := e.client.Query(ctx, antfly.QueryRequest{
+		Table:          *tableName,
+		FullTextSearch: &q,
+		Fields:         []string{"embed_model"},
+		Limit:          len(ids),
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Responses) > 0 && resp.Responses[0].Error != "" {
+		return fmt.Errorf("%s", resp.Responses[0].Error)
+	}
+	for _, id := range ids {
+		e.checked[id] = true
+	}
+	if len(resp.Responses) == 0 {
+		return nil
+	}
+	for _, hit := range resp.Responses[0].Hits.Hits {
+		model, _ := hit.Source["embed_model"].(string)
+		e.models[hit.ID] = model
+	}
+	return nil
+}
+
+// upcomingDocIDs computes the docIDs of buffered rows, skipping any the
+// import loop would reject anyway
+func upcomingDocIDs(rows [][]string, fixURL *urlTransformer) []string {
+	ids := make([]string, 0, len(rows))
+	for _, fields := range rows {
+		if len(fields) <= max(*urlCol, *descCol) {
+			continue
+		}
+		if *maxURLLen > 0 && len(strings.TrimSpace(fields[*urlCol])) > *maxURLLen {
+			continue
+		}
+		gifURL, err := fixURL.Transform(strings.TrimSpace(fields[*urlCol]))
+		if err != nil || validateURL(gifURL) != nil {
+			continue
+		}
+		ids = append(ids, gifDocID(gifURL))
+	}
+	return ids
+}
+
+// gifDocID is a GIF's doc ID: a hash of its (fixed) URL, or with
+// -canonical-ids of its provider ID when it has one
+func gifDocID(gifURL string) string {
+	key := gifURL
+	if *canonicalIDs {
+		if canonical, ok := canonicalKey(gifURL); ok {
+			key = canonical
+		}
+	}
+	hash := md5.Sum([]byte(key))
+	return fmt.Sprintf("gif_%x", hash[:8])
+}
+
+// giphyIDRegex extracts the GIF ID from giphy media URLs, e.g.
+// media2.giphy.com/media/<id>/giphy.gif or i.giphy.com/<id>.gif
+var giphyIDRegex = regexp.MustCompile(`giphy\.com/(?:media/(?:v1\.[^/]+/)?)?([a-zA-Z0-9]{6,})(?:/|\.gif)`)
+
+// canonicalKey names the GIF behind a URL independent of CDN subdomain and
+// size suffix, e.g. "tumblr:mx1abcd..." for any tumblr_mx1abcd..._250.gif
+func canonicalKey(gifURL string) (string, bool) {
+	if id := extractTumblrID(gifURL); id != "" {
+		return "tumblr:" + id, true
+	}
+	if m := giphyIDRegex.FindStringSubmatch(gifURL); m != nil {
+		return "giphy:" + m[1], true
+	}
+	return "", false
+}
+
+// embedChecksum is the CRC32 of the vector's little-endian float32 bytes
+func embedChecksum(vec []float32) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(encodeVector(vec)))
+}
+
+// rowSkip is why rowGate dropped a row, so callers can count each reason
+type rowSkip int
+
+const (
+	rowKept        rowSkip = iota
+	rowShort               // fewer fields than -url-col/-desc-col need
+	rowLongURL             // over -max-url-len
+	rowBadURL              // -url-transform failed
+	rowInvalidURL          // not an http(s) URL with a host
+	rowHostBlocked         // -allow-hosts/-deny-hosts
+	rowTermBlocked         // description matches -blocklist
+	rowMerged              // -canonical-ids variant of a GIF already stored
+)
+
+// gatedRow is a row that passed rowGate, with its URL fixed and its
+// description sanitized
+type gatedRow struct {
+	gifURL      string
+	description string
+	docID       string
+	canonical   bool // -canonical-ids: one of possibly several URL variants
+}
+
+// rowGate holds the row-level filters an import applies before fetching
+// anything, shared with -head so the preview drops the same rows
+type rowGate struct {
+	fixURL    *urlTransformer
+	allowList []string
+	denyList  []string
+	variants  *variantSet
+}
+
+func newRowGate(fixURL *urlTransformer, variants *variantSet) *rowGate {
+	return &rowGate{
+		fixURL:    fixURL,
+		allowList: splitHosts(*allowHosts),
+		denyList:  splitHosts(*denyHosts),
+		variants:  variants,
+	}
+}
+
+// Check runs one TSV row through the gates, logging URL problems. A
+// -canonical-ids variant only counts as merged once another variant has
+// been claimed in variants; until then every variant goes ahead, so one
+// failing to fetch or embed doesn't lose the GIF.
+func (g *rowGate) Check(rowNo int, fields []string) (gatedRow, rowSkip) {
+	if len(fields) <= max(*urlCol, *descCol) {
+		return gatedRow{}, rowShort
+	}
+
+	rawURL := strings.TrimSpace(fields[*urlCol])
+	// Garbage this long would only burn a Termite timeout
+	if *maxURLLen > 0 && len(rawURL) > *maxURLLen {
+		log.Printf("Row %d: URL is %d bytes (over -max-url-len %d)", rowNo, len(rawURL), *maxURLLen)
+		return gatedRow{}, rowLongURL
+	}
+
+	gifURL, err := g.fixURL.Transform(rawURL)
+	if err != nil {
+		log.Printf("Row %d: %s: %v", rowNo, logURL(rawURL, gifDocID(rawURL)), err)
+		return gatedRow{}, rowBadURL
+	}
+	docID := gifDocID(gifURL)
+	if err := validateURL(gifURL); err != nil {
+		log.Printf("Row %d: invalid URL %s: %s", rowNo, logURL(gifURL, docID), redactErr(err, gifURL, docID))
+		return gatedRow{}, rowInvalidURL
+	}
+	description := fields[*descCol]
+	if *sanitize {
+		description = sanitizeText(description)
+	}
+
+	if !hostAllowed(gifURL, g.allowList, g.denyList) {
+		return gatedRow{}, rowHostBlocked
+	}
+	if blocklist.Match(description) {
+		return gatedRow{}, rowTermBlocked
+	}
+
+	row := gatedRow{gifURL: gifURL, description: description, docID: docID}
+	if *canonicalIDs {
+		if _, ok := canonicalKey(gifURL); ok {
+			if g.variants.Has(docID) {
+				return row, rowMerged
+			}
+			row.canonical = true
+		}
+	}
+	return row, rowKept
+}
+
+// printHead prints the docs the first -head rows would become (with an
+// empty _embeddings), through the same row gates as an import
+func printHead() error {
+	file, err := os.Open(*tsvPath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer file.Close()
+	rows, err := newRowReader(file)
+	if err != nil {
+		return err
+	}
+	variants := &variantSet{ids: make(map[string]bool)}
+	gate := newRowGate(newURLTransformer(*urlTransformCmd), variants)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	for rowNo := 1; rowNo <= *head; rowNo++ {
+		fields, ok := rows.Next()
+		if !ok {
+			break
+		}
+		row, skip := gate.Check(rowNo, fields)
+		switch skip {
+		case rowKept:
+		case rowShort:
+			log.Printf("Row %d: only %d fields", rowNo, len(fields))
+			continue
+		case rowHostBlocked:
+			log.Printf("Row %d: host not allowed by -allow-hosts/-deny-hosts", rowNo)
+			continue
+		case rowTermBlocked:
+			log.Printf("Row %d: description matches -blocklist", rowNo)
+			continue
+		case rowMerged:
+			log.Printf("Row %d: URL variant of %s (-canonical-ids)", rowNo, row.docID)
+			continue
+		default:
+			continue // the gate logged why
+		}
+		// No embed to fail here, so the first variant is the one stored
+		if row.canonical {
+			variants.Claim(row.docID)
+		}
+		rec := embeddedDoc{ID: row.docID, Doc: buildDoc(row.gifURL, row.description, nil)}
+		if *preserveOrder {
+			rec.Doc["seq"] = rowNo - 1
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// stringField returns a string field from a document, or "" if absent
+func stringField(doc map[string]any, key string) string {
+	if s, ok := doc[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// shardRouter maps docIDs to the table's shards by their key byte ranges
+type shardRouter struct {
+	ranges []shardRange
+}
+
+type shardRange struct {
+	start, end []byte // end is exclusive; empty means unbounded
+}
+
+// newShardRouter reads the shard key ranges from the table status. It
+// errors when there's nothing to parallelize over, so callers fall back.
+func newShardRouter(ctx context.Context, client *antfly.AntflyClient) (*shardRouter, error) {
+	status, err := client.GetTable(ctx, *tableName)
+	if err != nil {
+		return nil, fmt.Errorf("get table: %w", err)
+	}
+	router := &shardRouter{}
+	for _, shard := range status.Shards {
+		if len(shard.ByteRange) != 2 {
+			return nil, fmt.Errorf("shard without a key range")
+		}
+		router.ranges = append(router.ranges, shardRange{start: shard.ByteRange[0], end: shard.ByteRange[1]})
+	}
+	if len(router.ranges) < 2 {
+		return nil, fmt.Errorf("table has %d shard(s)", len(router.ranges))
+	}
+	sort.Slice(router.ranges, func(i, j int) bool {
+		return bytes.Compare(router.ranges[i].start, router.ranges[j].start) < 0
+	})
+	return router, nil
+}
+
+// shardOf returns the index of the range holding key, or -1
+func (r *shardRouter) shardOf(key string) int {
+	for i, rng := range r.ranges {
+		if bytes.Compare([]byte(key), rng.start) >= 0 && (len(rng.end) == 0 || bytes.Compare([]byte(key), rng.end) < 0) {
+			return i
+		}
+	}
+	return -1
+}
+
+// split partitions a batch by shard, keeping input order within each part.
+// Keys outside every known range (a split in progress) share one part.
+func (r *shardRouter) split(batch *docBatch) []*docBatch {
+	parts := make(map[int]*docBatch)
+	var order []int
+	for _, id := range batch.IDs {
+		shard := r.shardOf(id)
+		part, ok := parts[shard]
+		if !ok {
+			part = newDocBatch()
+			parts[shard] = part
+			order = append(order, shard)
+		}
+		part.Add(id, batch.Docs[id])
+	}
+	split := make([]*docBatch, len(order))
+	for i, shard := range order {
+		split[i] = parts[shard]
+	}
+	return split
+}
+
+// insertBatch flushes a batch, per shard in parallel when shards is set. It
+// returns the most attempts any part took and the docs that failed (an
+// empty batch on success), so one bad shard doesn't dead-letter the rest.
+func insertBatch(ctx context.Context, client *antfly.AntflyClient, shards *shardRouter, batch *docBatch) (int, *docBatch, error) {
+	if shards == nil {
+		attempts, err := flushBatch(ctx, client, batch)
+		if err != nil {
+			return attempts, batch, err
+		}
+		return attempts, newDocBatch(), nil
+	}
+
+	parts := shards.split(batch)
+	attempts := make([]int, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempts[i], errs[i] = flushBatch(ctx, client, part)
+		}()
+	}
+	wg.Wait()
+
+	failed := newDocBatch()
+	maxAttempts := 0
+	for i, part := range parts {
+		maxAttempts = max(maxAttempts, attempts[i])
+		if errs[i] != nil {
+			for _, id := range part.IDs {
+				failed.Add(id, part.Docs[id])
+			}
+		}
+	}
+	return maxAttempts, failed, errors.Join(errs...)
+}
+
+// backoffWithJitter returns 500ms * 2^(attempt-1), capped at 32s and
+// randomized into [d/2, d) so concurrent ingests don't retry against Antfly
+// in lockstep. The cap also keeps a large -flush-retries from overflowing
+// the shift.
+func backoffWithJitter(attempt int) time.Duration {
+	d := 500 * time.Millisecond << min(max(attempt-1, 0), 6)
+	return d/2 + rand.N(d/2)
+}
+
+// batchSizer tracks the flush threshold. In -adaptive-batch mode it halves
+// on failure (or a retried insert) and doubles after sustained success.
+type batchSizer struct {
+	size      int
+	successes int
+}
+
+// growAfter is the number of consecutive clean flushes before growing
+const growAfter = 5
+
+func newBatchSizer() *batchSizer {
+	size := *batchSize
+	if *adaptiveBatch {
+		size = max(*minBatch, min(size, *maxBatch))
+	}
+	return &batchSizer{size: size}
+}
+
+// record adjusts the batch size after a flush; ok means it succeeded first try
+func (b *batchSizer) record(ok bool) {
+	if !*adaptiveBatch {
+		return
+	}
+	if !ok {
+		b.successes = 0
+		if next := max(*minBatch, b.size/2); next != b.size {
+			log.Printf("Adaptive batch: shrinking %d -> %d after insert failure", b.size, next)
+			b.size = next
+		}
+		return
+	}
+	b.successes++
+	if b.successes >= growAfter {
+		b.successes = 0
+		if next := min(*maxBatch, b.size*2); next != b.size {
+			log.Printf("Adaptive batch: growing %d -> %d after %d clean flushes", b.size, next, growAfter)
+			b.size = next
+		}
+	}
+}
+
+// logURL returns the URL to show in logs, or the docID under -redact-urls
+func logURL(gifURL, docID string) string {
+	if *redactURLs {
+		return docID
+	}
+	return gifURL
+}
+
+// redactErr formats err for logging, scrubbing the GIF URL under -redact-urls.
+// HTTP client and Termite errors often echo the URL they failed on.
+func redactErr(err error, gifURL, docID string) string {
+	msg := err.Error()
+	if *redactURLs {
+		msg = strings.ReplaceAll(msg, gifURL, docID)
+	}
+	return msg
+}
+
+// splitHosts parses a comma-separated host suffix list
+func splitHosts(list string) []string {
+	var hosts []string
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, strings.TrimPrefix(h, "."))
+		}
+	}
+	return hosts
+}
+
+// blocklist is the loaded -blocklist, nil without one
+var blocklist *termBlocklist
+
+// termBlocklist matches -blocklist terms as whole words, ignoring case
+type termBlocklist struct {
+	re *regexp.Regexp
+}
+
+// loadBlocklist reads one term or phrase per line, skipping blank lines and
+// # comments. A phrase matches across any run of whitespace.
+func loadBlocklist(path string) (*termBlocklist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read blocklist: %w", err)
+	}
+	var terms []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words := strings.Fields(line)
+		for i, w := range words {
+			words[i] = regexp.QuoteMeta(w)
+		}
+		terms = append(terms, strings.Join(words, `\s+`))
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("blocklist %s has no terms", path)
+	}
+	// RE2's \b only knows ASCII word characters, so the boundary is spelled
+	// out: a term may not touch a letter, digit or underscore on either side.
+	// That keeps "ass" from blocking "class" or "assets".
+	re, err := regexp.Compile(`(?i)(?:^|[^\pL\pN_])(?:` + strings.Join(terms, "|") + `)(?:$|[^\pL\pN_])`)
+	if err != nil {
+		return nil, fmt.Errorf("compile blocklist: %w", err)
+	}
+	return &termBlocklist{re: re}, nil
+}
+
+// Match reports whether any of the texts contains a blocked term; a nil
+// blocklist matches nothing
+func (b *termBlocklist) Match(texts ...string) bool {
+	if b == nil {
+		return false
+	}
+	for _, t := range texts {
+		if b.re.MatchString(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAllowed checks a URL's host against the deny list, then the allow
+// list. A suffix matches the host itself or any subdomain, so "tumblr.com"
+// covers 64.media.tumblr.com but not eviltumblr.com.
+func hostAllowed(gifURL string, allow, deny []string) bool {
+	if len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+	u, err := url.Parse(gifURL)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	matches := func(suffixes []string) bool {
+		for _, s := range suffixes {
+			if host == s || strings.HasSuffix(host, "."+s) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(deny) {
+		return false
+	}
+	return len(allow) == 0 || matches(allow)
+}
+
+// httpsVariant returns the https:// form of an http:// URL if it answers
+// with a 2xx. Some CDNs reject HEAD, so fall back to a one-byte GET.
+func httpsVariant(ctx context.Context, httpURL string) (string, bool) {
+	secure := "https://" + strings.TrimPrefix(httpURL, "http://")
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequestWithContext(ctx, method, secure, nil)
+		if err != nil {
+			return "", false
+		}
+		if method == "GET" {
+			req.Header.Set("Range", "bytes=0-0")
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return "", false
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return secure, true
+		}
+	}
+	return "", false
+}
+
+// markupRegex matches stray HTML tags left in scraped descriptions
+var markupRegex = regexp.MustCompile(`<[^>]*>`)
+
+// sanitizeText unescapes HTML entities, drops tags and control characters,
+// and collapses whitespace runs to single spaces
+func sanitizeText(text string) string {
+	text = html.UnescapeString(text)
+	text = markupRegex.ReplaceAllString(text, " ")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// validateURL rejects URLs Termite can't fetch: embedded whitespace (from
+// sloppy TSV generation), unparseable ones, and anything not http(s) with a host
+func validateURL(gifURL string) error {
+	if strings.ContainsFunc(gifURL, unicode.IsSpace) {
+		return errors.New("contains whitespace")
+	}
+	u, err := url.Parse(gifURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("no host")
+	}
+	return nil
+}
+
+// urlTransformer rewrites input URLs through -url-transform-cmd, or with
+// fixTumblrURL when no command is set. Results are cached so repeated URLs
+// don't spawn a process each.
+type urlTransformer struct {
+	cmd   string
+	cache map[string]string
+}
+
+func newURLTransformer(cmd string) *urlTransformer {
+	return &urlTransformer{cmd: cmd, cache: make(map[string]string)}
+}
+
+func (t *urlTransformer) Transform(rawURL string) (string, error) {
+	if t.cmd == "" {
+		return fixTumblrURL(rawURL), nil
+	}
+	if out, ok := t.cache[rawURL]; ok {
+		return out, nil
+	}
+
+	cmd := exec.Command("sh", "-c", t.cmd)
+	cmd.Stdin = strings.NewReader(rawURL + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("url transform: %w", err)
+	}
+	transformed := strings.TrimSpace(string(out))
+	if transformed == "" {
+		return "", errors.New("url transform returned nothing")
+	}
+	t.cache[rawURL] = transformed
+	return transformed, nil
+}
+
+// fixTumblrURL updates old Tumblr CDN URLs to the new domain
+func fixTumblrURL(url string) string {
+	// Old CDN domains redirect to 64.media.tumblr.com
+	url = strings.Replace(url, "38.media.tumblr.com", "64.media.tumblr.com", 1)
+	url = strings.Replace(url, "33.media.tumblr.com", "64.media.tumblr.com", 1)
+	url = strings.Replace(url, "31.media.tumblr.com", "64.media.tumblr.com", 1)
+	return url
 }
 
 // extractTumblrID extracts the tumblr post ID from a GIF URL
@@ -343,3 +5103,487 @@ func extractTumblrID(url string) string {
 	}
 	return ""
 }
+
+// describePrompt mirrors DESCRIPTION_PROMPT in describe_gifs.py, adapted to a
+// single image so the output JSONL is interchangeable with the Python tool's
+const describePrompt = `You are analyzing an animated GIF.
+
+Analyze the action it shows and return a JSON object:
+- "literal": Factual description of the complete action/sequence (1-3 sentences, describe what happens from start to finish)
+- "source": Your best guess at where this is from — movie title, TV show, meme name, video game, news event, YouTube/TikTok trend, etc. Be specific (e.g., "Spy Kids (2001)" not just "movie"). Use "unknown" only if you genuinely cannot identify it.
+- "mood": Emotional tone or vibe (e.g., "funny", "wholesome", "chaotic", "satisfying")
+- "action": Key actions/verbs (e.g., "dancing", "falling", "celebrating")
+- "context": When someone might use this GIF in conversation (e.g., "reaction to good news")
+- "tags": Array of 5-10 searchable keywords (include character names, show titles, meme names if recognized)
+
+Respond with ONLY the JSON object, no markdown or extra text.`
+
+// scanPage is how many keys each ScanKeys call returns
+const scanPage = 500
+
+// scanAll pages through every doc in table in key order, calling fn with
+// the requested fields (plus the key). Each page starts after the last key
+// of the previous one; a short page means the end. An error from fn stops
+// the scan and is returned as is.
+func scanAll(ctx context.Context, client *antfly.AntflyClient, table string, fields []string, fn func(doc map[string]any) error) error {
+	from := ""
+	for {
+		docs, err := client.ScanKeys(ctx, table, antfly.ScanKeysRequest{
+			From:   from,
+			Limit:  scanPage,
+			Fields: fields,
+		})
+		if err != nil {
+			return fmt.Errorf("scan table: %w", err)
+		}
+		for _, doc := range docs {
+			from = docKey(doc)
+			if err := fn(doc); err != nil {
+				return err
+			}
+		}
+		if len(docs) < scanPage || from == "" {
+			return nil
+		}
+	}
+}
+
+// exportFields are the doc fields the import paths write
+var exportFields = []string{"gif_url", "description", "tumblr_id", "dataset", "embed_ms", "frame_count", "motion_score", "palette", "embed_checksum", "embed_model", "ingested_at", "schema_version", "seq", "_embeddings"}
+
+// describeSchema prints -table's indexes (type, dimension, embedder, source
+// field) and document schema, to answer "is this table set up the way I
+// think" without reading raw API JSON
+func describeSchema(ctx context.Context, client *antfly.AntflyClient) error {
+	status, err := client.GetTable(ctx, *tableName)
+	if err != nil {
+		return fmt.Errorf("get table: %w", err)
+	}
+	fmt.Printf("Table '%s' (%d shards)\n", *tableName, len(status.Shards))
+	if status.Description != "" {
+		fmt.Printf("  %s\n", status.Description)
+	}
+
+	names := make([]string, 0, len(status.Indexes))
+	for name := range status.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("\nIndexes (%d):\n", len(names))
+	for _, name := range names {
+		index := status.Indexes[name]
+		fmt.Printf("  %-28s %s\n", name, index.Type)
+		if index.Type == oapi.IndexTypeAknnV0 {
+			config, err := index.AsEmbeddingIndexConfig()
+			if err != nil {
+				fmt.Printf("      (unreadable config: %v)\n", err)
+				continue
+			}
+			fmt.Printf("      dimension: %d\n", config.Dimension)
+			fmt.Printf("      embedder:  %s\n", describeEmbedder(config.Embedder))
+			if config.Field != "" {
+				fmt.Printf("      field:     %s\n", config.Field)
+			}
+		}
+		if index.Description != "" {
+			fmt.Printf("      %s\n", index.Description)
+		}
+	}
+
+	fmt.Println("\nSchema:")
+	if len(status.Schema.DocumentSchemas) == 0 && len(status.Schema.DynamicTemplates) == 0 {
+		fmt.Println("  none (fields are mapped dynamically)")
+		return nil
+	}
+	schema, err := json.MarshalIndent(status.Schema, "  ", "  ")
+	if err != nil {
+		return fmt.Errorf("encode schema: %w", err)
+	}
+	fmt.Printf("  %s\n", schema)
+	return nil
+}
+
+// describeEmbedder names an index's server-side embedder; docs for an index
+// without one must bring their own _embeddings
+func describeEmbedder(e oapi.EmbedderConfig) string {
+	if e.Provider == "" {
+		return "none (precomputed _embeddings)"
+	}
+	if e.Provider == oapi.EmbedderProviderTermite {
+		if termite, err := e.AsTermiteEmbedderConfig(); err == nil && termite.Model != "" {
+			return fmt.Sprintf("%s %s", e.Provider, termite.Model)
+		}
+	}
+	return string(e.Provider)
+}
+
+// exportTable writes every doc in the table to -embeddings-file in the
+// embed/load format
+func exportTable(ctx context.Context, client *antfly.AntflyClient) error {
+	out, err := os.Create(*embeddingsFile)
+	if err != nil {
+		return fmt.Errorf("create export file: %w", err)
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+
+	fmt.Printf("Exporting '%s' to %s...\n", *tableName, *embeddingsFile)
+	exported := 0
+	err = scanAll(ctx, client, *tableName, exportFields, func(doc map[string]any) error {
+		id := docKey(doc)
+		delete(doc, "_id")
+		delete(doc, "key")
+		if err := enc.Encode(embeddedDoc{ID: id, Doc: doc}); err != nil {
+			return fmt.Errorf("write export file: %w", err)
+		}
+		exported++
+		if exported%scanPage == 0 {
+			progressf("Exported: %d", exported)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write export file: %w", err)
+	}
+	fmt.Printf("\nCompleted: exported %d docs\n", exported)
+	return nil
+}
+
+// schemaVersion is stamped on every doc as schema_version. Docs without
+// one predate the stamp and count as version 0. Bump it whenever docs gain
+// a field, and teach migrateDoc how to derive that field for older docs.
+const schemaVersion = 1
+
+// migrateTable scans -table for docs below schemaVersion and brings them up
+// to it with in-place $set transforms, so fields it doesn't know about
+// (vectors, enrichments) are left alone. tumblr_id comes from the URL;
+// frame_count, palette and motion_score need the GIF downloaded, so they're
+// only derived when the matching import flag (-store-frame-count,
+// -extract-palette, -extract-motion) is set, and then current docs missing
+// them are filled in too. A doc whose GIF can't be fetched keeps its old
+// version, so a rerun tries it again.
+func migrateTable(ctx context.Context, client *antfly.AntflyClient) error {
+	fields := []string{"gif_url", "tumblr_id", "schema_version", "frame_count", "palette", "motion_score"}
+	fmt.Printf("Migrating '%s' to schema version %d...\n", *tableName, schemaVersion)
+
+	var transforms []map[string]any
+	flush := func() error {
+		if len(transforms) == 0 {
+			return nil
+		}
+		err := applyTransforms(ctx, transforms)
+		transforms = nil
+		return err
+	}
+
+	scanned, current, migrated, failed := 0, 0, 0, 0
+	err := scanAll(ctx, client, *tableName, fields, func(doc map[string]any) error {
+		scanned++
+		version, _ := doc["schema_version"].(float64)
+		if frames, palette, motion := missingGIFFields(doc); int(version) >= schemaVersion && !frames && !palette && !motion {
+			current++
+			return nil
+		}
+		key := docKey(doc)
+		set, err := migrateDoc(ctx, doc)
+		if err != nil {
+			gifURL, _ := doc["gif_url"].(string)
+			log.Printf("Warning: can't migrate %s: %s", logURL(gifURL, key), redactErr(err, gifURL, key))
+			failed++
+			return nil
+		}
+		set["schema_version"] = schemaVersion
+
+		names := make([]string, 0, len(set))
+		for field := range set {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+		ops := make([]map[string]any, 0, len(set))
+		for _, field := range names {
+			ops = append(ops, map[string]any{"op": "$set", "path": field, "value": set[field]})
+		}
+		transforms = append(transforms, map[string]any{"key": key, "operations": ops})
+		migrated++
+		if len(transforms) >= *batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		progressf("Scanned: %d, migrated: %d, failed: %d", scanned, migrated, failed)
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nCompleted: scanned %d docs, %d already at version %d, migrated %d, %d failures\n", scanned, current, schemaVersion, migrated, failed)
+	return nil
+}
+
+// migrateDoc returns the fields to $set on a doc below schemaVersion
+func migrateDoc(ctx context.Context, doc map[string]any) (map[string]any, error) {
+	set := make(map[string]any)
+	gifURL, _ := doc["gif_url"].(string)
+	if _, ok := doc["tumblr_id"]; !ok && gifURL != "" {
+		set["tumblr_id"] = extractTumblrID(gifURL)
+	}
+
+	needFrames, needPalette, needMotion := missingGIFFields(doc)
+	if gifURL == "" || !(needFrames || needPalette || needMotion) {
+		return set, nil
+	}
+
+	data, _, err := downloadImage(ctx, gifURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	if needFrames {
+		frames, err := frameCount(data)
+		if err != nil {
+			return nil, fmt.Errorf("count frames: %w", err)
+		}
+		set["frame_count"] = frames
+	}
+	if needPalette {
+		palette, err := dominantColors(data, paletteSize)
+		if err != nil {
+			return nil, fmt.Errorf("extract palette: %w", err)
+		}
+		set["palette"] = palette
+	}
+	if needMotion {
+		motion, err := motionScore(data)
+		if err != nil {
+			return nil, fmt.Errorf("measure motion: %w", err)
+		}
+		set["motion_score"] = motion
+	}
+	return set, nil
+}
+
+// missingGIFFields reports which GIF-derived fields this run's flags ask
+// for that doc lacks
+func missingGIFFields(doc map[string]any) (frames, palette, motion bool) {
+	_, hasFrames := doc["frame_count"]
+	_, hasPalette := doc["palette"]
+	_, hasMotion := doc["motion_score"]
+	return *storeFrameCount && !hasFrames, *extractPalette && !hasPalette, *extractMotion && !hasMotion
+}
+
+// applyTransforms sends in-place doc updates in one batch request. The Go
+// client's BatchRequest has no transforms, so this posts the batch directly.
+func applyTransforms(ctx context.Context, transforms []map[string]any) error {
+	reqBody, err := json.Marshal(map[string]any{"transforms": transforms})
+	if err != nil {
+		return fmt.Errorf("encode transforms: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		strings.TrimSuffix(*antflyURL, "/api/v1")+"/api/v1/tables/"+*tableName+"/batch",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := antflyHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send transforms: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("transforms failed %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// describeMissingGIFs scans the image table for docs without enriched fields
+// (no "literal"), describes each with the vision endpoint, and appends
+// describe_gifs.py-compatible records to the -describe-missing JSONL.
+// URLs already in that file are skipped, so reruns resume where they left off.
+func describeMissingGIFs(ctx context.Context, client *antfly.AntflyClient) error {
+	done, err := loadDescribedURLs(*describeMissing)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(*describeMissing, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open output: %w", err)
+	}
+	defer out.Close()
+
+	fmt.Printf("Describing GIFs in '%s' missing enriched fields (%d already in %s)...\n", *tableName, len(done), *describeMissing)
+
+	described, failed, scanned := 0, 0, 0
+	err = scanAll(ctx, client, *tableName, []string{"gif_url", "description", "literal"}, func(doc map[string]any) error {
+		scanned++
+		key := docKey(doc)
+
+		gifURL, _ := doc["gif_url"].(string)
+		if literal, _ := doc["literal"].(string); literal != "" || gifURL == "" || done[gifURL] {
+			return nil
+		}
+
+		fields, err := describeGIF(ctx, gifURL)
+		if err != nil {
+			log.Printf("Warning: failed to describe %s: %s", logURL(gifURL, key), redactErr(err, gifURL, key))
+			failed++
+			return nil
+		}
+
+		// Same shape as describe_gifs.py: url + original_description + model fields
+		record := map[string]any{"url": gifURL}
+		if desc, ok := doc["description"].(string); ok {
+			record["original_description"] = desc
+		}
+		for k, v := range fields {
+			record[k] = v
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshal record: %w", err)
+		}
+		if _, err := out.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("write record: %w", err)
+		}
+		done[gifURL] = true
+		described++
+		progressf("Scanned: %d, described: %d, failed: %d", scanned, described, failed)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nCompleted: scanned %d docs, described %d, %d failures\n", scanned, described, failed)
+	return nil
+}
+
+// loadDescribedURLs reads URLs already present in a descriptions JSONL
+func loadDescribedURLs(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open existing output: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec struct {
+			URL string `json:"url"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil && rec.URL != "" {
+			done[rec.URL] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// docKey returns the key of a ScanKeys result
+func docKey(doc map[string]any) string {
+	for _, k := range []string{"_id", "key"} {
+		if s, ok := doc[k].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// describeGIF asks the vision endpoint for the describe_gifs.py JSON fields
+func describeGIF(ctx context.Context, gifURL string) (map[string]any, error) {
+	imageURL := gifURL
+	if *fetchLocally {
+		data, contentType, err := downloadImage(ctx, gifURL)
+		if err != nil {
+			return nil, fmt.Errorf("fetch locally: %w", err)
+		}
+		imageURL = dataURI(contentType, data)
+	}
+
+	reqBody := map[string]any{
+		"model": *describeModel,
+		"messages": []map[string]any{
+			{
+				"role": "user",
+				"content": []map[string]any{
+					{"type": "text", "text": describePrompt},
+					{"type": "image_url", "image_url": map[string]string{"url": imageURL}},
+				},
+			},
+		},
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", *describeURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := os.Getenv("DESCRIBE_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("describe error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return nil, fmt.Errorf("parse response: %w", err)
+	}
+	if len(completion.Choices) == 0 {
+		return nil, fmt.Errorf("no choices returned")
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(cleanJSONText(completion.Choices[0].Message.Content)), &fields); err != nil {
+		return nil, fmt.Errorf("parse description JSON: %w", err)
+	}
+	return fields, nil
+}
+
+// cleanJSONText strips markdown fences models like to wrap JSON in
+func cleanJSONText(text string) string {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		lines := strings.Split(text, "\n")
+		if len(lines) >= 2 {
+			text = strings.Join(lines[1:len(lines)-1], "\n")
+		}
+	}
+	return text
+}
@@ -0,0 +1,836 @@
+// Tests for main.go. The programs in this directory each live in one file,
+// so test them one at a time:
+//
+//	go test main.go main_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/antflydb/antfly-go/antfly"
+)
+
+// setFlag overrides a flag value for one test
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// readRows drains a rowReader over input
+func readRows(t *testing.T, input string) [][]string {
+	t.Helper()
+	rows, err := newRowReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for {
+		fields, ok := rows.Next()
+		if !ok {
+			break
+		}
+		got = append(got, fields)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRowReaderCSV(t *testing.T) {
+	setFlag(t, inputFormat, "csv")
+	setFlag(t, delimiter, ",")
+
+	input := strings.Join([]string{
+		`http://a.com/1.gif,"cat, then dog"`,
+		`http://a.com/2.gif,"she said ""no"""`,
+		"http://a.com/3.gif,\"tab\there\"",
+		"http://a.com/4.gif,\"two\nlines\"",
+		`http://a.com/5.gif,plain`,
+	}, "\n")
+	want := [][]string{
+		{"http://a.com/1.gif", "cat, then dog"},
+		{"http://a.com/2.gif", `she said "no"`},
+		{"http://a.com/3.gif", "tab\there"},
+		{"http://a.com/4.gif", "two\nlines"},
+		{"http://a.com/5.gif", "plain"},
+	}
+	got := readRows(t, input)
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if strings.Join(got[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRowReaderCSVColumns(t *testing.T) {
+	setFlag(t, inputFormat, "csv")
+	setFlag(t, delimiter, `\t`)
+	setFlag(t, urlCol, 2)
+	setFlag(t, descCol, 0)
+
+	got := readRows(t, "\"waves, hello\"\tx\thttp://a.com/1.gif\n")
+	if len(got) != 1 || len(got[0]) != 3 {
+		t.Fatalf("got %q, want one 3-field row", got)
+	}
+	if got[0][*urlCol] != "http://a.com/1.gif" || got[0][*descCol] != "waves, hello" {
+		t.Errorf("url/desc = %q/%q", got[0][*urlCol], got[0][*descCol])
+	}
+}
+
+func TestRowReaderCSVMalformed(t *testing.T) {
+	setFlag(t, inputFormat, "csv")
+	setFlag(t, delimiter, ",")
+
+	// A bare quote inside a field is skipped as nil, not fatal
+	got := readRows(t, "http://a.com/1.gif,ok\nhttp://a.com/2.gif,bad \"quote\nhttp://a.com/3.gif,ok\n")
+	if len(got) != 3 || got[1] != nil || got[2][0] != "http://a.com/3.gif" {
+		t.Errorf("got %q, want the malformed middle row as nil", got)
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"entities", "Tom &amp; Jerry &quot;chase&quot; &#39;em", `Tom & Jerry "chase" 'em`},
+		{"nested entity", "&amp;lt;b&amp;gt;", "&lt;b&gt;"},
+		{"markup", "a <b>bold</b> move<br/>", "a bold move"},
+		{"escaped markup", "&lt;i&gt;wink&lt;/i&gt;", "wink"},
+		{"control chars", "dance\x00party\x07\x1b!", "dance party !"},
+		{"newlines and tabs", "  line one\r\n\tline two  ", "line one line two"},
+		{"unicode kept", "café crème 🎉", "café crème 🎉"},
+		{"empty", " \t\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeText(tt.in); got != tt.want {
+				t.Errorf("sanitizeText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// hangingServer accepts requests and never answers until the test ends
+func hangingServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	return srv
+}
+
+// TestCancelAbortsInFlight checks that canceling the context (what the
+// first Ctrl-C does) cuts a hung download or embed short instead of
+// waiting out the 60s client timeout
+func TestCancelAbortsInFlight(t *testing.T) {
+	srv := hangingServer(t)
+	setFlag(t, fetchRetries, 2)
+	setFlag(t, &termites, newTermitePool(srv.URL))
+
+	calls := map[string]func(ctx context.Context) error{
+		"download": func(ctx context.Context) error {
+			_, _, err := downloadImage(ctx, srv.URL+"/cat.gif")
+			return err
+		},
+		"embed": func(ctx context.Context) error {
+			_, err := embedImageURL(ctx, "https://example.com/cat.gif")
+			return err
+		},
+	}
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			start := time.Now()
+			err := call(ctx)
+			if err == nil {
+				t.Fatal("expected an error from a canceled request")
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("returned %s after cancel, want promptly", elapsed)
+			}
+		})
+	}
+}
+
+// TestScanAll serves 1003 docs from a fake scan endpoint and checks that
+// scanAll pages through all of them, resuming after each page's last key
+func TestScanAll(t *testing.T) {
+	const total = 1003
+	var froms []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			From   string   `json:"from"`
+			Limit  int      `json:"limit"`
+			Fields []string `json:"fields"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		froms = append(froms, req.From)
+		if !slices.Equal(req.Fields, []string{"gif_url"}) {
+			http.Error(w, fmt.Sprintf("fields = %q", req.Fields), http.StatusBadRequest)
+			return
+		}
+		docs := []map[string]any{}
+		for i := 0; i < total && len(docs) < req.Limit; i++ {
+			key := fmt.Sprintf("gif_%04d", i)
+			if key > req.From {
+				docs = append(docs, map[string]any{"_id": key, "gif_url": "https://example.com/" + key + ".gif"})
+			}
+		}
+		json.NewEncoder(w).Encode(docs)
+	}))
+	defer srv.Close()
+	client, err := antfly.NewAntflyClient(srv.URL+"/api/v1", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = scanAll(context.Background(), client, "gifs", []string{"gif_url"}, func(doc map[string]any) error {
+		keys = append(keys, docKey(doc))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scanAll: %v", err)
+	}
+	if len(keys) != total || keys[0] != "gif_0000" || keys[total-1] != "gif_1002" {
+		t.Fatalf("got %d keys (%q ... %q), want %d in order", len(keys), keys[0], keys[len(keys)-1], total)
+	}
+	if !slices.IsSorted(keys) || len(slices.Compact(slices.Clone(keys))) != total {
+		t.Error("keys are out of order or repeated across pages")
+	}
+	if want := []string{"", "gif_0499", "gif_0999"}; !slices.Equal(froms, want) {
+		t.Errorf("page starts = %q, want %q", froms, want)
+	}
+
+	// An error from fn ends the scan after the first page
+	froms = nil
+	stop := errors.New("stop")
+	err = scanAll(context.Background(), client, "gifs", []string{"gif_url"}, func(doc map[string]any) error {
+		return stop
+	})
+	if !errors.Is(err, stop) || len(froms) != 1 {
+		t.Errorf("err = %v after %d pages, want stop after 1", err, len(froms))
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"https://64.media.tumblr.com/abc/tumblr_x_400.gif", true},
+		{"  http://example.com/cat.gif\t", true}, // padded; rows are trimmed first
+		{"https://example.com/a cat.gif", false},
+		{"https://example.com/cat.gif\u00a0x", false},
+		{"ftp://example.com/cat.gif", false},
+		{"example.com/cat.gif", false},
+		{"https:///cat.gif", false},
+		{"https://example.com/%zz.gif", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := validateURL(strings.TrimSpace(tt.in))
+		if (err == nil) != tt.ok {
+			t.Errorf("validateURL(%q) = %v, want ok=%v", tt.in, err, tt.ok)
+		}
+	}
+}
+
+// TestRedactInvalidURL checks that an invalid-URL error, which can quote
+// the URL, is logged with only the doc ID under -redact-urls
+func TestRedactInvalidURL(t *testing.T) {
+	setFlag(t, redactURLs, true)
+	gifURL := "https://example.com/%zz.gif"
+	err := validateURL(gifURL)
+	if err == nil || !strings.Contains(err.Error(), gifURL) {
+		t.Fatalf("validateURL(%q) = %v, want an error quoting it", gifURL, err)
+	}
+	docID := gifDocID(gifURL)
+	line := fmt.Sprintf("invalid URL %s: %s", logURL(gifURL, docID), redactErr(err, gifURL, docID))
+	if strings.Contains(line, "example.com") || !strings.Contains(line, docID) {
+		t.Errorf("log line %q should name %s and not the URL", line, docID)
+	}
+}
+
+// TestCacheKeyPreprocess checks that vectors embedded from preprocessed
+// frames never share a cache entry with ones embedded another way
+func TestCacheKeyPreprocess(t *testing.T) {
+	const gifURL = "https://example.com/cat.gif"
+	seen := map[string]string{}
+	check := func(name string) {
+		t.Helper()
+		key := cacheKey(gifURL)
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s and %s share cache key %s", name, other, key)
+		}
+		seen[key] = name
+	}
+	check("whole GIF")
+	setFlag(t, preprocessMaxDim, 224)
+	check("224px png")
+	setFlag(t, preprocessFormat, "jpeg")
+	check("224px jpeg")
+	setFlag(t, preprocessMaxDim, 336)
+	check("336px jpeg")
+	setFlag(t, centerCrop, true)
+	check("336px jpeg center crop")
+	setFlag(t, cropStrategy, "pad")
+	check("336px jpeg padded")
+	setFlag(t, preprocessMaxDim, 0)
+	check("full-size jpeg padded")
+}
+
+func TestCleanField(t *testing.T) {
+	tests := []struct {
+		in            string
+		trim, unquote bool
+		want          string
+	}{
+		{` "a ""b"" c " `, true, true, `a "b" c`},
+		{`"a ""b"" c"`, false, true, `a "b" c`},
+		{` "a ""b"" c" `, false, true, ` "a ""b"" c" `}, // padding hides the quotes
+		{`  padded  `, true, false, "padded"},
+		{`"quoted"`, true, false, "quoted"},
+		{`' single '`, true, false, "single"},
+		{`'single'`, false, true, `'single'`}, // -unquote is double quotes only
+		{`"mismatched'`, true, true, `"mismatched'`},
+		{`"`, true, true, `"`},
+		{`""`, true, true, ""},
+		{`  "x"  `, false, false, `  "x"  `},
+	}
+	for _, tt := range tests {
+		setFlag(t, trimFields, tt.trim)
+		setFlag(t, unquote, tt.unquote)
+		if got := cleanField(tt.in); got != tt.want {
+			t.Errorf("cleanField(%q) trim=%v unquote=%v = %q, want %q", tt.in, tt.trim, tt.unquote, got, tt.want)
+		}
+	}
+}
+
+// TestRowReaderTSVCleanFields checks that TSV rows come back cleaned
+func TestRowReaderTSVCleanFields(t *testing.T) {
+	setFlag(t, inputFormat, "tsv")
+	setFlag(t, trimFields, true)
+	setFlag(t, unquote, true)
+
+	got := readRows(t, " \"http://a.com/1.gif\" \t \"she said \"\"hi\"\"\" \nhttp://a.com/2.gif\tplain\n")
+	want := [][]string{
+		{"http://a.com/1.gif", `she said "hi"`},
+		{"http://a.com/2.gif", "plain"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if !slices.Equal(got[i], want[i]) {
+			t.Errorf("row %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// TestDeserializeEmbeddingsCorrupt feeds headers whose sizes don't fit the
+// payload, including ones whose byte count overflows uint64
+func TestDeserializeEmbeddingsCorrupt(t *testing.T) {
+	header := func(numVectors, dimension uint64, payload int) []byte {
+		b := binary.LittleEndian.AppendUint64(nil, numVectors)
+		b = binary.LittleEndian.AppendUint64(b, dimension)
+		return append(b, make([]byte, payload)...)
+	}
+	tests := map[string][]byte{
+		"zero dimension":      header(1, 0, 8),
+		"short payload":       header(2, 4, 16),
+		"huge dimension":      header(1, 1<<62, 16),
+		"overflowing product": header(1<<62, 4, 16),
+		"overflowing vectors": header(math.MaxUint64, 1, 16),
+		"truncated header":    header(1, 4, 0)[:12],
+	}
+	for name, data := range tests {
+		if _, err := deserializeEmbeddings(data); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+
+	got, err := deserializeEmbeddings(header(2, 2, 16))
+	if err != nil || len(got) != 2 || len(got[0]) != 2 {
+		t.Errorf("2x2 response = %v, %v", got, err)
+	}
+}
+
+func TestIsModelMissing(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{404, "model not found: openai/clip-vit-base-patch32\n", true},
+		{404, `{"error":"Model not found: BAAI/bge-small-en-v1.5"}`, true},
+		{404, "404 page not found", false},
+		{400, "model not found: x", false},
+		{400, "input too long for model x", false},
+		{500, "unknown error loading image for model x", false},
+	}
+	for _, tt := range tests {
+		if got := isModelMissing(tt.status, []byte(tt.body)); got != tt.want {
+			t.Errorf("isModelMissing(%d, %q) = %v, want %v", tt.status, tt.body, got, tt.want)
+		}
+	}
+}
+
+// gradient is a w×h image, placed at (10, 10) to catch code that assumes a
+// zero origin, whose pixel at offset (x, y) has R=x and G=y
+func gradient(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(10, 10, 10+w, 10+h))
+	for y := range h {
+		for x := range w {
+			img.Set(10+x, 10+y, color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	return img
+}
+
+func TestSquareFrame(t *testing.T) {
+	at := func(img image.Image, x, y int) color.RGBA {
+		b := img.Bounds()
+		return color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+	}
+	black := color.RGBA{A: 255}
+	src := func(x, y int) color.RGBA { return color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255} }
+
+	tests := []struct {
+		name     string
+		w, h     int
+		strategy string
+		side     int
+		check    func(out image.Image) error
+	}{
+		{"wide center", 8, 4, "center", 4, func(out image.Image) error {
+			// Columns 2..5 of the source
+			if at(out, 0, 0) != src(2, 0) || at(out, 3, 3) != src(5, 3) {
+				return fmt.Errorf("corners %v %v", at(out, 0, 0), at(out, 3, 3))
+			}
+			return nil
+		}},
+		{"tall center", 4, 8, "center", 4, func(out image.Image) error {
+			if at(out, 0, 0) != src(0, 2) || at(out, 3, 3) != src(3, 5) {
+				return fmt.Errorf("corners %v %v", at(out, 0, 0), at(out, 3, 3))
+			}
+			return nil
+		}},
+		{"wide pad", 8, 4, "pad", 8, func(out image.Image) error {
+			// Rows 0-1 and 6-7 are letterbox, the source sits at y offset 2
+			for _, y := range []int{0, 1, 6, 7} {
+				if at(out, 4, y) != black {
+					return fmt.Errorf("row %d = %v, want black", y, at(out, 4, y))
+				}
+			}
+			if at(out, 0, 2) != src(0, 0) || at(out, 7, 5) != src(7, 3) {
+				return fmt.Errorf("source corners %v %v", at(out, 0, 2), at(out, 7, 5))
+			}
+			return nil
+		}},
+		{"tall pad", 4, 8, "pad", 8, func(out image.Image) error {
+			for _, x := range []int{0, 1, 6, 7} {
+				if at(out, x, 4) != black {
+					return fmt.Errorf("column %d = %v, want black", x, at(out, x, 4))
+				}
+			}
+			if at(out, 2, 0) != src(0, 0) || at(out, 5, 7) != src(3, 7) {
+				return fmt.Errorf("source corners %v %v", at(out, 2, 0), at(out, 5, 7))
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := squareFrame(gradient(tt.w, tt.h), tt.strategy)
+			if b := out.Bounds(); b.Dx() != tt.side || b.Dy() != tt.side {
+				t.Fatalf("size %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.side, tt.side)
+			}
+			if err := tt.check(out); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	square := gradient(4, 4)
+	if out := squareFrame(square, "center"); out != image.Image(square) {
+		t.Error("a square frame should come back as is")
+	}
+}
+
+// TestDominantColors encodes a one-row GIF (6 red, 3 blue, 1 green and
+// 2 transparent pixels) and checks the colors come back by pixel count
+func TestDominantColors(t *testing.T) {
+	pal := color.Palette{color.RGBA{}, color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}, color.RGBA{G: 255, A: 255}}
+	img := image.NewPaletted(image.Rect(0, 0, 12, 1), pal)
+	copy(img.Pix, []uint8{1, 2, 1, 0, 1, 3, 2, 1, 0, 1, 2, 1})
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		n    int
+		want []string
+	}{
+		{2, []string{"#ff0000", "#0000ff"}},
+		{5, []string{"#ff0000", "#0000ff", "#00ff00"}},
+	} {
+		got, err := dominantColors(buf.Bytes(), tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("dominantColors(n=%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+
+	if _, err := dominantColors([]byte("not a gif"), 5); err == nil {
+		t.Error("want an error for data that isn't a GIF")
+	}
+}
+
+// solidFrame is a w×h paletted frame at (x, y) filled with c
+func solidFrame(x, y, w, h int, c color.Color) *image.Paletted {
+	frame := image.NewPaletted(image.Rect(x, y, x+w, y+h), color.Palette{color.Transparent, c})
+	for i := range frame.Pix {
+		frame.Pix[i] = 1
+	}
+	return frame
+}
+
+// encodeGIF encodes a w×h animation of frames with the given disposals
+func encodeGIF(t *testing.T, w, h int, frames []*image.Paletted, disposal []byte) []byte {
+	t.Helper()
+	g := &gif.GIF{
+		Image:    frames,
+		Delay:    make([]int, len(frames)),
+		Disposal: disposal,
+		Config:   image.Config{Width: w, Height: h},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompositeFrames(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	green := color.RGBA{G: 255, A: 255}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	data := encodeGIF(t, 4, 4, []*image.Paletted{
+		solidFrame(0, 0, 4, 4, red),
+		solidFrame(0, 0, 2, 2, blue),  // restored away afterwards
+		solidFrame(2, 2, 2, 2, green), // cleared afterwards
+		solidFrame(0, 0, 1, 1, white),
+	}, []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground, gif.DisposalNone})
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ topLeft, bottomRight color.RGBA }{
+		{red, red},
+		{blue, red},
+		{red, green},
+		{white, color.RGBA{}},
+	}
+	visited := 0
+	compositeFrames(g, func(i int, canvas *image.RGBA) {
+		visited++
+		tl, br := canvas.RGBAAt(0, 0), canvas.RGBAAt(3, 3)
+		if tl != want[i].topLeft || br != want[i].bottomRight {
+			t.Errorf("frame %d: corners %v %v, want %v %v", i, tl, br, want[i].topLeft, want[i].bottomRight)
+		}
+	})
+	if visited != len(want) {
+		t.Errorf("visited %d frames, want %d", visited, len(want))
+	}
+}
+
+func TestMotionScore(t *testing.T) {
+	black := color.RGBA{A: 255}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	still := solidFrame(0, 0, 4, 4, black)
+	tests := []struct {
+		name   string
+		frames []*image.Paletted
+		want   float64
+	}{
+		{"single frame", []*image.Paletted{still}, 0},
+		{"still", []*image.Paletted{still, still, still, still}, 0},
+		{"flicker", []*image.Paletted{
+			solidFrame(0, 0, 4, 4, black), solidFrame(0, 0, 4, 4, white),
+			solidFrame(0, 0, 4, 4, black), solidFrame(0, 0, 4, 4, white),
+		}, 1},
+		// A quarter of the pixels flip to white and back
+		{"corner", []*image.Paletted{still, solidFrame(0, 0, 2, 2, white), still}, 0.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := motionScore(encodeGIF(t, 4, 4, tt.frames, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-3 {
+				t.Errorf("motionScore = %g, want %g", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := motionScore([]byte("GIF89a")); err == nil {
+		t.Error("want an error for a truncated GIF")
+	}
+}
+
+// TestRotatingFileRotateFails blocks rotation (path.1 is a non-empty
+// directory) and checks that writes keep landing in the current file
+func TestRotatingFileRotateFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.log")
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.Write([]byte("first line\n")); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	n, err := r.Write([]byte("second line\n"))
+	if err == nil || n != len("second line\n") {
+		t.Errorf("write over maxSize = %d, %v; want it written and the rotate error", n, err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "first line\nsecond line\n" {
+		t.Errorf("log holds %q", data)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("no space left on device") }
+
+// TestLogTeeFallsBack checks that a failing -log-file never stops output:
+// it goes to the console instead, with one warning
+func TestLogTeeFallsBack(t *testing.T) {
+	var console strings.Builder
+	tee := &logTee{file: failingWriter{}, console: &console, failed: new(atomic.Bool)}
+	for _, line := range []string{"one\n", "two\n"} {
+		if n, err := tee.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("Write(%q) = %d, %v", line, n, err)
+		}
+	}
+	out := console.String()
+	if strings.Count(out, "Warning") != 1 || !strings.Contains(out, "one\n") || !strings.Contains(out, "two\n") {
+		t.Errorf("console got %q", out)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.txt")
+	terms := "# moderation terms\nass\n\n  gore  \nkick  in the\tface\nCafé\n"
+	if err := os.WriteFile(path, []byte(terms), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want bool
+	}{
+		// Substrings of longer words don't count
+		{"class clown", false},
+		{"new assets dropped", false},
+		{"bass drop", false},
+		{"gorey", false},
+		// Whole words, at either end or in the middle
+		{"ass", true},
+		{"ass kicked", true},
+		{"what an ass", true},
+		{"pain in the ass!", true},
+		{"(gore)", true},
+		// Phrases match across any whitespace run
+		{"a kick in the face", true},
+		{"kick in\n the   face", true},
+		{"kick in face", false},
+		// Case-insensitive, including non-ASCII
+		{"WHAT AN ASS", true},
+		{"KICK IN THE FACE", true},
+		{"le CAFÉ", true},
+		// Accented letters are word characters: no match inside them
+		{"passé", false},
+		{"assé", false},
+		{"éass", false},
+		{"cafés", false},
+		{"café-au-lait", true},
+		// The comment line is not a term
+		{"moderation terms", false},
+	}
+	for _, tt := range tests {
+		if got := b.Match(tt.text); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+	if !b.Match("fine", "also fine", "gore") {
+		t.Error("Match should check every text")
+	}
+	var none *termBlocklist
+	if none.Match("ass") {
+		t.Error("a nil blocklist should match nothing")
+	}
+}
+
+func TestBlocklistEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.txt")
+	if err := os.WriteFile(path, []byte("# only comments\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBlocklist(path); err == nil {
+		t.Error("want an error for a blocklist with no terms")
+	}
+}
+
+func TestIsConnReset(t *testing.T) {
+	reset := []error{
+		fmt.Errorf("batch: %w", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}),
+		fmt.Errorf("send request: %w", syscall.EPIPE),
+		fmt.Errorf("send request: %w", io.EOF),
+		io.ErrUnexpectedEOF,
+		errors.New(`Post "http://antfly/api/v1/batch": http: server closed idle connection`),
+	}
+	for _, err := range reset {
+		if !isConnReset(err) {
+			t.Errorf("isConnReset(%v) = false, want true", err)
+		}
+	}
+	for _, err := range []error{
+		errors.New("received status 500: boom"),
+		fmt.Errorf("dial: %w", syscall.ECONNREFUSED),
+		context.DeadlineExceeded,
+	} {
+		if isConnReset(err) {
+			t.Errorf("isConnReset(%v) = true, want false", err)
+		}
+	}
+}
+
+// TestRowGate checks the row filters import and -head share
+func TestRowGate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.txt")
+	if err := os.WriteFile(path, []byte("gore\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, &blocklist, b)
+	setFlag(t, maxURLLen, 60)
+	setFlag(t, denyHosts, "spam.example")
+	setFlag(t, canonicalIDs, true)
+
+	variants := &variantSet{ids: make(map[string]bool)}
+	gate := newRowGate(newURLTransformer(""), variants)
+	tests := []struct {
+		fields []string
+		want   rowSkip
+	}{
+		{[]string{"https://64.media.tumblr.com/a/tumblr_mx1abcdefgh_250.gif"}, rowShort},
+		{[]string{"https://example.com/" + strings.Repeat("x", 60) + ".gif", "long"}, rowLongURL},
+		{[]string{"ftp://example.com/a.gif", "ftp"}, rowInvalidURL},
+		{[]string{"https://cdn.spam.example/a.gif", "spam"}, rowHostBlocked},
+		{[]string{"https://example.com/a.gif", "a gore scene"}, rowTermBlocked},
+		{[]string{"https://64.media.tumblr.com/a/tumblr_mx1abcdefgh_250.gif", "a cat"}, rowKept},
+		// Still unclaimed, so another variant goes ahead too
+		{[]string{"https://66.media.tumblr.com/a/tumblr_mx1abcdefgh_500.gif", "a cat"}, rowKept},
+	}
+	for _, tt := range tests {
+		if _, skip := gate.Check(1, tt.fields); skip != tt.want {
+			t.Errorf("Check(%q) = %d, want %d", tt.fields, skip, tt.want)
+		}
+	}
+
+	row, _ := gate.Check(1, []string{"https://64.media.tumblr.com/a/tumblr_mx1abcdefgh_250.gif", "a cat"})
+	if !row.canonical || !variants.Claim(row.docID) {
+		t.Fatalf("first variant %+v wasn't claimable", row)
+	}
+	if _, skip := gate.Check(1, []string{"https://66.media.tumblr.com/a/tumblr_mx1abcdefgh_400.gif", "a cat"}); skip != rowMerged {
+		t.Errorf("variant after a claim = %d, want rowMerged", skip)
+	}
+}
+
+// TestDeadLetterSeq checks -preserve-order's seq survives a failed insert
+// into the -dead-letter file
+func TestDeadLetterSeq(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	setFlag(t, deadLetter, path)
+
+	batch := newDocBatch()
+	batch.Add("gif_a", map[string]any{"gif_url": "https://example.com/a.gif", "seq": 0})
+	batch.Add("gif_b", map[string]any{"gif_url": "https://example.com/b.gif", "seq": float64(41)})
+	batch.Add("gif_c", map[string]any{"gif_url": "https://example.com/c.gif"})
+	writeDeadLetters(batch, errors.New("insert failed"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*int{"gif_a": new(int), "gif_b": new(int), "gif_c": nil}
+	*want["gif_b"] = 41
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec deadLetterRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		w := want[rec.ID]
+		if (w == nil) != (rec.Seq == nil) || (w != nil && *w != *rec.Seq) {
+			t.Errorf("%s: seq = %v, want %v", rec.ID, rec.Seq, w)
+		}
+	}
+}
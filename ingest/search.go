@@ -0,0 +1,2244 @@
+// TGIF GIF Picker - Search Script
+// Queries the text embeddings table built by ingest_text.go
+//
+// Runs a hybrid query: a semantic search against the "embeddings" vector
+// index plus a BM25 full-text search against combined_text, then fuses the
+// two ranked lists client-side with weighted Reciprocal Rank Fusion. Antfly's
+// built-in RRF merge has no weights, so we issue both queries ourselves.
+//
+// Prerequisites:
+// - Antfly running: antfly swarm
+// - Table populated by ingest_text.go
+//
+// Run: go run search.go -q "happy dance"
+//
+// Steer away from a cluster: rerank the fused candidates client-side by
+// cos(query) - λ·cos(negative) against their stored embeddings
+//   go run search.go -q "happy dancing" -negative "cartoon" -negative-weight 0.5
+//
+// Mood board: blend several prompts (weighted) into one query vector
+//   go run search.go -q "cozy:2" -q "autumn:1" -q "reading"
+//
+// Non-English queries go to the multilingual index when the table has one:
+//   go run search.go -q "gato bailando feliz" -multilingual
+//
+// Two-stage: rerank the top candidates with a cross-encoder
+//   go run search.go -q "awkward silence" -reranker-url http://localhost:8081/rerank -rerank-top 30
+//
+// A corpus split across tables, searched as one (concurrently, merged):
+//   go run search.go -q "facepalm" -tables tgif_2023,tgif_2024,reactions
+//
+// Surprise me: one relevant-but-varied GIF from the top 10
+//   go run search.go -q "celebrate" -pick-random -temperature 0.2
+//
+// Slang expansion: "lol" embeds as "lol laughing funny hilarious". A
+// -synonyms file adds to (or overrides) the built-in dictionary:
+//   go run search.go -q "lol" -expand -synonyms synonyms.txt
+//
+// Indexes without a server-side embedder (ingest_text.go -client-embed,
+// main.go -models) need the query embedded here, with the index's model:
+//   go run search.go -q "happy dance" -client-embed
+//   go run search.go -q "happy dance" -index siglip -client-embed -embed-model google/siglip-base-patch16-224
+//
+// More like this: nearest neighbours of a doc's stored vector
+//   go run search.go -similar-to gif_0123456789abcdef
+//
+// Zero-downtime reindex: build a new table, then repoint the alias that
+// search and serve query (a running server picks it up within -alias-refresh)
+//   go run search.go promote -alias gifs -table tgif_gifs_text_v2
+//   go run search.go serve -alias gifs
+//
+// Moderation: delete every doc matching a Bleve query-string filter
+//   go run search.go prune -filter 'mood:violent' -dry-run
+//
+// Serve mode exposes the picker over HTTP:
+//   go run search.go serve -addr :8090
+//   GET /pick?q=...&n=5          JSON results
+//   GET /pick/stream?q=...&n=5   Server-Sent Events: a "partial" event as
+//                                each retriever answers, then "results"
+//   POST /cache/purge            drop -cache-size's cached results (loopback
+//                                only, or "Authorization: Bearer <-purge-token>")
+//   POST /slack                  Slack slash command (needs -slack-secret):
+//                                "/gif happy dance" posts the top GIF,
+//                                "/gif shuffle happy dance" one of the top few
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/antflydb/antfly-go/antfly"
+	"github.com/antflydb/antfly-go/antfly/query"
+)
+
+var (
+	antflyURL    = flag.String("url", "http://localhost:8080/api/v1", "Antfly API URL")
+	tableName    = flag.String("table", "tgif_gifs_text", "Antfly table name")
+	tables       = flag.String("tables", "", "Comma-separated tables to search concurrently, merged by fused score into one ranking and deduplicated by docID and URL (overrides -table)")
+	queries      = queryFlag("q", "Search query; repeat to blend several into one vector, optionally weighted: -q \"cozy:2\" -q \"autumn:1\" (or cozy^2)")
+	limit        = flag.Int("limit", 10, "Number of results to return")
+	offset       = flag.Int("offset", 0, "Skip this many fused results (for paging: -offset 10 -limit 10 is page 2)")
+	candidates   = flag.Int("candidates", 50, "Candidates fetched from each retriever before fusion")
+	vectorWeight = flag.Float64("vector-weight", 1.0, "Fusion weight for semantic (vector) results (0 = disable)")
+	textWeight   = flag.Float64("text-weight", 1.0, "Fusion weight for full-text (BM25) results (0 = disable)")
+	rrfK         = flag.Float64("rrf-k", 60, "RRF rank constant (higher flattens rank differences)")
+	exportCSV    = flag.String("export-csv", "", "Write results with attribution to this CSV file")
+	htmlOut      = flag.String("html", "", "Write the results as a static HTML contact sheet (GIF grid with descriptions and scores) to this file")
+	attribution  = flag.String("attribution", "", "Default attribution for docs missing one (e.g., 'TGIF dataset')")
+	termiteURL   = flag.String("termite-url", "http://localhost:11433", "Termite API URL (for -verify-scores and -negative)")
+	embedModel   = flag.String("embed-model", "BAAI/bge-small-en-v1.5", "Text embedding model the table was built with")
+	clientEmbed  = flag.Bool("client-embed", false, "Embed queries here via Termite with -embed-model (-multilingual-model for the multilingual index) and send the vectors, for indexes without a server-side embedder (ingest_text.go -client-embed, main.go -models)")
+	verifyChecks = flag.Bool("verify-checksums", false, "Recompute each result's stored-vector CRC32 and compare with its embed_checksum (tables built with main.go -store-checksum)")
+	verifyScores = flag.Bool("verify-scores", false, "Recompute cosine similarity against each result's stored embedding")
+	dataset      = flag.String("dataset", "", "Only return docs ingested with this -dataset tag")
+	similarTo    = flag.String("similar-to", "", "Instead of -q, return the nearest neighbours of this docID's stored embedding")
+	expand       = flag.Bool("expand", false, "Expand slang/meme terms in the query before the semantic search")
+	synonymsFile = flag.String("synonyms", "", "Extra synonyms for -expand, one 'term: syn, syn' per line")
+	blockFile    = flag.String("blocklist", "", "Drop results whose description fields or tags contain any term in this file (the importers' -blocklist format)")
+	negative     = flag.String("negative", "", "Rerank candidates away from this text (e.g., 'cartoon')")
+	multilingual = flag.Bool("multilingual", false, "Send non-English queries to the 'embeddings_multilingual' index (built with ingest_text.go -multilingual-model)")
+	queryLang    = flag.String("lang", "", "Query language (ISO 639-1) for -multilingual; detected from the query when empty")
+	multiModel   = flag.String("multilingual-model", "sentence-transformers/paraphrase-multilingual-MiniLM-L12-v2", "Model of the 'embeddings_multilingual' index (ingest_text.go -multilingual-model), for blending several -q with -multilingual")
+	lastFrame    = flag.Bool("last-frame", false, "Also search the 'embeddings_last' index (built with main.go -frames first-last) so either frame can match")
+	vectorIndex  = flag.String("index", "embeddings", "Vector index to query, e.g. one of main.go -models' indexes (with -client-embed and -embed-model set to its model)")
+	pickRandom   = flag.Bool("pick-random", false, "Return one GIF sampled from the top -limit, weighted by score (\"surprise me\")")
+	temperature  = flag.Float64("temperature", 0.1, "Softmax temperature for -pick-random over top-relative scores (lower = closer to always top-1)")
+	queryLog     = flag.String("query-log", "", "Append each query, its parameters and the returned IDs+scores to this JSONL (an evaluation set)")
+	negWeight    = flag.Float64("negative-weight", 0.5, "λ in cos(query) - λ·cos(negative) for -negative")
+	rerankerURL  = flag.String("reranker-url", "", "Cross-encoder /rerank endpoint (text-embeddings-inference style); reorders the top -rerank-top candidates by query-description score")
+	rerankTop    = flag.Int("rerank-top", 20, "How many top candidates -reranker-url scores (each costs a cross-encoder pass)")
+
+	antflyHeaders  = headerFlag("antfly-header", "Header sent with every Antfly request, as key=value (repeatable)")
+	termiteHeaders = headerFlag("termite-header", "Header sent with every Termite request, as key=value (repeatable; e.g., for an auth gateway)")
+	rerankHeaders  = headerFlag("reranker-header", "Header sent with every -reranker-url request, as key=value (repeatable)")
+
+	alias        = flag.String("alias", "", "Query the table this alias points at instead of -table (see promote)")
+	aliasTable   = flag.String("alias-table", "gif_picker_aliases", "Table holding alias pointer docs")
+	aliasRefresh = flag.Duration("alias-refresh", 30*time.Second, "serve: how often to re-read -alias, so a promote takes effect without a restart (0 = resolve it once at startup)")
+
+	pruneFilter = flag.String("filter", "", "prune: Bleve query string selecting docs to delete (e.g., 'mood:violent')")
+	dryRun      = flag.Bool("dry-run", false, "prune: report matches without deleting")
+	batchSize   = flag.Int("batch", 100, "prune: IDs fetched and deleted per request")
+
+	serveAddr   = flag.String("addr", ":8090", "serve: listen address")
+	slackSecret = flag.String("slack-secret", "", "serve: Slack signing secret; enables POST /slack for a slash command")
+	maxStreams  = flag.Int("max-streams", 32, "serve: max concurrent /pick/stream connections")
+	cacheSize   = flag.Int("cache-size", 0, "serve: cache fused results of this many distinct queries in memory, least recently used out first (0 = off)")
+	cacheTTL    = flag.Duration("cache-ttl", 5*time.Minute, "serve: how long a -cache-size entry is served before the query runs again")
+	purgeToken  = flag.String("purge-token", "", "serve: bearer token that lets non-loopback clients POST /cache/purge (default: loopback only)")
+)
+
+// httpClient with timeout for Termite requests
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
+// antflyHTTPClient carries -antfly-header when set
+var antflyHTTPClient = http.DefaultClient
+
+// headers, headerFlag and headerTransport are main.go's -*-header flags
+type headers http.Header
+
+func headerFlag(name, usage string) *headers {
+	h := headers{}
+	flag.Var(&h, name, usage)
+	return &h
+}
+
+func (h *headers) String() string {
+	if h == nil {
+		return ""
+	}
+	var pairs []string
+	for key, values := range *h {
+		for _, v := range values {
+			pairs = append(pairs, key+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (h *headers) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	if key = strings.TrimSpace(key); !ok || key == "" {
+		return fmt.Errorf("want key=value, got %q", value)
+	}
+	http.Header(*h).Add(key, v)
+	return nil
+}
+
+func (h *headers) apply(dst http.Header) {
+	for key, values := range *h {
+		dst[http.CanonicalHeaderKey(key)] = values
+	}
+}
+
+type headerTransport struct {
+	base    http.RoundTripper
+	headers headers
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	t.headers.apply(req.Header)
+	return t.base.RoundTrip(req)
+}
+
+// tumblrIDRegex extracts the tumblr ID from a GIF URL
+var tumblrIDRegex = regexp.MustCompile(`tumblr_([a-zA-Z0-9]+)`)
+
+// searchHit is a fused result with the rank it held in each retriever (0 = absent)
+type searchHit struct {
+	ID          string
+	Score       float64
+	VectorRank  int
+	TextRank    int
+	VectorScore float64 // Antfly's own score from the semantic query
+	Cosine      float64 // client-side cosine, set by -verify-scores
+	Verified    bool
+	NegCosine   float64 // cosine to the -negative text, set when steering
+	Steered     bool
+	RerankScore float64 // cross-encoder score, set by -reranker-url
+	Reranked    bool
+	Rank        int    // 1-based position in the full fused ranking
+	Table       string // table the hit came from, with -tables
+	Source      map[string]any
+}
+
+func main() {
+	// Optional subcommand ahead of the flags: prune | serve | promote
+	command := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.Parse()
+	ctx := context.Background()
+
+	if *offset < 0 || *limit < 1 {
+		log.Fatal("-offset must be >= 0 and -limit >= 1")
+	}
+	if *aliasRefresh < 0 {
+		log.Fatal("-alias-refresh must be >= 0")
+	}
+	if len(*antflyHeaders) > 0 {
+		antflyHTTPClient = &http.Client{Transport: &headerTransport{base: http.DefaultTransport, headers: *antflyHeaders}}
+	}
+
+	if *queryLog != "" {
+		if err := openQueryLog(*queryLog); err != nil {
+			log.Fatalf("Failed to open query log: %v", err)
+		}
+		defer closeQueryLog()
+	}
+
+	if *synonymsFile != "" {
+		if err := loadSynonyms(*synonymsFile); err != nil {
+			log.Fatalf("Failed to load synonyms: %v", err)
+		}
+	}
+
+	if *blockFile != "" {
+		b, err := loadBlocklist(*blockFile)
+		if err != nil {
+			log.Fatalf("Failed to load blocklist: %v", err)
+		}
+		blocklist = b
+	}
+
+	if *alias != "" && command != "promote" {
+		client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
+		if err != nil {
+			log.Fatalf("Failed to create client: %v", err)
+		}
+		target, err := resolveAlias(ctx, client)
+		if err != nil {
+			log.Fatalf("Failed to resolve alias: %v", err)
+		}
+		currentTable.Store(&target)
+	}
+
+	switch command {
+	case "":
+	case "promote":
+		client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
+		if err != nil {
+			log.Fatalf("Failed to create client: %v", err)
+		}
+		if err := promote(ctx, client); err != nil {
+			log.Fatalf("Promote failed: %v", err)
+		}
+		return
+	case "prune":
+		client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
+		if err != nil {
+			log.Fatalf("Failed to create client: %v", err)
+		}
+		if err := prune(ctx, client); err != nil {
+			log.Fatalf("Prune failed: %v", err)
+		}
+		return
+	case "serve":
+		client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
+		if err != nil {
+			log.Fatalf("Failed to create client: %v", err)
+		}
+		if err := checkEmbedders(ctx, client); err != nil {
+			log.Fatal(err)
+		}
+		if err := serve(client); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %q (want prune, serve or promote)", command)
+	}
+
+	if *similarTo != "" {
+		if *tables != "" {
+			log.Printf("Warning: -similar-to searches '%s' only; -tables is ignored", table())
+		}
+		client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
+		if err != nil {
+			log.Fatalf("Failed to create client: %v", err)
+		}
+		hits, err := similarSearch(ctx, client, *similarTo)
+		if err != nil {
+			log.Fatalf("Similar search failed: %v", err)
+		}
+		printHits(page(hits, *offset, *limit))
+		return
+	}
+
+	if len(*queries) == 0 {
+		log.Fatal("Missing -q query")
+	}
+	queryText := queries.Text()
+	if *vectorWeight <= 0 && *textWeight <= 0 {
+		log.Fatal("At least one of -vector-weight or -text-weight must be positive")
+	}
+
+	// Create client
+	client, err := antfly.NewAntflyClient(*antflyURL, antflyHTTPClient)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+
+	if err := checkEmbedders(ctx, client); err != nil {
+		log.Fatal(err)
+	}
+	if expanded := expandQuery(queryText); expanded != queryText {
+		fmt.Printf("Expanded query: %s\n", expanded)
+	}
+	hits, err := searchTables(ctx, func(ctx context.Context) ([]antfly.Hit, []antfly.Hit, error) {
+		if len(*queries) > 1 {
+			return blendedRetrieve(ctx, client, *queries)
+		}
+		return hybridRetrieve(ctx, client, queryText)
+	})
+	if err != nil {
+		log.Fatalf("Search failed: %v", err)
+	}
+	if *negative != "" {
+		hits, err = steerAway(ctx, client, queryText, *negative, hits)
+		if err != nil {
+			log.Fatalf("Failed to apply -negative: %v", err)
+		}
+	}
+	if *rerankerURL != "" {
+		hits, err = rerank(ctx, queryText, hits)
+		if err != nil {
+			log.Fatalf("Rerank failed: %v", err)
+		}
+	}
+	hits = page(hits, *offset, *limit)
+	if *pickRandom && len(hits) > 0 {
+		hits = []searchHit{sampleHit(hits, *temperature)}
+	}
+
+	if *verifyChecks {
+		verifyChecksums(ctx, client, hits)
+	}
+	if *verifyScores {
+		if err := verifyHits(ctx, client, queryText, hits); err != nil {
+			log.Fatalf("Failed to verify scores: %v", err)
+		}
+	}
+
+	printHits(hits)
+	logQuery("cli", queryText, hits)
+
+	if *exportCSV != "" {
+		if err := writeCSV(*exportCSV, hits); err != nil {
+			log.Fatalf("Failed to export CSV: %v", err)
+		}
+		fmt.Printf("Wrote %d results to %s\n", len(hits), *exportCSV)
+	}
+	if *htmlOut != "" {
+		if err := writeHTML(*htmlOut, queryText, hits); err != nil {
+			log.Fatalf("Failed to write HTML: %v", err)
+		}
+		fmt.Printf("Wrote %d results to %s\n", len(hits), *htmlOut)
+	}
+}
+
+// currentTable is the table -alias resolved to; serve swaps it on a promote
+var currentTable atomic.Pointer[string]
+
+// table is the table to query: the alias target if -alias is set, else -table
+func table() string {
+	if t := currentTable.Load(); t != nil {
+		return *t
+	}
+	return *tableName
+}
+
+// tableKey carries a per-call table override in a context
+type tableKey struct{}
+
+// withTable points the queries and lookups made with ctx at name, so
+// -tables can search several tables at once; "" leaves ctx alone
+func withTable(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tableKey{}, name)
+}
+
+// tableFor is the table a call with ctx should use: withTable's, else table()
+func tableFor(ctx context.Context) string {
+	if t, ok := ctx.Value(tableKey{}).(string); ok {
+		return t
+	}
+	return table()
+}
+
+// tableList is -tables split into names
+func tableList() []string {
+	var names []string
+	for _, t := range strings.Split(*tables, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			names = append(names, t)
+		}
+	}
+	return names
+}
+
+// retriever fetches the vector and full-text candidates for one table
+type retriever func(ctx context.Context) (vectorHits, textHits []antfly.Hit, err error)
+
+// searchTables runs retrieve once per -tables entry, concurrently, and
+// fuses the results as if they came from one table: each retriever's lists
+// are merged by raw score, then ranked once by fuseRRF. (Per-table fused
+// scores only encode ranks, so merging those would interleave the tables.)
+// A GIF stored in more than one table (same docID or URL) keeps only its
+// best hit. A failing table is skipped with a warning unless every table
+// fails.
+func searchTables(ctx context.Context, retrieve retriever) ([]searchHit, error) {
+	names := tableList()
+	vectorLists, textLists, err := retrieveTables(ctx, names, retrieve)
+	if err != nil {
+		return nil, err
+	}
+	return fuseTables(names, vectorLists, textLists), nil
+}
+
+// retrieveTables is searchTables' fan-out: one list per table from each
+// retriever, or a single pair from the default table when names is empty
+func retrieveTables(ctx context.Context, names []string, retrieve retriever) (vectorLists, textLists [][]antfly.Hit, err error) {
+	if len(names) == 0 {
+		vectorHits, textHits, err := retrieve(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return [][]antfly.Hit{vectorHits}, [][]antfly.Hit{textHits}, nil
+	}
+
+	vectorLists = make([][]antfly.Hit, len(names))
+	textLists = make([][]antfly.Hit, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vectorLists[i], textLists[i], errs[i] = retrieve(withTable(ctx, name))
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, name := range names {
+		if errs[i] != nil {
+			log.Printf("Warning: search of '%s' failed: %v", name, errs[i])
+			vectorLists[i], textLists[i] = nil, nil
+			failed++
+		}
+	}
+	if failed == len(names) {
+		return nil, nil, fmt.Errorf("every table failed, last: %w", errs[len(errs)-1])
+	}
+	return vectorLists, textLists, nil
+}
+
+// fuseTables is searchTables' ranking of retrieveTables' lists. A list
+// still missing (a streamed retriever that hasn't answered) counts as empty.
+func fuseTables(names []string, vectorLists, textLists [][]antfly.Hit) []searchHit {
+	if len(names) == 0 {
+		var vectorHits, textHits []antfly.Hit
+		if len(vectorLists) > 0 {
+			vectorHits = vectorLists[0]
+		}
+		if len(textLists) > 0 {
+			textHits = textLists[0]
+		}
+		return fuseRRF(vectorHits, textHits)
+	}
+
+	tableOf := make(map[string]string)
+	fused := fuseRRF(mergeHits(vectorLists, names, tableOf), mergeHits(textLists, names, tableOf))
+	seenURLs := make(map[string]bool)
+	merged := make([]searchHit, 0, len(fused))
+	for _, h := range fused {
+		url := stringField(h.Source, "gif_url")
+		if url != "" && seenURLs[url] {
+			continue
+		}
+		if url != "" {
+			seenURLs[url] = true
+		}
+		h.Table = tableOf[h.ID]
+		h.Rank = len(merged) + 1
+		merged = append(merged, h)
+	}
+	return merged
+}
+
+// mergeHits joins one retriever's per-table lists into a single list by
+// raw score, keeping each docID or URL once, at its best score. tableOf
+// records the table each kept docID came from.
+func mergeHits(lists [][]antfly.Hit, names []string, tableOf map[string]string) []antfly.Hit {
+	type tableHit struct {
+		antfly.Hit
+		table string
+	}
+	var all []tableHit
+	for i, hits := range lists {
+		for _, h := range hits {
+			all = append(all, tableHit{h, names[i]})
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Score > all[j].Score
+	})
+	seenIDs := make(map[string]bool)
+	seenURLs := make(map[string]bool)
+	var merged []antfly.Hit
+	for _, h := range all {
+		url := stringField(h.Source, "gif_url")
+		if seenIDs[h.ID] || (url != "" && seenURLs[url]) {
+			continue
+		}
+		seenIDs[h.ID] = true
+		if url != "" {
+			seenURLs[url] = true
+		}
+		if _, ok := tableOf[h.ID]; !ok {
+			tableOf[h.ID] = h.table
+		}
+		merged = append(merged, h.Hit)
+	}
+	return merged
+}
+
+// resolveAlias reads the alias pointer doc. Antfly has no native table
+// aliases, so an alias is a doc keyed by its name in -alias-table.
+func resolveAlias(ctx context.Context, client *antfly.AntflyClient) (string, error) {
+	doc, err := client.LookupKey(ctx, *aliasTable, *alias)
+	if err != nil {
+		return "", fmt.Errorf("look up alias %q in '%s': %w", *alias, *aliasTable, err)
+	}
+	target := stringField(doc, "table")
+	if target == "" {
+		return "", fmt.Errorf("alias %q has no table", *alias)
+	}
+	return target, nil
+}
+
+// watchAlias re-reads -alias every -alias-refresh and switches tables
+// between requests, so promote is zero-downtime for a running server
+func watchAlias(client *antfly.AntflyClient) {
+	for range time.Tick(*aliasRefresh) {
+		target, err := resolveAlias(context.Background(), client)
+		if err != nil {
+			log.Printf("Warning: keeping '%s': %v", table(), err)
+			continue
+		}
+		if target != table() {
+			log.Printf("Alias %q now points at '%s' (was '%s')", *alias, target, table())
+			currentTable.Store(&target)
+		}
+	}
+}
+
+// promote points -alias at -table once -table is serving queries
+func promote(ctx context.Context, client *antfly.AntflyClient) error {
+	if *alias == "" {
+		return fmt.Errorf("promote needs -alias")
+	}
+	if _, err := client.Query(ctx, antfly.QueryRequest{Table: *tableName, Limit: 1}); err != nil {
+		return fmt.Errorf("table '%s' isn't queryable, not promoting: %w", *tableName, err)
+	}
+
+	// First promote creates the pointer table
+	err := client.CreateTable(ctx, *aliasTable, antfly.CreateTableRequest{})
+	switch {
+	case err == nil:
+		if err := waitForShards(ctx, client, *aliasTable, 30*time.Second); err != nil {
+			return fmt.Errorf("alias table: %w", err)
+		}
+	case !strings.Contains(err.Error(), "already exists"):
+		return fmt.Errorf("create alias table: %w", err)
+	}
+
+	previous, _ := resolveAlias(ctx, client)
+	_, err = client.Batch(ctx, *aliasTable, antfly.BatchRequest{
+		Inserts: map[string]any{
+			*alias: map[string]any{"table": *tableName, "promoted_at": time.Now().UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("write alias: %w", err)
+	}
+	if previous == "" {
+		fmt.Printf("Alias %q -> '%s'\n", *alias, *tableName)
+	} else {
+		fmt.Printf("Alias %q -> '%s' (was '%s')\n", *alias, *tableName, previous)
+	}
+	return nil
+}
+
+// waitForShards is the importers' wait for a new table's shards, so the
+// first write doesn't race shard startup
+func waitForShards(ctx context.Context, client *antfly.AntflyClient, table string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	pollCount := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			pollCount++
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timeout waiting for shards")
+			}
+			status, err := client.GetTable(ctx, table)
+			if err != nil {
+				continue
+			}
+			if len(status.Shards) > 0 && pollCount >= 6 {
+				return nil
+			}
+		}
+	}
+}
+
+// hybridRetrieve runs the semantic and full-text queries, for fuseRRF
+func hybridRetrieve(ctx context.Context, client *antfly.AntflyClient, text string) (vectorHits, textHits []antfly.Hit, err error) {
+	if *vectorWeight > 0 {
+		if vectorHits, err = semanticQuery(ctx, client, text); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *textWeight > 0 {
+		if textHits, err = fullTextQuery(ctx, client, text); err != nil {
+			return nil, nil, err
+		}
+	}
+	return vectorHits, textHits, nil
+}
+
+// weightedQuery is one -q term and its share of a blend
+type weightedQuery struct {
+	text   string
+	weight float64
+}
+
+// queryList is the repeatable -q flag. A trailing ":<number>" or
+// "^<number>" sets a term's weight (default 1). The colon only counts after
+// a non-digit, so "aspect 16:9" stays plain text.
+type queryList []weightedQuery
+
+func queryFlag(name, usage string) *queryList {
+	q := &queryList{}
+	flag.Var(q, name, usage)
+	return q
+}
+
+func (q *queryList) String() string {
+	if q == nil {
+		return ""
+	}
+	return q.Text()
+}
+
+func (q *queryList) Set(value string) error {
+	wq := weightedQuery{text: value, weight: 1}
+	i := strings.LastIndex(value, "^")
+	if c := strings.LastIndex(value, ":"); c > i && (c == 0 || value[c-1] < '0' || value[c-1] > '9') {
+		i = c
+	}
+	if i >= 0 {
+		if w, err := strconv.ParseFloat(value[i+1:], 64); err == nil {
+			if w <= 0 {
+				return fmt.Errorf("weight must be positive, got %q", value)
+			}
+			wq = weightedQuery{text: value[:i], weight: w}
+		}
+	}
+	if wq.text = strings.TrimSpace(wq.text); wq.text == "" {
+		return fmt.Errorf("empty query %q", value)
+	}
+	*q = append(*q, wq)
+	return nil
+}
+
+// Text joins the terms, for display, logging and the full-text retriever
+func (q queryList) Text() string {
+	texts := make([]string, len(q))
+	for i, wq := range q {
+		texts[i] = wq.text
+	}
+	return strings.Join(texts, " ")
+}
+
+// blendedRetrieve embeds each -q term, averages the L2-normalized vectors
+// by weight and searches with the blend, so results match the mix rather
+// than any single term. The full-text retriever gets all the terms at once.
+func blendedRetrieve(ctx context.Context, client *antfly.AntflyClient, qs queryList) (vectorHits, textHits []antfly.Hit, err error) {
+	if *vectorWeight > 0 {
+		// Each index gets the blend in its own model's space
+		indexes := semanticIndexes(qs.Text())
+		embeddings := make(map[string][]float32, len(indexes))
+		for _, index := range indexes {
+			blend, err := blendVector(ctx, indexModel(index), qs)
+			if err != nil {
+				return nil, nil, err
+			}
+			embeddings[index] = blend
+		}
+		vectorHits, err = runQuery(ctx, client, antfly.QueryRequest{
+			Table:   tableFor(ctx),
+			Indexes: indexes,
+			// The SDK wants text with indexes; the blend vectors take precedence
+			SemanticSearch: qs.Text(),
+			Embeddings:     embeddings,
+			FilterQuery:    datasetFilter(),
+			Limit:          window(),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("blended vector query: %w", err)
+		}
+	}
+	if *textWeight > 0 {
+		if textHits, err = fullTextQuery(ctx, client, qs.Text()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return vectorHits, textHits, nil
+}
+
+// blendVector is the weighted mean of the terms' normalized embeddings
+// under model
+func blendVector(ctx context.Context, model string, qs queryList) ([]float32, error) {
+	var blend []float32
+	var total float64
+	for _, wq := range qs {
+		vec, err := embedText(ctx, model, expandQuery(wq.text))
+		if err != nil {
+			return nil, fmt.Errorf("embed %q: %w", wq.text, err)
+		}
+		if blend == nil {
+			blend = make([]float32, len(vec))
+		}
+		if len(vec) != len(blend) {
+			return nil, fmt.Errorf("embed %q: dimension %d, want %d", wq.text, len(vec), len(blend))
+		}
+		norm := 0.0
+		for _, x := range vec {
+			norm += float64(x) * float64(x)
+		}
+		if norm == 0 {
+			continue
+		}
+		scale := wq.weight / math.Sqrt(norm)
+		for i, x := range vec {
+			blend[i] += float32(float64(x) * scale)
+		}
+		total += wq.weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("every query embedded to a zero vector")
+	}
+	for i := range blend {
+		blend[i] /= float32(total)
+	}
+	return blend, nil
+}
+
+// semanticQuery fetches the vector retriever's candidates
+func semanticQuery(ctx context.Context, client *antfly.AntflyClient, text string) ([]antfly.Hit, error) {
+	indexes := semanticIndexes(text)
+	var embeddings map[string][]float32
+	if *clientEmbed {
+		embeddings = make(map[string][]float32, len(indexes))
+		for _, index := range indexes {
+			vec, err := embedText(ctx, indexModel(index), expandQuery(text))
+			if err != nil {
+				return nil, fmt.Errorf("embed query: %w", err)
+			}
+			embeddings[index] = vec
+		}
+	}
+	hits, err := runQuery(ctx, client, antfly.QueryRequest{
+		Table:          tableFor(ctx),
+		SemanticSearch: expandQuery(text),
+		Indexes:        indexes,
+		Embeddings:     embeddings,
+		FilterQuery:    datasetFilter(),
+		Limit:          window(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("semantic query: %w", err)
+	}
+	return hits, nil
+}
+
+// indexModel is the model whose vectors fill index, for embedding queries
+// client-side
+func indexModel(index string) string {
+	if index == "embeddings_multilingual" {
+		return *multiModel
+	}
+	return *embedModel
+}
+
+// checkEmbedders fails when the queried index has no server-side embedder
+// and -client-embed is off: Antfly would have nothing to embed the query
+// text with
+func checkEmbedders(ctx context.Context, client *antfly.AntflyClient) error {
+	if *clientEmbed || *vectorWeight <= 0 {
+		return nil
+	}
+	names := tableList()
+	if len(names) == 0 {
+		names = []string{table()}
+	}
+	for _, name := range names {
+		status, err := client.GetTable(ctx, name)
+		if err != nil {
+			return fmt.Errorf("get table '%s': %w", name, err)
+		}
+		index, ok := status.Indexes[*vectorIndex]
+		if !ok {
+			return fmt.Errorf("table '%s' has no index %q", name, *vectorIndex)
+		}
+		config, err := index.AsEmbeddingIndexConfig()
+		if err != nil {
+			return fmt.Errorf("read index %q of '%s': %w", *vectorIndex, name, err)
+		}
+		if config.Embedder.Provider == "" {
+			return fmt.Errorf("index %q of '%s' has no server-side embedder (built with ingest_text.go -client-embed or main.go -models); rerun with -client-embed and -embed-model set to the index's model", *vectorIndex, name)
+		}
+	}
+	return nil
+}
+
+// semanticIndexes adds the last-frame index to semanticIndex's pick; Antfly
+// fuses the two result lists, so a GIF matches on either frame
+func semanticIndexes(text string) []string {
+	index := semanticIndex(text)
+	if *lastFrame && index == *vectorIndex {
+		return []string{index, *vectorIndex + "_last"}
+	}
+	return []string{index}
+}
+
+// semanticIndex picks the vector index whose model matches the query's
+// language, so the query is embedded by the same model as its documents
+func semanticIndex(text string) string {
+	if !*multilingual {
+		return *vectorIndex
+	}
+	english := looksEnglish(text)
+	if *queryLang != "" {
+		english = strings.HasPrefix(strings.ToLower(*queryLang), "en")
+	}
+	if english {
+		return *vectorIndex
+	}
+	return "embeddings_multilingual"
+}
+
+// englishStopwords and looksEnglish must match ingest_text.go, which used
+// them to decide which index each doc's caption went into
+var englishStopwords = map[string]bool{
+	"the": true, "a": true, "an": true, "and": true, "of": true, "to": true,
+	"in": true, "is": true, "on": true, "with": true, "at": true, "his": true,
+	"her": true, "their": true, "it": true, "while": true, "into": true,
+}
+
+func looksEnglish(text string) bool {
+	letters, ascii := 0, 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if r < unicode.MaxASCII {
+				ascii++
+			}
+		}
+	}
+	if letters == 0 {
+		return true
+	}
+	if float64(ascii) < 0.8*float64(letters) {
+		return false
+	}
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) < 4 {
+		return true
+	}
+	for _, w := range words {
+		if englishStopwords[strings.Trim(w, ".,!?;:")] {
+			return true
+		}
+	}
+	return false
+}
+
+// synonyms maps slang and meme shorthand to words the text embedder
+// places near the descriptions we store. -synonyms extends it.
+var synonyms = map[string][]string{
+	"lol":      {"laughing", "funny", "hilarious"},
+	"lmao":     {"laughing hard", "hilarious"},
+	"rofl":     {"laughing hard", "rolling on the floor"},
+	"omg":      {"shocked", "surprised"},
+	"wtf":      {"confused", "shocked"},
+	"smh":      {"disappointed", "shaking head"},
+	"idk":      {"shrug", "unsure"},
+	"facepalm": {"embarrassed", "frustrated"},
+	"yas":      {"excited", "celebrating"},
+	"hype":     {"excited", "celebrating"},
+	"gg":       {"good game", "congratulations"},
+	"ty":       {"thank you", "grateful"},
+	"thx":      {"thank you", "grateful"},
+	"rip":      {"sad", "mourning"},
+	"fml":      {"frustrated", "bad day"},
+	"nope":     {"refusing", "saying no"},
+	"bae":      {"love", "affection"},
+	"mood":     {"relatable", "feeling"},
+}
+
+// blocklist is the loaded -blocklist, nil without one
+var blocklist *termBlocklist
+
+// termBlocklist and loadBlocklist are main.go's -blocklist matcher, copied
+// since each program is one file; change them together
+type termBlocklist struct {
+	re *regexp.Regexp
+}
+
+func loadBlocklist(path string) (*termBlocklist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read blocklist: %w", err)
+	}
+	var terms []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words := strings.Fields(line)
+		for i, w := range words {
+			words[i] = regexp.QuoteMeta(w)
+		}
+		terms = append(terms, strings.Join(words, `\s+`))
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("blocklist %s has no terms", path)
+	}
+	re, err := regexp.Compile(`(?i)(?:^|[^\pL\pN_])(?:` + strings.Join(terms, "|") + `)(?:$|[^\pL\pN_])`)
+	if err != nil {
+		return nil, fmt.Errorf("compile blocklist: %w", err)
+	}
+	return &termBlocklist{re: re}, nil
+}
+
+// moderatedFields are the doc fields -blocklist checks: main.go's
+// description plus ingest_text.go's description fields and tags
+var moderatedFields = []string{"description", "original_description", "literal", "source", "mood", "action", "context", "tags", "combined_text"}
+
+// MatchDoc reports whether a doc's text fields contain a blocked term; a
+// nil blocklist matches nothing
+func (b *termBlocklist) MatchDoc(doc map[string]any) bool {
+	if b == nil {
+		return false
+	}
+	for _, field := range moderatedFields {
+		switch v := doc[field].(type) {
+		case string:
+			if b.re.MatchString(v) {
+				return true
+			}
+		case []any:
+			for _, item := range v {
+				if s, ok := item.(string); ok && b.re.MatchString(s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// loadSynonyms merges "term: syn, syn" lines into the dictionary
+func loadSynonyms(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read synonyms: %w", err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		term, list, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("%s:%d: want 'term: syn, syn'", path, i+1)
+		}
+		var syns []string
+		for _, syn := range strings.Split(list, ",") {
+			if syn = strings.TrimSpace(syn); syn != "" {
+				syns = append(syns, syn)
+			}
+		}
+		synonyms[strings.ToLower(strings.TrimSpace(term))] = syns
+	}
+	return nil
+}
+
+// expandQuery appends the synonyms of each query word under -expand, so
+// short slangy queries embed closer to descriptive text
+func expandQuery(text string) string {
+	if !*expand {
+		return text
+	}
+	seen := make(map[string]bool)
+	var extra []string
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		word = strings.Trim(word, ".,!?;:'\"")
+		for _, syn := range synonyms[word] {
+			if !seen[syn] {
+				seen[syn] = true
+				extra = append(extra, syn)
+			}
+		}
+	}
+	if len(extra) == 0 {
+		return text
+	}
+	return text + " " + strings.Join(extra, " ")
+}
+
+// fullTextQuery fetches the BM25 retriever's candidates
+func fullTextQuery(ctx context.Context, client *antfly.AntflyClient, text string) ([]antfly.Hit, error) {
+	q := query.NewMatch(text, "combined_text")
+	hits, err := runQuery(ctx, client, antfly.QueryRequest{
+		Table:          tableFor(ctx),
+		FullTextSearch: &q,
+		FilterQuery:    datasetFilter(),
+		Limit:          window(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("full-text query: %w", err)
+	}
+	return hits, nil
+}
+
+// similarSearch runs a pure vector query seeded with a doc's stored
+// embedding and drops the doc itself from the results
+func similarSearch(ctx context.Context, client *antfly.AntflyClient, docID string) ([]searchHit, error) {
+	vec, err := storedEmbedding(ctx, client, docID)
+	if err != nil {
+		return nil, fmt.Errorf("embedding for %s: %w", docID, err)
+	}
+
+	hits, err := runQuery(ctx, client, antfly.QueryRequest{
+		Table:       tableFor(ctx),
+		Indexes:     []string{*vectorIndex},
+		Embeddings:  map[string][]float32{*vectorIndex: vec},
+		FilterQuery: datasetFilter(),
+		Limit:       window() + 1, // the doc itself comes back as its own nearest neighbour
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vector query: %w", err)
+	}
+
+	var results []searchHit
+	for _, hit := range hits {
+		if hit.ID == docID || blocklist.MatchDoc(hit.Source) {
+			continue
+		}
+		results = append(results, searchHit{
+			ID:          hit.ID,
+			Score:       hit.Score,
+			VectorRank:  len(results) + 1,
+			VectorScore: hit.Score,
+			Rank:        len(results) + 1,
+			Source:      hit.Source,
+		})
+	}
+	return results, nil
+}
+
+// datasetFilter restricts results to one -dataset tag, or returns nil.
+// match_phrase tolerates the analyzer lowercasing/tokenizing the stored value.
+func datasetFilter() *query.Query {
+	if *dataset == "" {
+		return nil
+	}
+	q := query.NewMatchPhrase(*dataset, "dataset")
+	return &q
+}
+
+// prune collects every doc matching -filter (and -dataset), then deletes
+// them in batches. IDs are gathered before any delete so paging offsets
+// don't shift underneath us.
+func prune(ctx context.Context, client *antfly.AntflyClient) error {
+	if *pruneFilter == "" && *dataset == "" {
+		return fmt.Errorf("prune needs -filter and/or -dataset")
+	}
+
+	req := antfly.QueryRequest{
+		Table:       table(),
+		FilterQuery: datasetFilter(),
+		Fields:      []string{"gif_url"},
+		Limit:       *batchSize,
+	}
+	if *pruneFilter != "" {
+		q := query.NewQueryString(*pruneFilter)
+		req.FullTextSearch = &q
+	} else {
+		q := query.NewMatchAll()
+		req.FullTextSearch = &q
+	}
+
+	var ids []string
+	for {
+		hits, err := runQuery(ctx, client, req)
+		if err != nil {
+			return fmt.Errorf("query matches: %w", err)
+		}
+		for _, hit := range hits {
+			ids = append(ids, hit.ID)
+		}
+		if len(hits) < *batchSize {
+			break
+		}
+		req.Offset += len(hits)
+	}
+
+	fmt.Printf("%d docs in '%s' match the filter\n", len(ids), table())
+	if *dryRun {
+		for i, id := range ids {
+			if i == 10 {
+				fmt.Printf("  ... and %d more\n", len(ids)-10)
+				break
+			}
+			fmt.Printf("  %s\n", id)
+		}
+		return nil
+	}
+
+	deleted := 0
+	for start := 0; start < len(ids); start += *batchSize {
+		end := min(start+*batchSize, len(ids))
+		if _, err := client.Batch(ctx, table(), antfly.BatchRequest{
+			Deletes: ids[start:end],
+		}); err != nil {
+			return fmt.Errorf("delete batch at %d: %w", start, err)
+		}
+		deleted += end - start
+		fmt.Printf("\rDeleted: %d/%d", deleted, len(ids))
+	}
+	fmt.Printf("\nPruned %d docs\n", deleted)
+	return nil
+}
+
+// runQuery executes a single query and returns its hits
+func runQuery(ctx context.Context, client *antfly.AntflyClient, req antfly.QueryRequest) ([]antfly.Hit, error) {
+	resp, err := client.Query(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Responses) == 0 {
+		return nil, nil
+	}
+	if resp.Responses[0].Error != "" {
+		return nil, fmt.Errorf("%s", resp.Responses[0].Error)
+	}
+	return resp.Responses[0].Hits.Hits, nil
+}
+
+// fuseRRF combines two ranked lists with weighted Reciprocal Rank Fusion:
+// score = vectorWeight/(k+vectorRank) + textWeight/(k+textRank).
+// Hits matching -blocklist are dropped before ranking.
+func fuseRRF(vectorHits, textHits []antfly.Hit) []searchHit {
+	byID := make(map[string]*searchHit)
+	get := func(hit antfly.Hit) *searchHit {
+		h, ok := byID[hit.ID]
+		if !ok {
+			h = &searchHit{ID: hit.ID, Source: hit.Source}
+			byID[hit.ID] = h
+		}
+		return h
+	}
+
+	for i, hit := range vectorHits {
+		h := get(hit)
+		h.VectorRank = i + 1
+		h.VectorScore = hit.Score
+		h.Score += *vectorWeight / (*rrfK + float64(i+1))
+	}
+	for i, hit := range textHits {
+		h := get(hit)
+		h.TextRank = i + 1
+		h.Score += *textWeight / (*rrfK + float64(i+1))
+	}
+
+	fused := make([]searchHit, 0, len(byID))
+	for _, h := range byID {
+		if blocklist.MatchDoc(h.Source) {
+			continue
+		}
+		fused = append(fused, *h)
+	}
+	sort.Slice(fused, func(i, j int) bool {
+		if fused[i].Score != fused[j].Score {
+			return fused[i].Score > fused[j].Score
+		}
+		return fused[i].ID < fused[j].ID
+	})
+	for i := range fused {
+		fused[i].Rank = i + 1
+	}
+	return fused
+}
+
+// window is how many candidates each retriever fetches. Antfly can't offset
+// semantic queries, so deeper pages fetch a larger window and slice it.
+func window() int {
+	return max(*candidates, *offset+*limit)
+}
+
+// page returns hits[offset:offset+limit], clamped to the available results
+func page(hits []searchHit, offset, limit int) []searchHit {
+	offset, limit = max(offset, 0), max(limit, 0)
+	if offset >= len(hits) {
+		return nil
+	}
+	return hits[offset:min(offset+limit, len(hits))]
+}
+
+// sampleHit draws one hit with probability softmax(score/top/temperature).
+// Dividing by the top score puts fused scores on a 0..1 scale, so the
+// temperature means the same thing whatever -rrf-k and the weights are.
+func sampleHit(hits []searchHit, temperature float64) searchHit {
+	top := hits[0].Score
+	for _, h := range hits {
+		top = max(top, h.Score)
+	}
+	if top <= 0 || temperature <= 0 {
+		return hits[0]
+	}
+	weights := make([]float64, len(hits))
+	var total float64
+	for i, h := range hits {
+		// Shifted by the max (1) so exp can't overflow at low temperatures
+		weights[i] = math.Exp((h.Score/top - 1) / temperature)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r < 0 {
+			return hits[i]
+		}
+	}
+	return hits[len(hits)-1]
+}
+
+func printHits(hits []searchHit) {
+	if len(hits) == 0 {
+		fmt.Println("No results")
+		return
+	}
+	for _, h := range hits {
+		fmt.Printf("%2d. %.4f (vector #%d, text #%d) %s\n", h.Rank, h.Score, h.VectorRank, h.TextRank, stringField(h.Source, "gif_url"))
+		if h.Table != "" {
+			fmt.Printf("    table=%s\n", h.Table)
+		}
+		if h.Reranked {
+			fmt.Printf("    reranker=%.4f\n", h.RerankScore)
+		}
+		if h.Steered {
+			fmt.Printf("    cosine=%.4f negative=%.4f\n", h.Cosine, h.NegCosine)
+		} else if h.Verified {
+			fmt.Printf("    antfly=%.4f cosine=%.4f\n", h.VectorScore, h.Cosine)
+		}
+		if literal := stringField(h.Source, "literal"); literal != "" {
+			fmt.Printf("    %s\n", literal)
+		}
+	}
+}
+
+// rerank scores the top -rerank-top hits' descriptions against the query
+// with a cross-encoder and reorders them by that score; the tail keeps its
+// fused order behind them. hits itself is left alone (serve caches it).
+func rerank(ctx context.Context, text string, hits []searchHit) ([]searchHit, error) {
+	n := min(*rerankTop, len(hits))
+	if n == 0 {
+		return hits, nil
+	}
+	texts := make([]string, n)
+	for i, h := range hits[:n] {
+		texts[i] = description(h.Source)
+	}
+
+	jsonBody, err := json.Marshal(map[string]any{"query": text, "texts": texts})
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", *rerankerURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rerankHeaders.apply(req.Header)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reranker error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var scores []struct {
+		Index int     `json:"index"`
+		Score float64 `json:"score"`
+	}
+	if err := json.Unmarshal(body, &scores); err != nil {
+		return nil, fmt.Errorf("parse response: %w", err)
+	}
+
+	out := slices.Clone(hits)
+	for _, s := range scores {
+		if s.Index < 0 || s.Index >= n {
+			return nil, fmt.Errorf("reranker returned index %d for %d texts", s.Index, n)
+		}
+		out[s.Index].RerankScore = s.Score
+		out[s.Index].Reranked = true
+	}
+	// Stable, so unscored candidates and ties keep their fused order
+	sort.SliceStable(out[:n], func(i, j int) bool {
+		if out[i].Reranked != out[j].Reranked {
+			return out[i].Reranked
+		}
+		return out[i].RerankScore > out[j].RerankScore
+	})
+	for i := range out {
+		out[i].Rank = i + 1
+	}
+	return out, nil
+}
+
+// verifyHits embeds the query with the table's model and recomputes cosine
+// similarity against each hit's stored vector. A large gap from Antfly's
+// score points at a metric or normalization misconfiguration.
+func verifyHits(ctx context.Context, client *antfly.AntflyClient, text string, hits []searchHit) error {
+	queryVec, err := getTextEmbedding(ctx, text)
+	if err != nil {
+		return fmt.Errorf("embed query: %w", err)
+	}
+
+	for i := range hits {
+		stored, err := storedEmbedding(withTable(ctx, hits[i].Table), client, hits[i].ID)
+		if err != nil {
+			log.Printf("Warning: no stored embedding for %s: %v", hits[i].ID, err)
+			continue
+		}
+		if len(stored) != len(queryVec) {
+			log.Printf("Warning: %s has dimension %d, query has %d", hits[i].ID, len(stored), len(queryVec))
+			continue
+		}
+		hits[i].Cosine = cosine(queryVec, stored)
+		hits[i].Verified = true
+	}
+	return nil
+}
+
+// steerAway reranks the fused candidates by cos(query) - λ·cos(negative),
+// using each candidate's stored vector. Candidates without a usable vector
+// are dropped, since they can't be scored against the negative text.
+func steerAway(ctx context.Context, client *antfly.AntflyClient, text, neg string, hits []searchHit) ([]searchHit, error) {
+	queryVec, err := getTextEmbedding(ctx, text)
+	if err != nil {
+		return nil, fmt.Errorf("embed query: %w", err)
+	}
+	negVec, err := getTextEmbedding(ctx, neg)
+	if err != nil {
+		return nil, fmt.Errorf("embed negative: %w", err)
+	}
+
+	steered := make([]searchHit, 0, len(hits))
+	for _, h := range hits {
+		stored, err := storedEmbedding(withTable(ctx, h.Table), client, h.ID)
+		if err != nil {
+			log.Printf("Warning: no stored embedding for %s: %v", h.ID, err)
+			continue
+		}
+		if len(stored) != len(queryVec) {
+			log.Printf("Warning: %s has dimension %d, query has %d", h.ID, len(stored), len(queryVec))
+			continue
+		}
+		h.Cosine = cosine(queryVec, stored)
+		h.NegCosine = cosine(negVec, stored)
+		h.Score = h.Cosine - *negWeight*h.NegCosine
+		h.Verified = true
+		h.Steered = true
+		steered = append(steered, h)
+	}
+
+	sort.Slice(steered, func(i, j int) bool {
+		if steered[i].Score != steered[j].Score {
+			return steered[i].Score > steered[j].Score
+		}
+		return steered[i].ID < steered[j].ID
+	})
+	for i := range steered {
+		steered[i].Rank = i + 1
+	}
+	return steered, nil
+}
+
+// storedEmbedding fetches a document's vector from _embeddings.embeddings
+func storedEmbedding(ctx context.Context, client *antfly.AntflyClient, docID string) ([]float32, error) {
+	doc, err := client.LookupKeyWithFields(ctx, tableFor(ctx), docID, "_embeddings")
+	if err != nil {
+		return nil, err
+	}
+	return docEmbedding(doc)
+}
+
+// verifyChecksums compares each hit's stored vector against the checksum
+// computed at ingest. A mismatch means Antfly holds a different vector than
+// the one we sent.
+func verifyChecksums(ctx context.Context, client *antfly.AntflyClient, hits []searchHit) {
+	ok, bad, missing := 0, 0, 0
+	for _, h := range hits {
+		doc, err := client.LookupKeyWithFields(ctx, tableFor(withTable(ctx, h.Table)), h.ID, "_embeddings,embed_checksum")
+		if err != nil {
+			log.Printf("Warning: lookup %s: %v", h.ID, err)
+			continue
+		}
+		want := stringField(doc, "embed_checksum")
+		vec, err := docEmbedding(doc)
+		if want == "" || err != nil {
+			missing++
+			continue
+		}
+		if got := embedChecksum(vec); got != want {
+			log.Printf("Warning: %s stored vector checksum %s, ingested as %s", h.ID, got, want)
+			bad++
+			continue
+		}
+		ok++
+	}
+	fmt.Printf("Checksums: %d match, %d mismatch, %d without checksum\n", ok, bad, missing)
+}
+
+// embedChecksum is the CRC32 of the vector's little-endian float32 bytes,
+// matching main.go's embed_checksum
+func embedChecksum(vec []float32) string {
+	buf := make([]byte, 4*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(buf))
+}
+
+// docEmbedding reads _embeddings.<index> out of a looked-up doc
+func docEmbedding(doc map[string]any) ([]float32, error) {
+	embeddings, _ := doc["_embeddings"].(map[string]any)
+	values, ok := embeddings[*vectorIndex].([]any)
+	if !ok {
+		return nil, fmt.Errorf("missing _embeddings.%s", *vectorIndex)
+	}
+
+	vec := make([]float32, len(values))
+	for i, v := range values {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("non-numeric value at %d", i)
+		}
+		vec[i] = float32(f)
+	}
+	return vec, nil
+}
+
+// cosine returns the cosine similarity of two equal-length vectors
+func cosine(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// getTextEmbedding calls Termite's embed API directly to embed a query string
+func getTextEmbedding(ctx context.Context, text string) ([]float32, error) {
+	return embedText(ctx, *embedModel, text)
+}
+
+// embedText is getTextEmbedding with a model other than -embed-model
+func embedText(ctx context.Context, model, text string) ([]float32, error) {
+	reqBody := map[string]any{
+		"model": model,
+		"input": []string{text},
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", *termiteURL+"/api/embed", bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	termiteHeaders.apply(req.Header)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("termite error %d: %s", resp.StatusCode, string(body))
+	}
+
+	// Response is binary: uint64(numVectors) + uint64(dimension) + float32 values
+	return deserializeEmbedding(body)
+}
+
+// deserializeEmbedding parses Termite's binary embedding response
+func deserializeEmbedding(data []byte) ([]float32, error) {
+	r := bytes.NewReader(data)
+
+	var numVectors uint64
+	if err := binary.Read(r, binary.LittleEndian, &numVectors); err != nil {
+		return nil, fmt.Errorf("read numVectors: %w", err)
+	}
+	if numVectors == 0 {
+		return nil, fmt.Errorf("no embeddings returned")
+	}
+
+	var dimension uint64
+	if err := binary.Read(r, binary.LittleEndian, &dimension); err != nil {
+		return nil, fmt.Errorf("read dimension: %w", err)
+	}
+	if dimension == 0 || dimension > uint64(r.Len())/4 {
+		return nil, fmt.Errorf("response holds %d bytes, want a vector of dimension %d", r.Len(), dimension)
+	}
+
+	embedding := make([]float32, dimension)
+	for i := range embedding {
+		if err := binary.Read(r, binary.LittleEndian, &embedding[i]); err != nil {
+			return nil, fmt.Errorf("read float %d: %w", i, err)
+		}
+	}
+
+	return embedding, nil
+}
+
+// stringField returns a string field from a document source, or "" if absent
+func stringField(source map[string]any, key string) string {
+	if s, ok := source[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// writeCSV exports results with credit info for sharing outside the terminal
+func writeCSV(path string, hits []searchHit) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create csv: %w", err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"rank", "score", "gif_url", "description", "attribution", "provider", "tumblr_id"}); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	for i, h := range hits {
+		gifURL := stringField(h.Source, "gif_url")
+
+		// Mirror ingest: the per-doc attribution wins, otherwise the default
+		credit := stringField(h.Source, "attribution")
+		if credit == "" {
+			credit = *attribution
+		}
+
+		tumblrID := stringField(h.Source, "tumblr_id")
+		if tumblrID == "" {
+			tumblrID = extractTumblrID(gifURL)
+		}
+
+		row := []string{
+			strconv.Itoa(h.Rank),
+			strconv.FormatFloat(h.Score, 'f', 6, 64),
+			gifURL,
+			description(h.Source),
+			credit,
+			provider(gifURL),
+			tumblrID,
+		}
+		if err := w.Write(row); err != nil {
+			return fmt.Errorf("write row %d: %w", i+1, err)
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// contactSheet lays results out as a grid of captioned GIFs
+var contactSheet = template.Must(template.New("sheet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Query}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(240px, 1fr)); gap: 1em; }
+figure { margin: 0; }
+img { width: 100%; border-radius: 4px; background: #eee; }
+figcaption { font-size: 0.85em; }
+.score { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Query}}</h1>
+<p>{{len .Results}} results, table {{.Table}}</p>
+<div class="grid">
+{{- range .Results}}
+<figure>
+<a href="{{.GifURL}}"><img src="{{.GifURL}}" loading="lazy" alt="{{.Description}}"></a>
+<figcaption><b>#{{.Rank}}</b> <span class="score">{{printf "%.4f" .Score}}{{if .Table}} · {{.Table}}{{end}}</span><br>{{.Description}}{{if .Attribution}}<br><i>{{.Attribution}}</i>{{end}}</figcaption>
+</figure>
+{{- end}}
+</div>
+</body>
+</html>
+`))
+
+// writeHTML writes the results as a static contact sheet for eyeballing
+// relevance, which the terminal's URLs can't show
+func writeHTML(path, query string, hits []searchHit) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create html: %w", err)
+	}
+	defer file.Close()
+
+	tableLabel := table()
+	if *tables != "" {
+		tableLabel = *tables
+	}
+	err = contactSheet.Execute(file, map[string]any{
+		"Query":   query,
+		"Table":   tableLabel,
+		"Results": toResults(hits),
+	})
+	if err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+	return file.Close()
+}
+
+// description picks the best human-readable description from a document
+func description(source map[string]any) string {
+	for _, key := range []string{"literal", "description", "original_description", "combined_text"} {
+		if s := stringField(source, key); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// provider names the GIF host from its URL (e.g. "tumblr" for 64.media.tumblr.com)
+func provider(gifURL string) string {
+	u, err := url.Parse(gifURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	if len(labels) < 2 {
+		return labels[0]
+	}
+	return labels[len(labels)-2]
+}
+
+// extractTumblrID extracts the tumblr post ID from a GIF URL
+func extractTumblrID(url string) string {
+	matches := tumblrIDRegex.FindStringSubmatch(url)
+	if len(matches) >= 2 {
+		return matches[1]
+	}
+	return ""
+}
+
+// pickResult is the JSON shape of one result in serve mode
+type pickResult struct {
+	Rank        int     `json:"rank"`
+	Score       float64 `json:"score"`
+	ID          string  `json:"id"`
+	GifURL      string  `json:"gif_url"`
+	Description string  `json:"description"`
+	Attribution string  `json:"attribution,omitempty"`
+	Table       string  `json:"table,omitempty"`
+}
+
+func toResults(hits []searchHit) []pickResult {
+	results := make([]pickResult, len(hits))
+	for i, h := range hits {
+		credit := stringField(h.Source, "attribution")
+		if credit == "" {
+			credit = *attribution
+		}
+		results[i] = pickResult{
+			Rank:        h.Rank,
+			Score:       h.Score,
+			ID:          h.ID,
+			GifURL:      stringField(h.Source, "gif_url"),
+			Description: description(h.Source),
+			Attribution: credit,
+			Table:       h.Table,
+		}
+	}
+	return results
+}
+
+// serve runs the HTTP picker until the listener fails
+func serve(client *antfly.AntflyClient) error {
+	streams := make(chan struct{}, *maxStreams)
+	results = newResultCache(*cacheSize, *cacheTTL)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pick", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		if q == "" {
+			http.Error(w, "missing q", http.StatusBadRequest)
+			return
+		}
+		hits, err := results.search(r.Context(), client, q)
+		if err != nil {
+			log.Printf("Warning: search %q failed: %v", q, err)
+			http.Error(w, "search failed", http.StatusBadGateway)
+			return
+		}
+		if *rerankerURL != "" {
+			// Better unreranked results than none
+			if reranked, err := rerank(r.Context(), q, hits); err != nil {
+				log.Printf("Warning: rerank %q failed: %v", q, err)
+			} else {
+				hits = reranked
+			}
+		}
+		hits = page(hits, 0, requestLimit(r))
+		logQuery("pick", q, hits)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(toResults(hits))
+	})
+	mux.HandleFunc("POST /cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if !purgeAllowed(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		purged := results.purge()
+		log.Printf("Purged %d cached queries", purged)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+	})
+	mux.HandleFunc("GET /pick/stream", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case streams <- struct{}{}:
+			defer func() { <-streams }()
+		default:
+			http.Error(w, "too many streams", http.StatusServiceUnavailable)
+			return
+		}
+		streamPick(w, r, client)
+	})
+
+	if *slackSecret != "" {
+		mux.HandleFunc("POST /slack", func(w http.ResponseWriter, r *http.Request) {
+			slackCommand(w, r, client)
+		})
+	}
+
+	server := &http.Server{
+		Addr:              *serveAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if *alias != "" && *aliasRefresh > 0 {
+		go watchAlias(client)
+	}
+	fmt.Printf("Serving picker for '%s' on %s\n", table(), *serveAddr)
+	return server.ListenAndServe()
+}
+
+// results caches serve's fused result lists; nil (no caching) outside serve
+var results *resultCache
+
+// resultCache is an LRU of fused result lists with a TTL. Entries hold the
+// whole fused list, so one entry serves any n; the key is the table (an
+// alias can move) and the normalized query, the only per-request inputs to
+// the search; -dataset and the weights are fixed for the process.
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+type cachedResult struct {
+	key     string
+	hits    []searchHit
+	expires time.Time
+}
+
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	if size <= 0 {
+		return nil
+	}
+	return &resultCache{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// search answers from the cache when it can, else runs a hybrid search and
+// caches the result. A nil cache always searches.
+func (c *resultCache) search(ctx context.Context, client *antfly.AntflyClient, q string) ([]searchHit, error) {
+	retrieve := func(ctx context.Context) ([]antfly.Hit, []antfly.Hit, error) {
+		return hybridRetrieve(ctx, client, q)
+	}
+	if c == nil {
+		return searchTables(ctx, retrieve)
+	}
+	key := table() + "\x00" + *tables + "\x00" + strings.Join(strings.Fields(strings.ToLower(q)), " ")
+	if hits, ok := c.get(key); ok {
+		return hits, nil
+	}
+	hits, err := searchTables(ctx, retrieve)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, hits)
+	return hits, nil
+}
+
+func (c *resultCache) get(key string) ([]searchHit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cachedResult)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.hits, true
+}
+
+func (c *resultCache) put(key string, hits []searchHit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cachedResult{key: key, hits: hits, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+}
+
+// purgeAllowed admits /cache/purge callers bearing -purge-token, or without
+// one set, only loopback clients
+func purgeAllowed(r *http.Request) bool {
+	if *purgeToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && hmac.Equal([]byte(token), []byte(*purgeToken))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// purge empties the cache and returns how many entries it held
+func (c *resultCache) purge() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.order.Init()
+	clear(c.entries)
+	return n
+}
+
+// slackShufflePool is how many top results "/gif shuffle ..." samples from
+const slackShufflePool = 5
+
+// slackCommand answers a Slack slash command with the best GIF for its text
+func slackCommand(w http.ResponseWriter, r *http.Request, client *antfly.AntflyClient) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "read body", http.StatusBadRequest)
+		return
+	}
+	if err := verifySlack(r.Header, body, time.Now()); err != nil {
+		log.Printf("Warning: rejected /slack request: %v", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	q := strings.TrimSpace(form.Get("text"))
+	shuffle := false
+	if rest, ok := strings.CutPrefix(q, "shuffle "); ok {
+		q, shuffle = strings.TrimSpace(rest), true
+	}
+	reply := func(v map[string]any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	if q == "" {
+		reply(map[string]any{"response_type": "ephemeral", "text": "Usage: " + form.Get("command") + " [shuffle] <what you're feeling>"})
+		return
+	}
+
+	hits, err := results.search(r.Context(), client, q)
+	if err != nil {
+		log.Printf("Warning: search %q failed: %v", q, err)
+		reply(map[string]any{"response_type": "ephemeral", "text": "Search failed, try again in a moment"})
+		return
+	}
+	if len(hits) == 0 {
+		reply(map[string]any{"response_type": "ephemeral", "text": "No GIFs found for \"" + q + "\""})
+		return
+	}
+	hit := hits[0]
+	if shuffle {
+		hit = sampleHit(page(hits, 0, slackShufflePool), *temperature)
+	}
+	logQuery("slack", q, []searchHit{hit})
+
+	gifURL := stringField(hit.Source, "gif_url")
+	alt := description(hit.Source)
+	if alt == "" {
+		alt = q
+	}
+	reply(map[string]any{
+		"response_type": "in_channel",
+		"text":          gifURL,
+		"blocks": []map[string]any{{
+			"type":      "image",
+			"image_url": gifURL,
+			"alt_text":  alt,
+			"title":     map[string]any{"type": "plain_text", "text": q},
+		}},
+	})
+}
+
+// verifySlack checks Slack's request signature: v0= hex HMAC-SHA256 of
+// "v0:<timestamp>:<body>" under the signing secret. Old timestamps are
+// rejected so a captured request can't be replayed.
+func verifySlack(header http.Header, body []byte, now time.Time) error {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp %q", ts)
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > 5*time.Minute || age < -5*time.Minute {
+		return fmt.Errorf("timestamp %s off by %s", ts, age.Round(time.Second))
+	}
+	mac := hmac.New(sha256.New, []byte(*slackSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(header.Get("X-Slack-Signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// queryRecord is one -query-log line
+type queryRecord struct {
+	Time    time.Time      `json:"ts"`
+	Via     string         `json:"via"` // cli, pick, stream or slack
+	Query   string         `json:"q"`
+	Table   string         `json:"table"`
+	Params  map[string]any `json:"params"`
+	Results []loggedHit    `json:"results"`
+}
+
+type loggedHit struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+	Rank  int     `json:"rank"`
+}
+
+// queryLogQueue feeds the -query-log writer, so logging never delays a
+// response; when it's full, records are dropped and counted
+var (
+	queryLogQueue   chan queryRecord
+	queryLogDone    chan struct{}
+	queryLogDropped atomic.Int64
+)
+
+func openQueryLog(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	queryLogQueue = make(chan queryRecord, 1024)
+	queryLogDone = make(chan struct{})
+	go func() {
+		defer close(queryLogDone)
+		defer file.Close()
+		enc := json.NewEncoder(file)
+		for rec := range queryLogQueue {
+			if err := enc.Encode(rec); err != nil {
+				log.Printf("Warning: query log: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// closeQueryLog drains pending records before the process exits
+func closeQueryLog() {
+	close(queryLogQueue)
+	<-queryLogDone
+	if n := queryLogDropped.Load(); n > 0 {
+		log.Printf("Warning: query log dropped %d records", n)
+	}
+}
+
+// logQuery queues a query and what it returned, if -query-log is on
+func logQuery(via, q string, hits []searchHit) {
+	if queryLogQueue == nil {
+		return
+	}
+	rec := queryRecord{
+		Time:  time.Now().UTC(),
+		Via:   via,
+		Query: q,
+		Table: table(),
+		Params: map[string]any{
+			"limit":         *limit,
+			"offset":        *offset,
+			"candidates":    *candidates,
+			"vector_weight": *vectorWeight,
+			"text_weight":   *textWeight,
+			"rrf_k":         *rrfK,
+			"dataset":       *dataset,
+			"expand":        *expand,
+			"negative":      *negative,
+			"pick_random":   *pickRandom,
+			"embed_model":   *embedModel,
+		},
+		Results: make([]loggedHit, len(hits)),
+	}
+	for i, h := range hits {
+		rec.Results[i] = loggedHit{ID: h.ID, Score: h.Score, Rank: h.Rank}
+	}
+	select {
+	case queryLogQueue <- rec:
+	default:
+		queryLogDropped.Add(1)
+	}
+}
+
+// requestLimit reads ?n=, defaulting to -limit and capped at -candidates
+func requestLimit(r *http.Request) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = *limit
+	}
+	return min(n, *candidates)
+}
+
+// streamPick runs both retrievers concurrently (each across -tables) and
+// sends a fused ranking as each one answers. Fast keystrokes are handled by the browser closing the
+// EventSource: the request context cancels any in-flight queries.
+func streamPick(w http.ResponseWriter, r *http.Request, client *antfly.AntflyClient) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return
+	}
+	n := requestLimit(r)
+	ctx := r.Context()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(event string, v any) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+
+	type retrieved struct {
+		vector bool
+		lists  [][]antfly.Hit
+		err    error
+	}
+	names := tableList()
+	results := make(chan retrieved, 2)
+	pending := 0
+	if *vectorWeight > 0 {
+		pending++
+		go func() {
+			lists, _, err := retrieveTables(ctx, names, func(ctx context.Context) ([]antfly.Hit, []antfly.Hit, error) {
+				hits, err := semanticQuery(ctx, client, q)
+				return hits, nil, err
+			})
+			results <- retrieved{vector: true, lists: lists, err: err}
+		}()
+	}
+	if *textWeight > 0 {
+		pending++
+		go func() {
+			_, lists, err := retrieveTables(ctx, names, func(ctx context.Context) ([]antfly.Hit, []antfly.Hit, error) {
+				hits, err := fullTextQuery(ctx, client, q)
+				return nil, hits, err
+			})
+			results <- retrieved{lists: lists, err: err}
+		}()
+	}
+
+	var vectorLists, textLists [][]antfly.Hit
+	for pending > 0 {
+		var res retrieved
+		select {
+		case <-ctx.Done():
+			return
+		case res = <-results:
+		}
+		pending--
+		if res.err != nil {
+			log.Printf("Warning: stream search %q failed: %v", q, res.err)
+			send("error", map[string]string{"error": "search failed"})
+			return
+		}
+		if res.vector {
+			vectorLists = res.lists
+		} else {
+			textLists = res.lists
+		}
+
+		event := "partial"
+		hits := page(fuseTables(names, vectorLists, textLists), 0, n)
+		if pending == 0 {
+			event = "results"
+			logQuery("stream", q, hits)
+		}
+		send(event, toResults(hits))
+	}
+	send("done", struct{}{})
+}
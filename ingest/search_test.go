@@ -0,0 +1,194 @@
+// Tests for search.go, run on their own:
+//
+//	go test search.go search_test.go
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/antflydb/antfly-go/antfly"
+)
+
+func TestQueryListSet(t *testing.T) {
+	tests := []struct {
+		in     string
+		text   string
+		weight float64
+	}{
+		{"cozy", "cozy", 1},
+		{"cozy^2", "cozy", 2},
+		{"cozy:2", "cozy", 2},
+		{"autumn:1", "autumn", 1},
+		{"warm light:0.5", "warm light", 0.5},
+		{"time 10:30", "time 10:30", 1},
+		{"see: notes", "see: notes", 1},
+		{"autumn leaves ^0.5", "autumn leaves", 0.5},
+		{"aspect 16:9", "aspect 16:9", 1},
+		{"ratio 4:3^3", "ratio 4:3", 3},
+		{"x^y", "x^y", 1},
+	}
+	for _, tt := range tests {
+		var q queryList
+		if err := q.Set(tt.in); err != nil {
+			t.Errorf("Set(%q): %v", tt.in, err)
+			continue
+		}
+		if q[0].text != tt.text || q[0].weight != tt.weight {
+			t.Errorf("Set(%q) = %q^%g, want %q^%g", tt.in, q[0].text, q[0].weight, tt.text, tt.weight)
+		}
+	}
+
+	for _, bad := range []string{"cozy^0", "cozy^-1", "cozy:0", "^2", ":2", "  "} {
+		var q queryList
+		if err := q.Set(bad); err == nil {
+			t.Errorf("Set(%q) = %v, want an error", bad, q)
+		}
+	}
+}
+
+func TestPurgeAllowed(t *testing.T) {
+	request := func(remote, auth string) bool {
+		r := httptest.NewRequest("POST", "/cache/purge", nil)
+		r.RemoteAddr = remote
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return purgeAllowed(r)
+	}
+
+	if !request("127.0.0.1:5000", "") || !request("[::1]:5000", "") {
+		t.Error("loopback purge refused with no -purge-token")
+	}
+	if request("10.0.0.7:5000", "") {
+		t.Error("remote purge allowed with no -purge-token")
+	}
+
+	old := *purgeToken
+	*purgeToken = "s3cret"
+	defer func() { *purgeToken = old }()
+	if !request("10.0.0.7:5000", "Bearer s3cret") {
+		t.Error("purge with the right token refused")
+	}
+	for _, auth := range []string{"", "Bearer wrong", "s3cret", "Bearer s3cret2"} {
+		if request("127.0.0.1:5000", auth) {
+			t.Errorf("purge allowed with Authorization %q", auth)
+		}
+	}
+}
+
+// TestSearchTablesMergesRawScores checks that -tables ranks by the
+// retrievers' raw scores across tables, not by each table's own ranks
+func TestSearchTablesMergesRawScores(t *testing.T) {
+	old := *tables
+	*tables = "a,b"
+	defer func() { *tables = old }()
+
+	hit := func(id string, score float64) antfly.Hit {
+		return antfly.Hit{ID: id, Score: score, Source: map[string]any{"gif_url": "https://example.com/" + id + ".gif"}}
+	}
+	vector := map[string][]antfly.Hit{
+		"a": {hit("a1", 0.61), hit("a2", 0.60), hit("a3", 0.59)},
+		"b": {hit("b1", 0.95), hit("b2", 0.90), hit("a1", 0.10)},
+	}
+	text := map[string][]antfly.Hit{
+		"a": {hit("a2", 12)},
+		"b": {hit("b2", 3)},
+	}
+	hits, err := searchTables(context.Background(), func(ctx context.Context) ([]antfly.Hit, []antfly.Hit, error) {
+		return vector[tableFor(ctx)], text[tableFor(ctx)], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids, from []string
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+		from = append(from, h.Table)
+	}
+	// b2 and a2 lead on both retrievers; b1 beats every other a on vectors
+	if want := []string{"b2", "a2", "b1", "a1", "a3"}; !slices.Equal(ids, want) {
+		t.Errorf("order = %q, want %q", ids, want)
+	}
+	if want := []string{"b", "a", "b", "a", "a"}; !slices.Equal(from, want) {
+		t.Errorf("tables = %q, want %q", from, want)
+	}
+}
+
+func TestCheckEmbedders(t *testing.T) {
+	tablesJSON := map[string]string{
+		"served": `{"name":"served","indexes":{"embeddings":{"name":"embeddings","type":"aknn_v0","dimension":384,"embedder":{"provider":"termite","model":"BAAI/bge-small-en-v1.5"}}}}`,
+		"bare":   `{"name":"bare","indexes":{"embeddings":{"name":"embeddings","type":"aknn_v0","dimension":384}}}`,
+		"other":  `{"name":"other","indexes":{"siglip":{"name":"siglip","type":"aknn_v0","dimension":768}}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := tablesJSON[path.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	client, err := antfly.NewAntflyClient(srv.URL+"/api/v1", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldTables, oldClient := *tables, *clientEmbed
+	defer func() { *tables, *clientEmbed = oldTables, oldClient }()
+	tests := []struct {
+		tables  string
+		client  bool
+		wantErr string
+	}{
+		{"served", false, ""},
+		{"served,bare", false, "no server-side embedder"},
+		{"bare", true, ""},
+		{"other", false, `no index "embeddings"`},
+	}
+	for _, tt := range tests {
+		*tables, *clientEmbed = tt.tables, tt.client
+		err := checkEmbedders(context.Background(), client)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s (client-embed %v): %v", tt.tables, tt.client, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s (client-embed %v) = %v, want an error containing %q", tt.tables, tt.client, err, tt.wantErr)
+		}
+	}
+}
+
+// TestFuseTablesPartial is streamPick's first event: only the vector
+// retriever has answered, across two tables
+func TestFuseTablesPartial(t *testing.T) {
+	hit := func(id string, score float64) antfly.Hit {
+		return antfly.Hit{ID: id, Score: score, Source: map[string]any{"gif_url": "https://example.com/" + id + ".gif"}}
+	}
+	vectorLists := [][]antfly.Hit{
+		{hit("a1", 0.5), hit("a2", 0.4)},
+		{hit("b1", 0.9), hit("a1", 0.1)},
+	}
+	hits := fuseTables([]string{"a", "b"}, vectorLists, nil)
+
+	var ids, from []string
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+		from = append(from, h.Table)
+	}
+	if want := []string{"b1", "a1", "a2"}; !slices.Equal(ids, want) {
+		t.Errorf("order = %q, want %q", ids, want)
+	}
+	if want := []string{"b", "a", "a"}; !slices.Equal(from, want) {
+		t.Errorf("tables = %q, want %q", from, want)
+	}
+}